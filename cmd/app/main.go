@@ -3,30 +3,49 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strings"
 
 	"github.com/1F47E/go-shaihulud/internal/client"
+	"github.com/1F47E/go-shaihulud/internal/client/forward"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/client/pipe"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
 	myrsa "github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rsa"
 	"github.com/1F47E/go-shaihulud/internal/logger"
+	"github.com/1F47E/go-shaihulud/internal/tui"
 
 	"golang.org/x/term"
 )
 
 var log = logger.New()
 
-var usage = "Usage: <srv | cli>\n"
+var usage = "Usage: <srv | cli | pipe srv | pipe cli KEY> [-L [bind:]port:host:hostport] [-R [bind:]port:host:hostport]\n"
 
 func main() {
 
 	// get input args
-	args := os.Args
+	args, local, remote := forwardArgs(os.Args)
 	if len(args) == 1 {
 		log.Fatal(usage)
 	}
 	arg := args[1]
 
+	// pipe mode streams stdin to the peer, stdout is for the data
+	pipeMode := arg == "pipe"
+	if pipeMode {
+		logger.SetOutput(os.Stderr)
+		if len(args) < 3 {
+			log.Error(usage)
+			os.Exit(pipe.ExitUsage)
+		}
+		arg = args[2]
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// create assym crypter for communication
@@ -36,43 +55,80 @@ func main() {
 	}
 
 	// start the server or connect
-	var connType client.ConnectionType
+	connType, err := client.ParseConnectionType(cfg.CONNECTOR)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if os.Getenv("TOR") == "0" {
 		connType = client.Local
-	} else {
-		connType = client.Tor
 	}
 	cli := client.NewClient(ctx, cancel, connType, crypter)
+	var piped <-chan error
+	if pipeMode {
+		var in io.Reader = os.Stdin
+		// nothing to send from a terminal, the other side is the source
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			in = strings.NewReader("")
+		}
+		piped = cli.Pipe(in, os.Stdout)
+	}
+	if err := cli.Forward(local, remote); err != nil {
+		log.Fatal(err)
+	}
+
+	// full screen chat, the line one when there is no terminal
+	var ui *tui.UI
+	uiDone := make(chan struct{})
+	if !pipeMode && cfg.TUI && term.IsTerminal(int(os.Stdout.Fd())) {
+		ui = tui.New(cli)
+	}
+	chat := func() {
+		if ui == nil {
+			cli.CLI()
+			return
+		}
+		go func() {
+			defer close(uiDone)
+			logger.SetOutput(ui)
+			err := ui.Run(ctx)
+			logger.SetOutput(os.Stdout)
+			if err != nil && ctx.Err() == nil {
+				log.Warnf("%v, using the line mode", err)
+				cli.CLI()
+			}
+		}()
+	}
+	// gives the terminal back before the last logs
+	closeUI := func() {
+		if ui != nil {
+			cancel()
+			<-uiDone
+		}
+	}
 
 	// TODO: add new session command and connect to old session.
 	// or select a previous session from a list
+	failed := make(chan error, 1)
 	go func() {
 		switch arg {
 		case "srv":
-			session := ""
-			err := cli.RunServer(session)
-			if err != nil {
-				log.Fatalf("server start error: %v\n", err)
+			if !pipeMode {
+				chat()
 			}
-		case "cli":
-			log.Info("Enter chat key:")
-			reader := bufio.NewReader(os.Stdin)
-			key, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatalf("Error reading chat key: %v", err)
+			if err := cli.RunServer(cfg.SESSION); err != nil {
+				failed <- fmt.Errorf("server start error: %w", err)
 			}
-			key = strings.TrimSpace(key)
-			// TODO: validate key
-
-			log.Info("Enter password:")
-			password, err := term.ReadPassword(int(os.Stdin.Fd()))
-			if err != nil {
-				log.Fatalf("Error reading password: %v", err)
+		case "cli":
+			var key, password string
+			if pipeMode {
+				key, password = pipeCredentials(args)
+			} else {
+				key, password = chatCredentials()
+				// stdin is ours after the credentials
+				chat()
 			}
-
-			err = cli.RunClient(key, string(password))
-			if err != nil {
-				log.Fatalf("server connect error: %v\n", err)
+			if err := cli.RunClient(key, password); err != nil {
+				failed <- err
 			}
 
 		default:
@@ -85,9 +141,132 @@ func main() {
 		stop := make(chan os.Signal, 1)
 		signal.Notify(stop, os.Interrupt)
 		<-stop
+		// tell the peers we are leaving
+		cli.Disconnect(message.DiscQuit, "")
 		cancel()
 	}()
 
-	<-ctx.Done()
+	code := 0
+	select {
+	case err := <-failed:
+		closeUI()
+		code = exitCode(err)
+		cancel()
+	case <-ctx.Done():
+		closeUI()
+		if err := cli.Err(); err != nil {
+			code = exitCode(err)
+		} else if pipeMode {
+			code = pipe.ExitLost
+		}
+	// nil in the chat mode
+	case err := <-piped:
+		if err != nil {
+			log.Errorf("pipe: %v", err)
+		}
+		code = pipe.ExitCode(err)
+		cli.Disconnect(message.DiscQuit, "")
+		cancel()
+	}
+	cli.Close()
 	log.Warn("Bye!")
+	os.Exit(code)
+}
+
+// after the pipe mode ones, lost is the same
+const (
+	exitAuth      = 5 // wrong password or malformed key
+	exitHandshake = 6
+	exitProtocol  = 7
+)
+
+// tell the user what went wrong, the code is for scripts
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, client.ErrWrongPassword):
+		log.Error("Wrong password, check it with the server")
+		return exitAuth
+	case errors.Is(err, client.ErrMalformedKey):
+		log.Errorf("Can't read the access key, check it for typos: %v", err)
+		return exitAuth
+	case errors.Is(err, client.ErrPeerUnreachable):
+		log.Errorf("%v. Is the server running?", err)
+		return pipe.ExitLost
+	case errors.Is(err, client.ErrHandshakeFailed):
+		log.Errorf("Can't start the chat: %v", err)
+		return exitHandshake
+	case errors.Is(err, client.ErrProtocol):
+		log.Errorf("The peer broke the protocol: %v", err)
+		return exitProtocol
+	default:
+		log.Error(err)
+		return pipe.ExitError
+	}
+}
+
+// -L and -R can go anywhere, the rest are the mode args
+func forwardArgs(args []string) ([]string, []forward.Spec, []forward.Spec) {
+	var rest []string
+	var local, remote []forward.Spec
+	for i := 0; i < len(args); i++ {
+		if args[i] != "-L" && args[i] != "-R" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 == len(args) {
+			log.Fatal(usage)
+		}
+		spec, err := forward.ParseSpec(args[i+1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if args[i] == "-L" {
+			local = append(local, spec)
+		} else {
+			remote = append(remote, spec)
+		}
+		i++
+	}
+	return rest, local, remote
+}
+
+func chatCredentials() (string, string) {
+	log.Info("Enter chat key:")
+	reader := bufio.NewReader(os.Stdin)
+	key, err := reader.ReadString('\n')
+	if err != nil {
+		log.Fatalf("Error reading chat key: %v", err)
+	}
+	key = strings.TrimSpace(key)
+	// TODO: validate key
+
+	log.Info("Enter password:")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Fatalf("Error reading password: %v", err)
+	}
+	return key, string(password)
+}
+
+// stdin is the data, the key comes in args and the password from
+// SHAIHULUD_PASSWORD or the terminal
+func pipeCredentials(args []string) (string, string) {
+	if len(args) < 4 {
+		log.Error(usage)
+		os.Exit(pipe.ExitUsage)
+	}
+	if password, ok := os.LookupEnv("SHAIHULUD_PASSWORD"); ok {
+		return args[3], password
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		log.Fatalf("No terminal for the password, set SHAIHULUD_PASSWORD: %v", err)
+	}
+	defer tty.Close()
+	log.Info("Enter password:")
+	password, err := term.ReadPassword(int(tty.Fd()))
+	if err != nil {
+		log.Fatalf("Error reading password: %v", err)
+	}
+	return args[3], string(password)
 }
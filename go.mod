@@ -4,18 +4,24 @@ go 1.20
 
 require (
 	github.com/cretz/bine v0.2.0
+	github.com/gdamore/tcell/v2 v2.6.0
 	github.com/google/uuid v1.3.0
+	github.com/mattn/go-runewidth v0.0.14
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
 	golang.org/x/term v0.13.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
 	github.com/stretchr/objx v0.1.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/listner"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/pow"
+)
+
+var (
+	errServerFull = listner.ErrFull
+	errLocked     = errors.New("chat is locked to the first peer")
+	errBanned     = errors.New("temporarily banned")
+)
+
+// counters for rejected connection attempts
+type AdmissionStats struct {
+	Accepted          int64
+	RejectedFull      int64
+	RejectedLocked    int64
+	RejectedBanned    int64
+	HandshakeTimeouts int64
+	ProtocolErrors    int64
+}
+
+func (s AdmissionStats) String() string {
+	return fmt.Sprintf("accepted=%d full=%d locked=%d banned=%d handshake_timeouts=%d protocol_errors=%d",
+		s.Accepted, s.RejectedFull, s.RejectedLocked, s.RejectedBanned, s.HandshakeTimeouts, s.ProtocolErrors)
+}
+
+// first pause for the connections without a host, doubles up to the ban duration
+const minPause = time.Second
+
+// server admission policy.
+// over tor every connection comes from the local tor process, there is no
+// host to ban, see remoteHost. those share one failure budget: when it runs
+// out new ones wait before the handshake, longer every time, until a peer
+// gets through. a ban would lock the real peer out too
+type admission struct {
+	mu        sync.Mutex
+	failures  map[string][]time.Time // host -> recent failures, "" is every host we can't tell
+	bans      map[string]time.Time   // host -> banned until
+	pause     time.Duration          // last pause for the connections without a host
+	pauseEnd  time.Time
+	lockedKey []byte // first peer key in the lock mode
+	seated    int    // confirmed peers, the ones in the handshake don't count
+	now       func() time.Time
+
+	maxPeers      int
+	lock          bool
+	maxFailures   int
+	failureWindow time.Duration
+	banDuration   time.Duration
+	powDifficulty int // 0 is off
+	powMax        int
+
+	accepted          atomic.Int64
+	rejectedFull      atomic.Int64
+	rejectedLocked    atomic.Int64
+	rejectedBanned    atomic.Int64
+	handshakeTimeouts atomic.Int64
+	protocolErrors    atomic.Int64
+}
+
+func newAdmission() *admission {
+	return &admission{
+		failures:      make(map[string][]time.Time),
+		bans:          make(map[string]time.Time),
+		now:           time.Now,
+		maxPeers:      cfg.MAX_PEERS,
+		lock:          cfg.LOCK_AFTER_FIRST,
+		maxFailures:   cfg.MAX_FAILURES,
+		failureWindow: cfg.FAILURE_WINDOW,
+		banDuration:   cfg.BAN_DURATION,
+		powDifficulty: cfg.POW_DIFFICULTY,
+		powMax:        cfg.POW_MAX_DIFFICULTY,
+	}
+}
+
+// check a new connection before the handshake.
+// only confirmed peers take the room, connections without the password
+// can't lock the real peer out, they are dropped at the handshake timeout
+func (a *admission) allow(host string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if until, ok := a.bans[host]; ok {
+		if a.now().Before(until) {
+			a.rejectedBanned.Add(1)
+			return errBanned
+		}
+		delete(a.bans, host)
+	}
+	if a.maxPeers > 0 && a.seated >= a.maxPeers {
+		a.rejectedFull.Add(1)
+		return errServerFull
+	}
+	a.accepted.Add(1)
+	return nil
+}
+
+// take the room for a confirmed peer, several can finish the handshake at once
+func (a *admission) seat() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxPeers > 0 && a.seated >= a.maxPeers {
+		a.rejectedFull.Add(1)
+		return errServerFull
+	}
+	a.seated++
+	return nil
+}
+
+// seated peer is gone
+func (a *admission) leave() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seated--
+}
+
+// in the lock mode only the first peer key is allowed, so the peer can still reconnect.
+// a stranger is turned away as soon as the key comes, before the puzzle is solved
+func (a *admission) checkKey(key []byte) error {
+	if !a.lock {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockedKey != nil && !bytes.Equal(a.lockedKey, key) {
+		a.rejectedLocked.Add(1)
+		return errLocked
+	}
+	return nil
+}
+
+// lock on the first key that passed the confirmation, so only a peer
+// with the password can take the chat
+func (a *admission) pinKey(key []byte) error {
+	if !a.lock {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockedKey == nil {
+		a.lockedKey = key
+		return nil
+	}
+	if !bytes.Equal(a.lockedKey, key) {
+		a.rejectedLocked.Add(1)
+		return errLocked
+	}
+	return nil
+}
+
+// puzzle gets one bit (2x work) harder for every powLoadStep
+// connections that are still before the handshake
+const powLoadStep = 2
+
+func (a *admission) puzzleDifficulty(pending int) int {
+	if a.powDifficulty <= 0 {
+		return 0
+	}
+	d := a.powDifficulty + pending/powLoadStep
+	if d > a.powMax {
+		d = a.powMax
+	}
+	if d > pow.MaxDifficulty {
+		d = pow.MaxDifficulty
+	}
+	return d
+}
+
+// nil if the puzzle is off
+func (a *admission) puzzle(pending int) (*pow.Challenge, error) {
+	d := a.puzzleDifficulty(pending)
+	if d == 0 {
+		return nil, nil
+	}
+	return pow.NewChallenge(d)
+}
+
+func (a *admission) handshakeTimeout(host string) {
+	a.handshakeTimeouts.Add(1)
+	a.fail(host)
+}
+
+// peer dropped by the receiver: malformed frame or rejected key
+func (a *admission) peerError(host string, err error) {
+	if errors.Is(err, errServerFull) {
+		// the peer has the password, it comes back when there is room
+		return
+	}
+	if !errors.Is(err, errLocked) {
+		a.protocolErrors.Add(1)
+	}
+	a.fail(host)
+}
+
+// ban the host after too many failures within the window,
+// pause the connections without a host instead
+func (a *admission) fail(host string) {
+	if a.maxFailures <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	recent := a.failures[host][:0]
+	for _, t := range a.failures[host] {
+		if now.Sub(t) < a.failureWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < a.maxFailures {
+		a.failures[host] = recent
+		return
+	}
+	delete(a.failures, host)
+	if host != "" {
+		a.bans[host] = now.Add(a.banDuration)
+		return
+	}
+	a.pause *= 2
+	if a.pause < minPause {
+		a.pause = minPause
+	}
+	if a.pause > a.banDuration {
+		a.pause = a.banDuration
+	}
+	a.pauseEnd = now.Add(a.pause)
+}
+
+// how long a new connection waits before the handshake, 0 goes right away
+func (a *admission) wait(host string) time.Duration {
+	if host != "" {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if d := a.pauseEnd.Sub(a.now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// a peer got through, the pause starts small again
+func (a *admission) handshakeDone(host string) {
+	if host != "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pause = 0
+	delete(a.failures, host)
+}
+
+func (a *admission) stats() AdmissionStats {
+	return AdmissionStats{
+		Accepted:          a.accepted.Load(),
+		RejectedFull:      a.rejectedFull.Load(),
+		RejectedLocked:    a.rejectedLocked.Load(),
+		RejectedBanned:    a.rejectedBanned.Load(),
+		HandshakeTimeouts: a.handshakeTimeouts.Load(),
+		ProtocolErrors:    a.protocolErrors.Load(),
+	}
+}
+
+// host to ban, empty if there is none. loopback is the local tor process
+// or a local proxy, banning it would ban everyone including the real peer.
+// unix and memory connections have no host either, all of them share one budget
+func remoteHost(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		return ""
+	}
+	return host
+}
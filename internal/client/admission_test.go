@@ -0,0 +1,172 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdmission() (*admission, *time.Time) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := newAdmission()
+	a.now = func() time.Time { return now }
+	a.maxPeers = 0
+	a.lock = false
+	a.maxFailures = 3
+	a.failureWindow = time.Minute
+	a.banDuration = 5 * time.Minute
+	return a, &now
+}
+
+func TestAdmission(t *testing.T) {
+	t.Run("max peers", func(t *testing.T) {
+		a, _ := newTestAdmission()
+		a.maxPeers = 2
+		// connections in the handshake don't take the room
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, a.allow("h"))
+		}
+		assert.NoError(t, a.seat())
+		assert.NoError(t, a.seat())
+		assert.ErrorIs(t, a.allow("h"), errServerFull)
+		assert.ErrorIs(t, a.seat(), errServerFull, "too many finished the handshake at once")
+		a.leave()
+		assert.NoError(t, a.allow("h"))
+		assert.Equal(t, int64(6), a.stats().Accepted)
+		assert.Equal(t, int64(2), a.stats().RejectedFull)
+	})
+
+	t.Run("lock after first peer", func(t *testing.T) {
+		a, _ := newTestAdmission()
+		a.lock = true
+		// a key without the confirmation locks nothing
+		assert.NoError(t, a.checkKey([]byte("stranger")))
+		assert.NoError(t, a.checkKey([]byte("first")))
+		assert.NoError(t, a.pinKey([]byte("first")))
+		// same peer reconnects
+		assert.NoError(t, a.checkKey([]byte("first")))
+		assert.NoError(t, a.pinKey([]byte("first")))
+		assert.ErrorIs(t, a.checkKey([]byte("second")), errLocked)
+		assert.ErrorIs(t, a.pinKey([]byte("second")), errLocked)
+		assert.Equal(t, int64(2), a.stats().RejectedLocked)
+	})
+
+	t.Run("no lock", func(t *testing.T) {
+		a, _ := newTestAdmission()
+		assert.NoError(t, a.checkKey([]byte("first")))
+		assert.NoError(t, a.checkKey([]byte("second")))
+	})
+
+	t.Run("ban after failures", func(t *testing.T) {
+		a, now := newTestAdmission()
+		a.handshakeTimeout("bad")
+		a.peerError("bad", errors.New("message is too big"))
+		assert.NoError(t, a.allow("bad"))
+		a.peerError("bad", errLocked)
+
+		assert.ErrorIs(t, a.allow("bad"), errBanned)
+		// other hosts are fine
+		assert.NoError(t, a.allow("good"))
+
+		*now = now.Add(5*time.Minute + time.Second)
+		assert.NoError(t, a.allow("bad"))
+
+		s := a.stats()
+		assert.Equal(t, int64(1), s.HandshakeTimeouts)
+		assert.Equal(t, int64(1), s.ProtocolErrors)
+		assert.Equal(t, int64(1), s.RejectedBanned)
+	})
+
+	t.Run("no host shares a budget", func(t *testing.T) {
+		a, now := newTestAdmission()
+		a.handshakeTimeout("")
+		a.handshakeTimeout("")
+		assert.Zero(t, a.wait(""))
+		a.handshakeTimeout("")
+		// no ban, the real peer comes from the same place
+		assert.NoError(t, a.allow(""))
+		assert.Equal(t, time.Second, a.wait(""))
+		assert.Zero(t, a.wait("h"), "remote hosts have their own")
+
+		// every time the budget runs out the pause is longer
+		*now = now.Add(time.Second)
+		assert.Zero(t, a.wait(""))
+		for i := 0; i < 3; i++ {
+			a.peerError("", errors.New("garbage"))
+		}
+		assert.Equal(t, 2*time.Second, a.wait(""))
+		for i := 0; i < 20; i++ {
+			*now = now.Add(a.wait(""))
+			for j := 0; j < 3; j++ {
+				a.handshakeTimeout("")
+			}
+		}
+		assert.Equal(t, 5*time.Minute, a.wait(""), "up to the ban")
+
+		// a peer got through
+		*now = now.Add(a.wait(""))
+		a.handshakeDone("")
+		for i := 0; i < 3; i++ {
+			a.handshakeTimeout("")
+		}
+		assert.Equal(t, time.Second, a.wait(""))
+	})
+
+	t.Run("old failures expire", func(t *testing.T) {
+		a, now := newTestAdmission()
+		a.handshakeTimeout("h")
+		a.handshakeTimeout("h")
+		*now = now.Add(2 * time.Minute)
+		a.handshakeTimeout("h")
+		assert.NoError(t, a.allow("h"))
+	})
+}
+
+func TestPuzzleDifficulty(t *testing.T) {
+	a, _ := newTestAdmission()
+	p, err := a.puzzle(10)
+	assert.NoError(t, err)
+	assert.Nil(t, p, "puzzle is off")
+
+	a.powDifficulty = 8
+	a.powMax = 12
+	assert.Equal(t, 8, a.puzzleDifficulty(0))
+	assert.Equal(t, 8, a.puzzleDifficulty(1))
+	assert.Equal(t, 9, a.puzzleDifficulty(2))
+	assert.Equal(t, 12, a.puzzleDifficulty(100))
+
+	p, err = a.puzzle(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(9), p.Difficulty)
+}
+
+// conn with any remote address
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestRemoteHost(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		host string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4000}, "203.0.113.7"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4000}, "2001:db8::1"},
+		// tor and local proxies
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}, ""},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 4000}, ""},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.host, remoteHost(addrConn{addr: tt.addr}), "%v", tt.addr)
+	}
+}
@@ -0,0 +1,23 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// exponential backoff: base * 2^(attempt-1) capped by max,
+// with random jitter of up to a half so peers don't retry in sync
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay/2 + jitter
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	base, max := time.Second, 10*time.Second
+	tests := []struct {
+		attempt int
+		delay   time.Duration // before jitter
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			d := backoff(tt.attempt, base, max)
+			assert.GreaterOrEqual(t, d, tt.delay/2, "attempt %d", tt.attempt)
+			assert.LessOrEqual(t, d, tt.delay, "attempt %d", tt.attempt)
+		}
+	}
+	assert.Zero(t, backoff(1, -time.Second, max), "no panic on a bad config")
+}
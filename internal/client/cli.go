@@ -0,0 +1,126 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+// CLI is the terminal chat: one subscriber printing the events
+// and the user input with the commands.
+// Call it before RunServer or RunClient, so no event is missed
+func (c *Client) CLI() {
+	ch, _ := c.Subscribe()
+	go func() {
+		for e := range ch {
+			fmt.Fprintln(c.out, e)
+		}
+	}()
+	go func() {
+		if err := c.ListenUserInput(); err != nil {
+			c.stop(err)
+		}
+	}()
+}
+
+// user input until the chat is over, EOF is /quit
+func (c *Client) ListenUserInput() error {
+	log := logger.New().WithField("scope", "client.ListenUserInput")
+	for {
+		select {
+		case <-c.ctx.Done():
+			log.Warnf("context done: %v\n", c.ctx.Err())
+			return nil
+		default:
+			input := make([]byte, cfg.MSG_MAX_SIZE)
+			n, err := c.in.Read(input)
+			if errors.Is(err, io.EOF) {
+				c.Command("/quit", c.out)
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("user input: %w", err)
+			}
+			text := input[:n]
+			log.Debugf("user input: %d %v\n", len(text), text)
+			if c.Command(strings.TrimSpace(string(text)), c.out) {
+				continue
+			}
+			if _, err := c.SendText(string(text)); err != nil {
+				fmt.Fprintf(c.out, "✗ %v\n", err)
+				continue
+			}
+			if !c.Handshaked() {
+				log.Infof("Not connected, %d message(s) pending", c.outbox.Len())
+			}
+		}
+	}
+}
+
+// chat commands, replies go to out. false if the input is a message
+func (c *Client) Command(line string, out io.Writer) bool {
+	log := logger.New()
+	switch {
+	case line == "/quit":
+		c.Disconnect(message.DiscQuit, "")
+		c.stop(nil)
+	case line == "/pending":
+		for _, item := range c.Pending() {
+			fmt.Fprintf(out, "⧗ #%d %s\n", item.Seq, events.Preview(string(item.Text)))
+		}
+	case line == "/status":
+		if link := c.ConnectorStatus(); link != "" {
+			fmt.Fprintf(out, "%s %s\n", c.connType, link)
+		}
+		status := c.Status()
+		if len(status) == 0 {
+			fmt.Fprintln(out, "not connected")
+		}
+		for _, s := range status {
+			fmt.Fprintln(out, s)
+		}
+	case strings.HasPrefix(line, "/send "):
+		path := strings.TrimSpace(strings.TrimPrefix(line, "/send "))
+		if err := c.SendFile(path); err != nil {
+			fmt.Fprintf(out, "✗ can't send %s: %v\n", path, err)
+		}
+	case strings.HasPrefix(line, "/accept "), strings.HasPrefix(line, "/decline "):
+		cmd, id, _ := strings.Cut(line, " ")
+		if !c.DecideFile(strings.TrimSpace(id), cmd == "/accept") {
+			log.Warnf("No such offer: %s", id)
+		}
+	case line == "/files":
+		list := c.Files()
+		if len(list) == 0 {
+			fmt.Fprintln(out, "no transfers")
+		}
+		for _, f := range list {
+			fmt.Fprintln(out, f)
+		}
+	case line == "/rekey":
+		if c.Rekey() == 0 {
+			fmt.Fprintln(out, "not connected")
+		}
+	case strings.HasPrefix(line, "/kick "):
+		name := strings.TrimSpace(strings.TrimPrefix(line, "/kick "))
+		if !c.Kick(name) {
+			log.Warnf("No such user: %s", name)
+		}
+	case strings.HasPrefix(line, "/verify "):
+		name := strings.TrimSpace(strings.TrimPrefix(line, "/verify "))
+		if !c.Verify(name) {
+			log.Warnf("No such user: %s", name)
+			break
+		}
+		fmt.Fprintf(out, "✓ <%s> verified\n", name)
+	default:
+		return false
+	}
+	return true
+}
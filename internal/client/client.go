@@ -2,26 +2,46 @@ package client
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/events"
 	"github.com/1F47E/go-shaihulud/internal/client/listner"
 	client_local "github.com/1F47E/go-shaihulud/internal/client/local"
+	client_memory "github.com/1F47E/go-shaihulud/internal/client/memory"
 	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+	"github.com/1F47E/go-shaihulud/internal/client/outbox"
+	client_socks "github.com/1F47E/go-shaihulud/internal/client/socks"
 	client_tor "github.com/1F47E/go-shaihulud/internal/client/tor"
+	client_unix "github.com/1F47E/go-shaihulud/internal/client/unix"
 	cfg "github.com/1F47E/go-shaihulud/internal/config"
 	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rotating"
+	myrsa "github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rsa"
 	"github.com/1F47E/go-shaihulud/internal/cryptotools/auth"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/padding"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/pow"
 	myaes "github.com/1F47E/go-shaihulud/internal/cryptotools/symmetric/aes"
 	"github.com/1F47E/go-shaihulud/internal/logger"
 )
 
-// can be local or tor
+// can be local, tor, socks proxy, unix socket or in-memory
 type Connector interface {
 	RunServer(address string, onionPrivKey []byte) (net.Listener, error)
 	RunClient(address string) (net.Conn, error)
+	Close() error
 }
 
 type ConnectionType int
@@ -29,64 +49,143 @@ type ConnectionType int
 const (
 	Local ConnectionType = iota
 	Tor
+	Socks
+	Unix
+	Memory // in-process, for tests
 )
 
+func (t ConnectionType) String() string {
+	switch t {
+	case Local:
+		return "local"
+	case Tor:
+		return "tor"
+	case Socks:
+		return "socks"
+	case Unix:
+		return "unix"
+	case Memory:
+		return "memory"
+	default:
+		return fmt.Sprintf("connection(%d)", int(t))
+	}
+}
+
+func ParseConnectionType(s string) (ConnectionType, error) {
+	switch strings.ToLower(s) {
+	case "local":
+		return Local, nil
+	case "tor":
+		return Tor, nil
+	case "socks":
+		return Socks, nil
+	case "unix":
+		return Unix, nil
+	case "memory":
+		return Memory, nil
+	default:
+		return 0, fmt.Errorf("unknown connection type: %q", s)
+	}
+}
+
 type Client struct {
 	ctx       context.Context
 	cancel    context.CancelFunc
-	msgCh     chan message.Message
 	connector Connector
 	crypter   asymmetric.Asymmetric
-	user      *connection.Connection
-	listner   *listner.Listner
+	keygen    func() (asymmetric.Asymmetric, error) // new keypairs for rekeying
+	auth      *auth.Auth
+	mu        sync.RWMutex // guards peers and trusted
+	peers     map[string]*peer
+	trusted   map[fingerprint]bool // peers checked with /verify
+	peerReady chan struct{}        // signals a new peer after handshake
+	admission *admission           // server only
+	rejecting chan struct{}        // reject reasons being written, server only
+	listener  net.Listener         // server only, connectors don't close it
 	connType  ConnectionType
+	address   string    // peer address for reconnects
+	in        io.Reader // user input
+	out       io.Writer // cli output
+	input     *inputQueue
+	outbox    *outbox.Outbox // undelivered messages, on disk if the session allows
+	files     *files         // unfinished file transfers
+	pipe      *pipeMode      // pipe mode, nil in the chat
+	forwards  *forwards      // tcp port forwarding
+	bus       *events.Bus    // chat events for the frontends
+	inputOnce sync.Once
+	errMu     sync.Mutex
+	err       error // why the chat has stopped, see stop
 }
 
 func NewClient(ctx context.Context, cancel context.CancelFunc, connType ConnectionType, crypter asymmetric.Asymmetric) *Client {
-	msgCh := make(chan message.Message)
 	var connector Connector
 
 	// init connector debug or tor
 	switch connType {
 	case Local:
-		connector = client_local.New(ctx, cancel, msgCh)
+		connector = client_local.New(ctx, cancel)
 	case Tor:
-		connector = client_tor.New(ctx, cancel, msgCh)
+		connector = client_tor.New(ctx, cancel)
+	case Socks:
+		connector = client_socks.New(ctx, cancel)
+	case Unix:
+		connector = client_unix.New(ctx, cancel)
+	case Memory:
+		connector = client_memory.New(ctx, cancel)
 	}
 
-	// create listner
-	lCtx, lCancel := context.WithCancel(ctx)
-	lstnr := listner.New(lCtx, lCancel, msgCh)
-
 	return &Client{
 		ctx:       ctx,
 		cancel:    cancel,
-		msgCh:     msgCh,
 		connector: connector,
 		crypter:   crypter,
-		listner:   lstnr,
+		keygen:    newKeypair,
 		connType:  connType,
+		in:        os.Stdin,
+		out:       os.Stdout,
+		input:     newInputQueue(),
+		outbox:    outbox.New(),
+		files:     newFiles(),
+		forwards:  newForwards(),
+		bus:       events.NewBus(),
+		peers:     make(map[string]*peer),
+		trusted:   make(map[fingerprint]bool),
+		peerReady: make(chan struct{}, 1),
 	}
 }
 
 func (c *Client) RunServer(session string) error {
 	log := logger.New()
 
-	// generate auth key and password
+	// generate auth key and password.
+	// named session is created on the first run and loaded after
 	crypter := myaes.New()
-	auth, err := auth.New(crypter, session)
+	load := session
+	if session != "" && !auth.SessionExists(session) {
+		load = ""
+	}
+	ath, err := auth.New(crypter, load)
 	if err != nil {
-		log.Fatalf("cant create auth: %v\n", err)
+		return fmt.Errorf("can't create auth: %w", err)
+	}
+	c.auth = ath
+	if session != "" && load == "" {
+		if err := ath.SaveAs(session); err != nil {
+			return fmt.Errorf("can't save session: %w", err)
+		}
+		log.Infof("New session %s is saved", session)
+	}
+	// onion changes on every run without a session, nothing to resume
+	if session != "" {
+		c.openOutbox("server", ath.OnionAddress(), ath.Onion().PrivKey())
 	}
 
 	// auth creds for the client
-	println()
 	log.Warn("🔑 Client auth creds")
 	log.Warn("=======================================")
-	log.Warnf(" Key: %s\n\n", auth.AccessKey())
-	log.Warnf(" Password: %s\n", auth.Password())
+	log.Warnf(" Key: %s\n\n", ath.AccessKey())
+	log.Warnf(" Password: %s\n", ath.Password())
 	log.Warn("=======================================")
-	println()
 
 	// get address
 	address := ""
@@ -96,19 +195,31 @@ func (c *Client) RunServer(session string) error {
 		address = "localhost:3000"
 	case Tor:
 		log.Info("Starting tor...")
-		address = auth.OnionAddressFull()
+		address = ath.OnionAddressFull()
 		log.Debugf("onion address: %v\n", address)
+	case Socks:
+		address = ath.OnionAddressFull()
+	case Unix:
+		log.Info("Starting unix socket server...")
+		address = cfg.UNIX_SOCKET
+	case Memory:
+		// unique per session
+		address = ath.OnionAddressFull()
 	default:
-		log.Fatalf("unknown connection type: %v\n", c.connType)
+		return fmt.Errorf("unknown connection type: %v", c.connType)
 	}
 
 	// run server with a given address
 	log.Debugf("Client.RunServer: %v\n", address)
-	listener, err := c.connector.RunServer(address, auth.Onion().PrivKey())
+	listener, err := c.connector.RunServer(address, ath.Onion().PrivKey())
 	if err != nil {
 		return err
 	}
 	log.Info("Server started, waiting for connections...")
+	c.admission = newAdmission()
+	c.rejecting = make(chan struct{}, maxRejecting)
+	c.listener = listener
+	c.startInput()
 
 	// accept incoming connections
 	go func() {
@@ -123,19 +234,44 @@ func (c *Client) RunServer(session string) error {
 
 				conn, err := listener.Accept()
 				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
 					log.Errorf("Client.RunServer listener.Accept error: %v\n", err)
 					continue
 				}
-				user := connection.New(conn) // connection with user data
-				c.user = user
 				log.Debug("Client.RunServer: Got a connection")
-
-				// Create a new Listner for each connection
-				ctx, cancel := context.WithCancel(c.ctx)
-				listner := listner.New(ctx, cancel, c.msgCh)
-				go listner.Sender(user, c.crypter)
-				go listner.Receiver(user, c.crypter)
-				go c.ListenUserInput()
+				host := remoteHost(conn)
+				if d := c.admission.wait(host); d > 0 {
+					log.Warnf("Too many failed connections, next one in %s [%s]", d.Round(time.Millisecond), c.admission.stats())
+					select {
+					case <-time.After(d):
+					case <-c.ctx.Done():
+						conn.Close()
+						return
+					}
+				}
+				if err := c.admission.allow(host); err != nil {
+					log.Warnf("Connection rejected: %v [%s]", err, c.admission.stats())
+					// the reason can take a while to write, don't hold the next connection
+					select {
+					case c.rejecting <- struct{}{}:
+						go func() {
+							reject(conn, err)
+							<-c.rejecting
+						}()
+					default:
+						conn.Close()
+					}
+					continue
+				}
+				puzzle, err := c.admission.puzzle(c.peerCount() - len(c.readyPeers()))
+				if err != nil {
+					log.Errorf("can't create puzzle: %v\n", err)
+					conn.Close()
+					continue
+				}
+				c.serve(conn, puzzle)
 			}
 		}
 	}()
@@ -150,12 +286,16 @@ func (c *Client) RunClient(key, password string) error {
 	aes := myaes.New()
 	ath, err := auth.NewFromKey(aes, key, password)
 	if err != nil {
-		if strings.Contains(err.Error(), "authentication failed") {
-			log.Fatal("wrong password")
-		}
-		log.Fatalf("cant create auth: %v\n", err)
+		return err
 	}
 	log.Info("✅ Auth key and password are valid, connecting...")
+	c.auth = ath
+	// the password is new on every server run, the local key stays
+	if key, err := outbox.LocalKey(cfg.OUTBOX_DIR); err != nil {
+		log.Warnf("Can't load the outbox key, undelivered messages are kept in memory only: %v", err)
+	} else {
+		c.openOutbox("client", ath.OnionAddress(), key)
+	}
 
 	// ===== At this point access key and pass are valid
 
@@ -169,57 +309,551 @@ func (c *Client) RunClient(key, password string) error {
 		address = ath.OnionAddressFull()
 		log.Info("Starting tor...")
 		log.Debugf("onion address: %v\n", address)
+	case Socks:
+		address = ath.OnionAddressFull()
+		log.Infof("Connecting via socks proxy %s...", cfg.PROXY_ADDR)
+		log.Debugf("onion address: %v\n", address)
+	case Unix:
+		address = cfg.UNIX_SOCKET
+		log.Infof("Connecting to %s...", address)
+	case Memory:
+		address = ath.OnionAddressFull()
 	default:
-		log.Fatalf("unknown connection type: %v\n", c.connType)
+		return fmt.Errorf("unknown connection type: %v", c.connType)
 	}
 
 	// Run the connector
 	conn, err := c.connector.RunClient(address)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
 	}
-	user := connection.New(conn) // connection with user data
-	c.user = user
+	c.address = address
 
-	// Run the listener, sender, and input listener goroutines
-	ctx, cancel := context.WithCancel(c.ctx)
-	c.listner = listner.New(ctx, cancel, c.msgCh)
-	go c.listner.Sender(user, c.crypter)
-	go c.listner.Receiver(user, c.crypter)
-	go c.ListenUserInput()
+	c.startInput()
+	go c.keepAlive(conn)
 
 	return nil
 }
 
-func (c *Client) ListenUserInput() {
-	log := logger.New().WithField("scope", "client.ListenUserInput")
+// serve the connection and reconnect with backoff when it drops.
+// a full server is tried again, the backoff goes on until a handshake
+func (c *Client) keepAlive(conn net.Conn) {
+	log := logger.New()
+	attempt := 0
 	for {
-		select {
-		case <-c.ctx.Done():
-			log.Warnf("context done: %v\n", c.ctx.Err())
+		p := c.serve(conn, nil)
+		<-p.ctx.Done()
+		if c.ctx.Err() != nil {
+			return
+		}
+		if p.handshaked() {
+			attempt = 0
+		}
+		left, ok := p.lstnr.Left()
+		switch {
+		case ok && left.Reason == message.DiscFull:
+			// our old connection can still hold the place until the server drops it
+			log.Warnf("Server is full: %s", left.Text)
+		case ok && left.Reason != message.DiscTimeout:
+			// server has closed the chat on purpose
+			log.Warnf("Server has closed the connection: %s", left)
+			c.stop(leftError(left))
 			return
 		default:
-			input := make([]byte, cfg.MSG_MAX_SIZE)
-			n, err := os.Stdin.Read(input)
-			if err != nil {
-				log.Fatalf("read error: %v\n", err)
+			// the same server breaks it again after a reconnect
+			if err := p.lstnr.Err(); err != nil {
+				c.stop(peerError(err, p.handshaked()))
+				return
+			}
+			log.Warn("Connection lost")
+		}
+
+		conn, attempt = c.reconnect(attempt)
+		if conn == nil {
+			log.Error("Can't reconnect, giving up")
+			c.stop(fmt.Errorf("%w: no reconnect after %d attempts", ErrPeerUnreachable, cfg.CLIENT_MAX_RETRY))
+			return
+		}
+	}
+}
+
+// next attempts after the given one, returns the one that connected
+func (c *Client) reconnect(attempt int) (net.Conn, int) {
+	log := logger.New()
+	for attempt++; attempt <= cfg.CLIENT_MAX_RETRY; attempt++ {
+		delay := backoff(attempt, cfg.RECONNECT_DELAY, cfg.RECONNECT_MAX_DELAY)
+		log.Warnf("Reconnecting (attempt %d/%d) in %s...", attempt, cfg.CLIENT_MAX_RETRY, delay.Round(time.Millisecond))
+		c.emit(events.Reconnecting{Attempt: attempt, Max: cfg.CLIENT_MAX_RETRY, Delay: delay})
+		select {
+		case <-time.After(delay):
+		case <-c.ctx.Done():
+			return nil, attempt
+		}
+
+		conn, err := c.connector.RunClient(c.address)
+		if err != nil {
+			log.Errorf("reconnect error: %v\n", err)
+			continue
+		}
+		log.Info("✅ Reconnected")
+		return conn, attempt
+	}
+	return nil, attempt
+}
+
+// run sender and receiver for the connection.
+// server can give a puzzle to solve before the handshake.
+// peer context is done when the connection is closed
+func (c *Client) serve(conn net.Conn, puzzle *pow.Challenge) *peer {
+	log := logger.New()
+	// chat goes on the main stream, transfers get their own
+	p := newPeer(c.ctx, mux.New(conn, c.admission == nil))
+	c.addPeer(p)
+
+	host := remoteHost(conn)
+	c.emit(events.PeerConnected{Addr: host})
+
+	lstnr := p.lstnr
+	lstnr.Emit = c.emit
+	var seated atomic.Bool
+	if c.admission != nil {
+		lstnr.KeyCheck = c.admission.checkKey
+		lstnr.KeyPin = func(key []byte) error {
+			if err := c.admission.pinKey(key); err != nil {
+				return err
+			}
+			if err := c.admission.seat(); err != nil {
+				return err
+			}
+			seated.Store(true)
+			return nil
+		}
+	}
+	lstnr.Puzzle = puzzle
+	lstnr.Dialer = c.admission == nil
+	lstnr.Secret = []byte(c.auth.Password())
+	lstnr.Heartbeat = cfg.HEARTBEAT_INTERVAL
+	lstnr.MaxMissed = cfg.HEARTBEAT_MAX_MISSED
+	p.report = c.report
+	p.encrypt = func(text []byte) ([]byte, error) {
+		return c.crypter.Encrypt(padding.Pad(padding.Data, text), p.user.Key())
+	}
+	lstnr.Cover = cfg.COVER_INTERVAL
+	lstnr.Rekey = listner.RekeyPolicy{
+		Messages: cfg.REKEY_MESSAGES,
+		Bytes:    cfg.REKEY_BYTES,
+		Interval: cfg.REKEY_INTERVAL,
+	}
+	// own keypair per peer after the first rekey
+	p.keys = rotating.New(c.crypter, c.keygen)
+	go lstnr.Sender(p.user, p.keys)
+	go lstnr.Receiver(p.user, p.keys)
+	go p.retransmit()
+	go c.acceptStreams(p)
+	go func() {
+		timer := time.NewTimer(cfg.HANDSHAKE_TIMEOUT)
+		defer timer.Stop()
+		select {
+		case <-p.user.Ready():
+			if c.admission != nil {
+				c.admission.handshakeDone(host)
+			}
+			if !c.verified(p) {
+				c.notice(p.user.Name, "🔑 <%s> safety code %s, compare it with the peer and /verify %s",
+					p.user.Name, c.fingerprint(p).Code(), p.user.Name)
+			}
+			c.requeue()
+			c.resumeFiles(p)
+			c.requestListens(p)
+			if c.pipe != nil && c.admission == nil {
+				c.openPipe(p)
+			}
+			select {
+			case c.peerReady <- struct{}{}:
+			default:
+			}
+		case <-timer.C:
+			log.Warn("Handshake timeout, closing the connection")
+			if c.admission != nil {
+				c.admission.handshakeTimeout(host)
+			}
+			lstnr.Disconnect(message.DiscTimeout, "handshake timeout")
+		case <-p.ctx.Done():
+		}
+	}()
+	go func() {
+		// sender closes the chat stream, the rest goes with the session
+		<-p.ctx.Done()
+		p.mux.Close()
+		c.removePeer(p)
+		if seated.Load() {
+			c.admission.leave()
+		}
+		c.outbox.Forget(p.user.Name)
+		err := lstnr.Err()
+		if err != nil && c.admission != nil {
+			c.admission.peerError(host, err)
+			log.Warnf("Peer dropped: %v [%s]", err, c.admission.stats())
+		}
+		// strangers that never made it through the handshake only go to the log
+		confirmed := p.handshaked()
+		if err != nil && (confirmed || c.admission == nil) {
+			c.emit(events.Error{Peer: p.user.Name, Err: peerError(err, confirmed)})
+		}
+		if confirmed {
+			reason := "connection lost"
+			if left, ok := lstnr.Left(); ok {
+				reason = left.String()
+			}
+			c.emit(events.PeerLeft{Peer: p.user.Name, Reason: reason})
+		}
+		log.Debugf("peer %s is gone, %d connected\n", p.user.UUID, c.peerCount())
+	}()
+	return p
+}
+
+func (c *Client) startInput() {
+	c.inputOnce.Do(func() {
+		go c.dispatchInput()
+	})
+}
+
+// encrypt queued input for every peer after the handshake.
+// input stays in the queue while nobody is connected
+func (c *Client) dispatchInput() {
+	log := logger.New().WithField("scope", "client.dispatchInput")
+	for {
+		item, ok := c.input.peek()
+		if !ok {
+			select {
+			case <-c.input.notify:
+				continue
+			case <-c.ctx.Done():
+				return
+			}
+		}
+		peers := c.readyPeers()
+		if len(peers) == 0 {
+			select {
+			case <-c.peerReady:
+				continue
+			case <-c.ctx.Done():
 				return
 			}
-			text := input[:n]
-			log.Debugf("user input: %d %v\n", len(text), text)
-			log.Debugf("crypter: %v\n", c.crypter)
-			inputCipher, err := c.crypter.Encrypt(text, c.user.PubKey)
-			if err != nil {
-				log.Errorf("can't send a message: %v\n", err)
+		}
+		// the outbox knows who waits for it before the first ack can come back
+		targets := make([]*peer, 0, len(peers))
+		names := make([]string, 0, len(peers))
+		for _, p := range peers {
+			if !c.outbox.Acked(item.Seq, p.user.Name) {
+				targets = append(targets, p)
+				names = append(names, p.user.Name)
+			}
+		}
+		c.outbox.Sent(item.Seq, names...)
+		for _, p := range targets {
+			if err := p.sendTracked(item.Seq, item.Text); err != nil {
+				log.Errorf("can't send a message to <%s>: %v\n", p.user.Name, err)
+				c.report(Delivery{Seq: item.Seq, Peer: p.user.Name, Text: string(item.Text), State: Failed})
+				// can't be encrypted, it would come back after every handshake
+				if err := c.outbox.Drop(item.Seq, p.user.Name); err != nil {
+					log.Errorf("can't update the outbox: %v", err)
+				}
 			}
-			log.Debugf("inputCipher: %d %v\n", len(inputCipher), inputCipher)
-			c.msgCh <- message.NewMSG(inputCipher)
 		}
+		c.input.pop()
+	}
+}
+
+func (c *Client) addPeer(p *peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers[p.user.UUID] = p
+}
+
+func (c *Client) removePeer(p *peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.peers, p.user.UUID)
+}
+
+func (c *Client) peerCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.peers)
+}
+
+// peers with completed handshake, the earliest confirmed first
+func (c *Client) readyPeers() []*peer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	peers := make([]*peer, 0, len(c.peers))
+	for _, p := range c.peers {
+		if p.user.Confirmed() {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].user.ConfirmedAt().Before(peers[j].user.ConfirmedAt())
+	})
+	return peers
+}
+
+// server counters for accepted and rejected connections
+func (c *Client) AdmissionStats() AdmissionStats {
+	if c.admission == nil {
+		return AdmissionStats{}
+	}
+	return c.admission.stats()
+}
+
+// tell the frontends how the delivery went
+func (c *Client) report(d Delivery) {
+	switch d.State {
+	case Delivered:
+		// removed once every peer it went to has it
+		if err := c.outbox.Ack(d.Seq, d.Peer); err != nil {
+			logger.New().Errorf("can't update the outbox: %v", err)
+		}
+		c.emit(events.Delivered{Seq: d.Seq, Peer: d.Peer, Text: d.Text})
+	case Failed:
+		// stays in the outbox until the next handshake
+		c.emit(events.Undelivered{Seq: d.Seq, Peer: d.Peer, Text: d.Text})
+	}
+}
+
+// load undelivered messages from the last run
+func (c *Client) openOutbox(role, address string, secret []byte) {
+	log := logger.New()
+	if !cfg.OUTBOX {
+		return
+	}
+	id := sha256.Sum256([]byte(role + ":" + address))
+	path := filepath.Join(cfg.OUTBOX_DIR, hex.EncodeToString(id[:16]))
+	ob, err := outbox.Open(path, secret)
+	if errors.Is(err, outbox.ErrDecrypt) {
+		// moved away, so it doesn't come up on every run
+		unreadable := path + ".unreadable"
+		if rerr := os.Rename(path, unreadable); rerr == nil {
+			log.Errorf("Messages from the last run are not sent, the outbox can't be decrypted: the key has changed or the file is corrupted. It is kept in %s", unreadable)
+			ob, err = outbox.Open(path, secret)
+		}
+	}
+	if err != nil {
+		log.Warnf("Can't open the outbox, undelivered messages are kept in memory only: %v", err)
+		return
+	}
+	c.outbox = ob
+	if n := ob.Len(); n > 0 {
+		log.Infof("%d message(s) pending from the last run", n)
+		for _, item := range ob.Items() {
+			c.input.push(item)
+		}
+	}
+}
+
+// queue undelivered messages again after the handshake,
+// they are encrypted for the current peer key
+func (c *Client) requeue() {
+	// the queue goes first, dispatch tracks a message before it leaves the queue
+	skip := c.input.seqs()
+	for _, p := range c.readyPeers() {
+		for _, d := range p.sent.list() {
+			skip[d.Seq] = true
+		}
+	}
+	for _, item := range c.outbox.Items() {
+		if !skip[item.Seq] {
+			c.input.push(item)
+		}
+	}
+}
+
+// messages waiting for delivery
+func (c *Client) Pending() []outbox.Item {
+	return c.outbox.Items()
+}
+
+// messages waiting for the ack
+func (c *Client) Deliveries() []Delivery {
+	var list []Delivery
+	for _, p := range c.readyPeers() {
+		list = append(list, p.sent.list()...)
+	}
+	sortDeliveries(list)
+	return list
+}
+
+// link quality per connected peer
+type PeerStatus struct {
+	Name     string
+	Health   listner.Health
+	Code     string // safety code
+	Verified bool
+}
+
+func (s PeerStatus) String() string {
+	if s.Verified {
+		return fmt.Sprintf("<%s> %s, verified %s", s.Name, s.Health, s.Code)
+	}
+	return fmt.Sprintf("<%s> %s, not verified, safety code %s", s.Name, s.Health, s.Code)
+}
+
+func (c *Client) Status() []PeerStatus {
+	peers := c.readyPeers()
+	status := make([]PeerStatus, 0, len(peers))
+	for _, p := range peers {
+		status = append(status, PeerStatus{
+			Name:     p.user.Name,
+			Health:   p.lstnr.Health(),
+			Code:     c.fingerprint(p).Code(),
+			Verified: c.verified(p),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+func (c *Client) Connector() ConnectionType {
+	return c.connType
+}
+
+// state of the connector itself, like the tor bootstrap and circuit.
+// empty if the connector doesn't tell
+func (c *Client) ConnectorStatus() string {
+	s, ok := c.connector.(interface{ Status() string })
+	if !ok {
+		return ""
+	}
+	return s.Status()
+}
+
+// access key and password for the peers, empty before RunServer or RunClient
+func (c *Client) Credentials() (key, password string) {
+	if c.auth == nil {
+		return "", ""
+	}
+	return c.auth.AccessKey(), c.auth.Password()
+}
+
+// true if any peer has completed the handshake
+func (c *Client) Handshaked() bool {
+	return len(c.readyPeers()) > 0
+}
+
+// chat events until unsubscribe or Close
+func (c *Client) Subscribe() (<-chan events.Event, func()) {
+	return c.bus.Subscribe()
+}
+
+func (c *Client) emit(e events.Event) {
+	c.bus.Publish(e)
+}
+
+// one line for the frontends, like a file transfer step
+func (c *Client) notice(peer, format string, args ...any) {
+	c.emit(events.Notice{Peer: peer, Text: fmt.Sprintf(format, args...)})
+}
+
+// SendText queues the message for every peer, sent after the handshake
+// if nobody is connected. Delivery events carry the returned seq
+func (c *Client) SendText(text string) (uint64, error) {
+	if max := c.MaxMessageSize(); max > 0 && len(text) > max {
+		return 0, fmt.Errorf("%w: %d bytes, max %d", ErrMessageTooLong, len(text), max)
+	}
+	item, err := c.outbox.Add([]byte(text))
+	if err != nil {
+		logger.New().Errorf("can't save the message to the outbox: %v", err)
+	}
+	c.input.push(item)
+	return item.Seq, nil
+}
+
+// longest text in bytes the crypter can carry, 0 if it doesn't tell
+func (c *Client) MaxMessageSize() int {
+	s, ok := c.crypter.(interface{ MaxSize() int })
+	if !ok || s.MaxSize() == 0 {
+		return 0
+	}
+	return s.MaxSize() - padding.Overhead
+}
+
+// graceful shutdown: tell every peer why we leave and wait for the acks
+func (c *Client) Disconnect(reason message.DiscReason, text string) {
+	c.mu.RLock()
+	peers := make([]*peer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	c.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			p.disconnect(reason, text, cfg.DISC_TIMEOUT)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// kick the peer by name
+func (c *Client) Kick(name string) bool {
+	for _, p := range c.readyPeers() {
+		if p.user.Name == name {
+			p.disconnect(message.DiscKicked, "", cfg.DISC_TIMEOUT)
+			return true
+		}
+	}
+	return false
+}
+
+// rotate the session keys with every peer, returns the number of peers
+func (c *Client) Rekey() int {
+	peers := c.readyPeers()
+	for _, p := range peers {
+		p.lstnr.RequestRekey()
+	}
+	return len(peers)
+}
+
+func newKeypair() (asymmetric.Asymmetric, error) {
+	return myrsa.New()
+}
+
+// rejects written at once, more are closed without the reason
+const maxRejecting = 16
+
+// tell the rejected connection why, no listner for it yet
+func reject(conn net.Conn, reason error) {
+	session := mux.New(conn, false)
+	defer session.Close()
+	code := message.DiscRejected
+	if errors.Is(reason, errServerFull) {
+		code = message.DiscFull
+	}
+	msg := message.NewDisconnect(code, reason.Error())
+	data, err := msg.Serialize()
+	if err != nil {
+		return
 	}
+	st := session.Main()
+	st.SetWriteDeadline(time.Now().Add(time.Second))
+	st.Write(data)
 }
 
 func (c *Client) Close() {
-	if c.user != nil && c.user.Conn != nil {
-		c.user.Conn.Close()
+	c.mu.RLock()
+	for _, p := range c.peers {
+		p.close()
+	}
+	c.mu.RUnlock()
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if err := c.connector.Close(); err != nil {
+		logger.New().Errorf("connector close error: %v\n", err)
 	}
+	c.bus.Close()
 }
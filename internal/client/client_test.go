@@ -0,0 +1,1071 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+	"github.com/1F47E/go-shaihulud/internal/client/forward"
+	client_memory "github.com/1F47E/go-shaihulud/internal/client/memory"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+	myrsa "github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rsa"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/auth"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/onion"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/pow"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// keep the outbox files away from the repo
+	dir, err := os.MkdirTemp("", "outbox")
+	if err != nil {
+		panic(err)
+	}
+	cfg.OUTBOX_DIR = dir
+	cfg.DOWNLOAD_DIR = filepath.Join(dir, "downloads")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// chat output shared between goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type testClient struct {
+	*Client
+	input *io.PipeWriter
+	out   *syncBuffer
+}
+
+func newTestClient(t *testing.T, ctx context.Context, cancel context.CancelFunc) *testClient {
+	crypter, err := myrsa.New()
+	require.NoError(t, err)
+	c := NewClient(ctx, cancel, Memory, crypter)
+	in, input := io.Pipe()
+	out := &syncBuffer{}
+	c.in = in
+	c.out = out
+	c.CLI()
+	t.Cleanup(c.Close)
+	return &testClient{c, input, out}
+}
+
+func TestClientChatInMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+
+	assert.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	_, err := cli.input.Write([]byte("hello from client"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(srv.out.String(), "hello from client")
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(cli.out.String(), "☑︎ <"+cli.readyPeers()[0].user.Name+"> hello from client")
+	}, 5*time.Second, 50*time.Millisecond, "delivery report")
+	assert.Empty(t, cli.Deliveries())
+
+	_, err = srv.input.Write([]byte("hello from server"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(cli.out.String(), "hello from server")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// the api without the cli: events in, commands out
+func TestEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	srvEvents, _ := srv.Subscribe()
+	cliEvents, _ := cli.Subscribe()
+	// first event of the type, the rest is skipped
+	next := func(ch <-chan events.Event, match func(events.Event) bool) events.Event {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case e := <-ch:
+				if match(e) {
+					return e
+				}
+			case <-timeout:
+				t.Fatal("no event")
+				return nil
+			}
+		}
+	}
+	is := func(want events.Event) func(events.Event) bool {
+		return func(e events.Event) bool {
+			return fmt.Sprintf("%T", e) == fmt.Sprintf("%T", want)
+		}
+	}
+
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	next(srvEvents, is(events.PeerConnected{}))
+	hs := next(cliEvents, is(events.HandshakeComplete{})).(events.HandshakeComplete)
+	assert.NotEmpty(t, hs.Peer)
+
+	seq, err := cli.SendText("spice must flow")
+	require.NoError(t, err)
+	got := next(srvEvents, is(events.MessageReceived{})).(events.MessageReceived)
+	assert.Equal(t, "spice must flow", got.Text)
+	delivered := next(cliEvents, is(events.Delivered{})).(events.Delivered)
+	assert.Equal(t, seq, delivered.Seq)
+	assert.Equal(t, hs.Peer, delivered.Peer)
+
+	cli.Disconnect(message.DiscQuit, "")
+	left := next(srvEvents, is(events.PeerLeft{})).(events.PeerLeft)
+	assert.Equal(t, "quit", left.Reason)
+}
+
+func TestClientReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	delay := cfg.RECONNECT_DELAY
+	cfg.RECONNECT_DELAY = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.RECONNECT_DELAY = delay })
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	// drop the connection on the server side
+	dropped := srv.readyPeers()[0]
+	dropped.user.Conn.Close()
+
+	require.Eventually(t, func() bool {
+		peers := srv.readyPeers()
+		return len(peers) == 1 && peers[0] != dropped && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "reconnect")
+	assert.NoError(t, ctx.Err())
+	assert.Contains(t, cli.out.String(), "reconnecting (attempt 1/", "frontends see the attempts")
+
+	_, err := cli.input.Write([]byte("hello again"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(srv.out.String(), "hello again")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// conn that breaks like a reset tcp connection, not with a clean EOF
+type resetConn struct {
+	net.Conn
+	mu    sync.Mutex
+	reset bool
+}
+
+func (c *resetConn) Reset() {
+	c.mu.Lock()
+	c.reset = true
+	c.mu.Unlock()
+	c.Conn.Close()
+}
+
+func (c *resetConn) err(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil && c.reset {
+		return syscall.ECONNRESET
+	}
+	return err
+}
+
+func (c *resetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	return n, c.err(err)
+}
+
+func (c *resetConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	return n, c.err(err)
+}
+
+type resetConnector struct {
+	Connector
+	mu    sync.Mutex
+	conns []*resetConn
+}
+
+func (r *resetConnector) RunClient(address string) (net.Conn, error) {
+	conn, err := r.Connector.RunClient(address)
+	if err != nil {
+		return nil, err
+	}
+	rc := &resetConn{Conn: conn}
+	r.mu.Lock()
+	r.conns = append(r.conns, rc)
+	r.mu.Unlock()
+	return rc, nil
+}
+
+// a reset under the mux is a lost link, not a protocol error
+func TestClientReconnectAfterReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	delay := cfg.RECONNECT_DELAY
+	cfg.RECONNECT_DELAY = 10 * time.Millisecond
+	t.Cleanup(func() { cfg.RECONNECT_DELAY = delay })
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	connector := &resetConnector{Connector: cli.connector}
+	cli.connector = connector
+
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	dropped := cli.readyPeers()[0]
+	connector.mu.Lock()
+	connector.conns[0].Reset()
+	connector.mu.Unlock()
+
+	require.Eventually(t, func() bool {
+		peers := cli.readyPeers()
+		return len(peers) == 1 && peers[0] != dropped
+	}, 10*time.Second, 50*time.Millisecond, "reconnect")
+	assert.NoError(t, dropped.lstnr.Err())
+	assert.NoError(t, cli.Err())
+	assert.Zero(t, srv.AdmissionStats().ProtocolErrors)
+}
+
+// a full server is not a reason to give up, the client waits for the room
+func TestClientRetriesFullServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	delay, maxDelay, retry, maxPeers := cfg.RECONNECT_DELAY, cfg.RECONNECT_MAX_DELAY, cfg.CLIENT_MAX_RETRY, cfg.MAX_PEERS
+	cfg.RECONNECT_DELAY, cfg.RECONNECT_MAX_DELAY, cfg.CLIENT_MAX_RETRY, cfg.MAX_PEERS = 10*time.Millisecond, 20*time.Millisecond, 1000, 1
+	t.Cleanup(func() {
+		cfg.RECONNECT_DELAY, cfg.RECONNECT_MAX_DELAY, cfg.CLIENT_MAX_RETRY, cfg.MAX_PEERS = delay, maxDelay, retry, maxPeers
+	})
+
+	srv := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	firstCtx, firstCancel := context.WithCancel(ctx)
+	first := newTestClient(t, firstCtx, firstCancel)
+	require.NoError(t, first.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, first.Handshaked, 10*time.Second, 50*time.Millisecond, "first handshake")
+
+	secondCtx, secondCancel := context.WithCancel(ctx)
+	second := newTestClient(t, secondCtx, secondCancel)
+	require.NoError(t, second.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.AdmissionStats().RejectedFull > 0
+	}, 5*time.Second, 50*time.Millisecond, "rejected as full")
+	assert.NoError(t, secondCtx.Err(), "still trying")
+
+	first.Close()
+	firstCancel()
+	require.Eventually(t, second.Handshaked, 10*time.Second, 50*time.Millisecond, "second gets in")
+	assert.NoError(t, second.Err())
+}
+
+// connections that never finish the handshake don't fill the server
+func TestPendingDontFillServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	maxPeers := cfg.MAX_PEERS
+	cfg.MAX_PEERS = 1
+	t.Cleanup(func() { cfg.MAX_PEERS = maxPeers })
+
+	srv := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	for i := 0; i < 3; i++ {
+		conn, err := client_memory.New(ctx, cancel).RunClient(srv.auth.OnionAddressFull())
+		require.NoError(t, err)
+		defer conn.Close()
+		go io.Copy(io.Discard, conn)
+	}
+	require.Eventually(t, func() bool {
+		return srv.peerCount() == 3
+	}, 5*time.Second, 50*time.Millisecond, "strangers connected")
+
+	cli := newTestClient(t, ctx, cancel)
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, cli.Handshaked, 10*time.Second, 50*time.Millisecond, "real peer gets in")
+	assert.Zero(t, srv.AdmissionStats().RejectedFull)
+}
+
+func TestServerMultiplePeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli1 := newTestClient(t, ctx, cancel)
+	cli2 := newTestClient(t, ctx, cancel)
+
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli1.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.NoError(t, cli2.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return len(srv.readyPeers()) == 2 && cli1.Handshaked() && cli2.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	// server input goes to every peer
+	_, err := srv.input.Write([]byte("hello everyone"))
+	require.NoError(t, err)
+	for _, cli := range []*testClient{cli1, cli2} {
+		cli := cli
+		assert.Eventually(t, func() bool {
+			return strings.Contains(cli.out.String(), "hello everyone")
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+
+	// acks go back to the sender, not the other peer
+	_, err = cli1.input.Write([]byte("from first"))
+	require.NoError(t, err)
+	_, err = cli2.input.Write([]byte("from second"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		out := srv.out.String()
+		return strings.Contains(out, "from first") && strings.Contains(out, "from second")
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NotContains(t, cli2.out.String(), "from first")
+	assert.NotContains(t, cli1.out.String(), "from second")
+	assert.Eventually(t, func() bool {
+		return len(srv.Pending()) == 0
+	}, 5*time.Second, 50*time.Millisecond, "both peers have acked")
+
+	// one ack doesn't take it from the other peer
+	item, err := srv.outbox.Add([]byte("late"))
+	require.NoError(t, err)
+	srv.outbox.Sent(item.Seq, "first", "second")
+	srv.report(Delivery{Seq: item.Seq, Peer: "first", State: Delivered})
+	assert.Len(t, srv.Pending(), 1)
+	srv.report(Delivery{Seq: item.Seq, Peer: "second", State: Delivered})
+	assert.Empty(t, srv.Pending())
+}
+
+func TestServerPuzzle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	difficulty := cfg.POW_DIFFICULTY
+	cfg.POW_DIFFICULTY = 8
+	t.Cleanup(func() { cfg.POW_DIFFICULTY = difficulty })
+
+	srv := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+
+	t.Run("client solves the puzzle", func(t *testing.T) {
+		cli := newTestClient(t, ctx, cancel)
+		require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+		assert.Eventually(t, func() bool {
+			return srv.Handshaked() && cli.Handshaked()
+		}, 10*time.Second, 50*time.Millisecond, "handshake")
+	})
+
+	t.Run("messages before the solution are rejected", func(t *testing.T) {
+		conn, err := client_memory.New(ctx, cancel).RunClient(srv.auth.OnionAddressFull())
+		require.NoError(t, err)
+		session := mux.New(conn, true)
+		defer session.Close()
+
+		msg := message.NewMSG([]byte("spam"))
+		data, err := msg.Serialize()
+		require.NoError(t, err)
+		// server writes the puzzle first, drain it
+		go io.Copy(io.Discard, session.Main())
+		_, err = session.Main().Write(data)
+		require.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			return srv.AdmissionStats().ProtocolErrors == 1
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+}
+
+// a puzzle sent to the server would make it burn cpu, even with the puzzle off
+func TestPuzzleToServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	difficulty := cfg.POW_DIFFICULTY
+	cfg.POW_DIFFICULTY = 0
+	t.Cleanup(func() { cfg.POW_DIFFICULTY = difficulty })
+
+	srv := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+
+	conn, err := client_memory.New(ctx, cancel).RunClient(srv.auth.OnionAddressFull())
+	require.NoError(t, err)
+	session := mux.New(conn, true)
+	defer session.Close()
+	go io.Copy(io.Discard, session.Main())
+
+	challenge, err := pow.NewChallenge(pow.MaxDifficulty)
+	require.NoError(t, err)
+	for _, msg := range []message.Message{message.NewHello(), message.NewPuzzle(challenge.Marshal())} {
+		data, err := msg.Serialize()
+		require.NoError(t, err)
+		// the server can drop us before the write returns
+		session.Main().Write(data)
+	}
+	assert.Eventually(t, func() bool {
+		return srv.AdmissionStats().ProtocolErrors == 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestDisconnect(t *testing.T) {
+	t.Run("kicked client does not reconnect", func(t *testing.T) {
+		srvCtx, srvCancel := context.WithCancel(context.Background())
+		defer srvCancel()
+		cliCtx, cliCancel := context.WithCancel(context.Background())
+		defer cliCancel()
+
+		srv := newTestClient(t, srvCtx, srvCancel)
+		cli := newTestClient(t, cliCtx, cliCancel)
+		require.NoError(t, srv.RunServer(""))
+		require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+		require.Eventually(t, func() bool {
+			return srv.Handshaked() && cli.Handshaked()
+		}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+		p := cli.readyPeers()[0]
+		name := srv.readyPeers()[0].user.Name
+		_, err := srv.input.Write([]byte("/kick " + name))
+		require.NoError(t, err)
+
+		select {
+		case <-cliCtx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("client is still running")
+		}
+		left, ok := p.lstnr.Left()
+		require.True(t, ok)
+		assert.Equal(t, message.DiscKicked, left.Reason)
+		assert.NoError(t, cli.Err(), "kicked on purpose")
+		assert.NoError(t, srvCtx.Err())
+		assert.Eventually(t, func() bool {
+			return srv.peerCount() == 0
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("client quits", func(t *testing.T) {
+		srvCtx, srvCancel := context.WithCancel(context.Background())
+		defer srvCancel()
+		cliCtx, cliCancel := context.WithCancel(context.Background())
+		defer cliCancel()
+
+		srv := newTestClient(t, srvCtx, srvCancel)
+		cli := newTestClient(t, cliCtx, cliCancel)
+		require.NoError(t, srv.RunServer(""))
+		require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+		require.Eventually(t, func() bool {
+			return srv.Handshaked() && cli.Handshaked()
+		}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+		p := srv.readyPeers()[0]
+		_, err := cli.input.Write([]byte("/quit"))
+		require.NoError(t, err)
+
+		select {
+		case <-cliCtx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("client is still running")
+		}
+		assert.Eventually(t, func() bool {
+			left, ok := p.lstnr.Left()
+			return ok && left.Reason == message.DiscQuit && srv.peerCount() == 0
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.NoError(t, srvCtx.Err())
+	})
+}
+
+func TestRunClientErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	key, password := srv.Credentials()
+
+	cli := newTestClient(t, ctx, cancel)
+	assert.ErrorIs(t, cli.RunClient(key, "0000-0000"), ErrWrongPassword)
+	assert.ErrorIs(t, cli.RunClient("AF3E", password), ErrMalformedKey)
+	srv.Close()
+	assert.ErrorIs(t, cli.RunClient(key, password), ErrPeerUnreachable)
+	assert.NoError(t, ctx.Err(), "errors don't stop the program")
+}
+
+func TestClientStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interval := cfg.HEARTBEAT_INTERVAL
+	cfg.HEARTBEAT_INTERVAL = 20 * time.Millisecond
+	defer func() { cfg.HEARTBEAT_INTERVAL = interval }()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	require.Eventually(t, func() bool {
+		status := cli.Status()
+		return len(status) == 1 && status[0].Health.Latency > 0
+	}, 5*time.Second, 20*time.Millisecond, "latency")
+
+	_, err := cli.input.Write([]byte("/status"))
+	require.NoError(t, err)
+	name := cli.readyPeers()[0].user.Name
+	assert.Eventually(t, func() bool {
+		return strings.Contains(cli.out.String(), "<"+name+"> ok")
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.NotContains(t, srv.out.String(), "/status")
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	delay, maxDelay := cfg.RECONNECT_DELAY, cfg.RECONNECT_MAX_DELAY
+	cfg.RECONNECT_DELAY, cfg.RECONNECT_MAX_DELAY = time.Hour, time.Hour
+	defer func() { cfg.RECONNECT_DELAY, cfg.RECONNECT_MAX_DELAY = delay, maxDelay }()
+
+	srvCtx, srvCancel := context.WithCancel(context.Background())
+	defer srvCancel()
+	srv := newTestClient(t, srvCtx, srvCancel)
+	require.NoError(t, srv.RunServer(""))
+	key, password := srv.auth.AccessKey(), srv.auth.Password()
+
+	// first run: the link drops and the client waits to reconnect
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	cli1 := newTestClient(t, ctx1, cancel1)
+	require.NoError(t, cli1.RunClient(key, password))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli1.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+	srv.readyPeers()[0].close()
+	require.Eventually(t, func() bool {
+		return !cli1.Handshaked()
+	}, 5*time.Second, 20*time.Millisecond, "disconnect")
+
+	_, err := cli1.input.Write([]byte("written offline"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(cli1.Pending()) == 1
+	}, 5*time.Second, 20*time.Millisecond, "pending")
+	cancel1()
+	cli1.Close()
+
+	// second run with the same key delivers the message
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	cli2 := newTestClient(t, ctx2, cancel2)
+	require.NoError(t, cli2.RunClient(key, password))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(srv.out.String(), "written offline")
+	}, 10*time.Second, 50*time.Millisecond, "delivered after restart")
+	assert.Eventually(t, func() bool {
+		return len(cli2.Pending()) == 0
+	}, 5*time.Second, 20*time.Millisecond, "outbox is empty")
+	assert.Equal(t, 1, strings.Count(srv.out.String(), "written offline"))
+}
+
+// the server password is new after a restart, the outbox still opens
+func TestOutboxSurvivesServerRestart(t *testing.T) {
+	sessions, onions := auth.SESSION_DIR, onion.SESSION_DIR
+	auth.SESSION_DIR = t.TempDir()
+	onion.SESSION_DIR = auth.SESSION_DIR
+	defer func() { auth.SESSION_DIR, onion.SESSION_DIR = sessions, onions }()
+
+	srvCtx1, srvCancel1 := context.WithCancel(context.Background())
+	srv1 := newTestClient(t, srvCtx1, srvCancel1)
+	require.NoError(t, srv1.RunServer("restart"))
+	cliCtx1, cliCancel1 := context.WithCancel(context.Background())
+	cli1 := newTestClient(t, cliCtx1, cliCancel1)
+	require.NoError(t, cli1.RunClient(srv1.auth.AccessKey(), srv1.auth.Password()))
+	require.Eventually(t, cli1.Handshaked, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	// both stop, the message waits on the disk
+	srvCancel1()
+	srv1.Close()
+	require.Eventually(t, func() bool {
+		return !cli1.Handshaked()
+	}, 5*time.Second, 20*time.Millisecond, "disconnect")
+	_, err := cli1.input.Write([]byte("before the restart"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(cli1.Pending()) == 1
+	}, 5*time.Second, 20*time.Millisecond, "pending")
+	cliCancel1()
+	cli1.Close()
+
+	srvCtx2, srvCancel2 := context.WithCancel(context.Background())
+	defer srvCancel2()
+	srv2 := newTestClient(t, srvCtx2, srvCancel2)
+	require.NoError(t, srv2.RunServer("restart"))
+	require.Equal(t, srv1.auth.OnionAddress(), srv2.auth.OnionAddress())
+	cliCtx2, cliCancel2 := context.WithCancel(context.Background())
+	defer cliCancel2()
+	cli2 := newTestClient(t, cliCtx2, cliCancel2)
+	require.NoError(t, cli2.RunClient(srv2.auth.AccessKey(), srv2.auth.Password()))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(srv2.out.String(), "before the restart")
+	}, 10*time.Second, 50*time.Millisecond, "delivered after both restarts")
+}
+
+// an outbox that can't be decrypted is moved away once, with an error
+func TestUnreadableOutbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newTestClient(t, ctx, cancel)
+	c.openOutbox("client", "unreadable", []byte("old key"))
+	_, err := c.outbox.Add([]byte("lost"))
+	require.NoError(t, err)
+
+	c.openOutbox("client", "unreadable", []byte("new key"))
+	assert.Zero(t, c.outbox.Len())
+	matches, err := filepath.Glob(filepath.Join(cfg.OUTBOX_DIR, "*.unreadable"))
+	require.NoError(t, err)
+	assert.Len(t, matches, 1)
+}
+
+func TestMessageSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+
+	max := cli.MaxMessageSize()
+	require.Equal(t, 189, max)
+	_, err := cli.SendText(strings.Repeat("x", max+1))
+	assert.ErrorIs(t, err, ErrMessageTooLong)
+	assert.Empty(t, cli.Pending(), "not saved")
+
+	_, err = cli.SendText(strings.Repeat("y", max))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(srv.out.String(), strings.Repeat("y", 32))
+	}, 10*time.Second, 50*time.Millisecond, "the longest one goes through")
+}
+
+// text the crypter can't carry fails and leaves the outbox
+func TestUnencryptableMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	// like one from an old outbox, too big for rsa
+	item, err := cli.outbox.Add(bytes.Repeat([]byte("x"), 500))
+	require.NoError(t, err)
+	cli.Client.input.push(item)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(cli.out.String(), "not delivered") && len(cli.Pending()) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// not back after the next handshake
+	cli.requeue()
+	assert.Zero(t, cli.Client.input.len())
+}
+
+func TestRekey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+	cliKey := srv.readyPeers()[0].user.Key()
+	srvKey := cli.readyPeers()[0].user.Key()
+
+	_, err := cli.input.Write([]byte("/rekey"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return cli.readyPeers()[0].lstnr.Rekeys() == 1 && srv.readyPeers()[0].lstnr.Rekeys() == 1
+	}, 10*time.Second, 50*time.Millisecond, "rekey")
+	assert.Contains(t, cli.out.String(), "session keys rotated")
+	assert.NotEqual(t, cliKey, srv.readyPeers()[0].user.Key())
+	assert.NotEqual(t, srvKey, cli.readyPeers()[0].user.Key())
+
+	// chat goes on with the new keys
+	_, err = cli.input.Write([]byte("after rekey from client"))
+	require.NoError(t, err)
+	_, err = srv.input.Write([]byte("after rekey from server"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(srv.out.String(), "after rekey from client") &&
+			strings.Contains(cli.out.String(), "after rekey from server")
+	}, 5*time.Second, 50*time.Millisecond)
+
+}
+
+func TestRekeyByMessageCount(t *testing.T) {
+	messages := cfg.REKEY_MESSAGES
+	cfg.REKEY_MESSAGES = 2
+	defer func() { cfg.REKEY_MESSAGES = messages }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	for _, text := range []string{"one", "two"} {
+		_, err := cli.input.Write([]byte(text))
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		return srv.readyPeers()[0].lstnr.Rekeys() >= 1 && cli.readyPeers()[0].lstnr.Rekeys() >= 1
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestSendFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	data := bytes.Repeat([]byte("dune "), 50_000)
+	path := filepath.Join(t.TempDir(), "spice.txt")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	// offer waits for the answer
+	offer := func() string {
+		_, err := cli.input.Write([]byte("/send " + path))
+		require.NoError(t, err)
+		var id string
+		require.Eventually(t, func() bool {
+			srv.files.mu.Lock()
+			defer srv.files.mu.Unlock()
+			for _, in := range srv.files.in {
+				if in.decide != nil {
+					id = in.ShortID()
+				}
+			}
+			return id != ""
+		}, 10*time.Second, 20*time.Millisecond, "offer")
+		return id
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		id := offer()
+		assert.Contains(t, srv.out.String(), "offers spice.txt (244.1 KB)")
+		_, err := srv.input.Write([]byte("/accept " + id))
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return strings.Contains(cli.out.String(), "spice.txt sent to")
+		}, 10*time.Second, 50*time.Millisecond)
+		got, err := os.ReadFile(filepath.Join(cfg.DOWNLOAD_DIR, "spice.txt"))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got))
+		assert.Contains(t, cli.out.String(), "100%")
+		assert.Contains(t, srv.out.String(), "100%")
+		assert.Empty(t, cli.Files())
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		id := offer()
+		_, err := srv.input.Write([]byte("/decline " + id))
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return strings.Contains(cli.out.String(), "spice.txt not sent")
+		}, 10*time.Second, 50*time.Millisecond)
+		assert.Empty(t, srv.Files())
+	})
+
+	// chat still works
+	_, err := cli.input.Write([]byte("after the file"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(srv.out.String(), "after the file")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestFilePolicy(t *testing.T) {
+	deny, auto := cfg.FILE_DENY_EXT, cfg.FILE_AUTO_ACCEPT_VERIFIED
+	cfg.FILE_DENY_EXT, cfg.FILE_AUTO_ACCEPT_VERIFIED = []string{"exe"}, true
+	defer func() { cfg.FILE_DENY_EXT, cfg.FILE_AUTO_ACCEPT_VERIFIED = deny, auto }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	dir := t.TempDir()
+	send := func(name string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("spice must flow"), 0600))
+		_, err := cli.input.Write([]byte("/send " + path))
+		require.NoError(t, err)
+	}
+
+	t.Run("denied without asking", func(t *testing.T) {
+		send("setup.exe")
+		assert.Eventually(t, func() bool {
+			return strings.Contains(cli.out.String(), "setup.exe not sent")
+		}, 10*time.Second, 50*time.Millisecond)
+		assert.Contains(t, cli.out.String(), ".exe files are denied")
+		assert.NotContains(t, srv.out.String(), "/accept")
+		assert.NoFileExists(t, filepath.Join(cfg.DOWNLOAD_DIR, "setup.exe"))
+	})
+
+	t.Run("unverified peer is asked", func(t *testing.T) {
+		send("notes.txt")
+		var id string
+		require.Eventually(t, func() bool {
+			srv.files.mu.Lock()
+			defer srv.files.mu.Unlock()
+			for _, in := range srv.files.in {
+				if in.decide != nil {
+					id = in.ShortID()
+				}
+			}
+			return id != ""
+		}, 10*time.Second, 20*time.Millisecond, "offer")
+		assert.NotContains(t, srv.out.String(), "accepted by the policy")
+		srv.Command("/decline "+id, srv.out)
+		assert.Eventually(t, func() bool {
+			return strings.Contains(cli.out.String(), "notes.txt not sent")
+		}, 10*time.Second, 50*time.Millisecond)
+	})
+
+	// both sides see the same code
+	status, peer := srv.Status(), cli.Status()
+	require.Len(t, status, 1)
+	require.Len(t, peer, 1)
+	assert.Equal(t, status[0].Code, peer[0].Code)
+	assert.Contains(t, srv.out.String(), "safety code "+status[0].Code)
+	assert.False(t, status[0].Verified)
+	require.True(t, srv.Command("/verify "+status[0].Name, srv.out))
+	assert.True(t, srv.Status()[0].Verified)
+
+	t.Run("auto accepted, never over an existing file", func(t *testing.T) {
+		existing := filepath.Join(cfg.DOWNLOAD_DIR, "map.txt")
+		require.NoError(t, os.MkdirAll(cfg.DOWNLOAD_DIR, 0700))
+		require.NoError(t, os.WriteFile(existing, []byte("mine"), 0600))
+		send("map.txt")
+		assert.Eventually(t, func() bool {
+			return strings.Contains(cli.out.String(), "map.txt sent to")
+		}, 10*time.Second, 50*time.Millisecond)
+		assert.Contains(t, srv.out.String(), "accepted by the policy")
+		mine, err := os.ReadFile(existing)
+		require.NoError(t, err)
+		assert.Equal(t, "mine", string(mine))
+		got, err := os.ReadFile(filepath.Join(cfg.DOWNLOAD_DIR, "map (1).txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "spice must flow", string(got))
+	})
+}
+
+func TestPipeMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	up := bytes.Repeat([]byte("tar data "), 100_000)
+	var srvOut, cliOut bytes.Buffer
+	srvDone := srv.Pipe(bytes.NewReader(nil), &srvOut)
+	cliDone := cli.Pipe(bytes.NewReader(up), &cliOut)
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+
+	for _, done := range []<-chan error{srvDone, cliDone} {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(20 * time.Second):
+			t.Fatal("pipe is not done")
+		}
+	}
+	assert.True(t, bytes.Equal(up, srvOut.Bytes()))
+	assert.Empty(t, cliOut.Bytes())
+	assert.NotContains(t, srv.out.String(), "tar data", "pipe data is not chat")
+}
+
+// tcp echo server, closed with the test
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func echoThrough(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(conn)
+	return string(got)
+}
+
+func TestForward(t *testing.T) {
+	echo := echoServer(t)
+	allow, listen := cfg.FORWARD_ALLOW, cfg.FORWARD_LISTEN
+	cfg.FORWARD_ALLOW, cfg.FORWARD_LISTEN = []string{echo}, []string{"127.0.0.1:*"}
+	defer func() { cfg.FORWARD_ALLOW, cfg.FORWARD_LISTEN = allow, listen }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestClient(t, ctx, cancel)
+	cli := newTestClient(t, ctx, cancel)
+	local := forward.Spec{Bind: freeAddr(t), Target: echo}
+	denied := forward.Spec{Bind: freeAddr(t), Target: freeAddr(t)}
+	remote := forward.Spec{Bind: freeAddr(t), Target: echo}
+	require.NoError(t, cli.Forward([]forward.Spec{local, denied}, []forward.Spec{remote}))
+	require.NoError(t, srv.RunServer(""))
+	require.NoError(t, cli.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return srv.Handshaked() && cli.Handshaked()
+	}, 10*time.Second, 50*time.Millisecond, "handshake")
+
+	t.Run("local", func(t *testing.T) {
+		assert.Equal(t, "ping", echoThrough(t, local.Bind))
+		// every connection is its own stream
+		assert.Equal(t, "ping", echoThrough(t, local.Bind))
+	})
+
+	t.Run("target not in the allowlist", func(t *testing.T) {
+		assert.Empty(t, echoThrough(t, denied.Bind))
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		// the server listens for us after the handshake
+		require.Eventually(t, func() bool {
+			conn, err := net.Dial("tcp", remote.Bind)
+			if err == nil {
+				conn.Close()
+			}
+			return err == nil
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.Equal(t, "ping", echoThrough(t, remote.Bind))
+	})
+
+	// chat still works
+	_, err := cli.input.Write([]byte("after the tunnel"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(srv.out.String(), "after the tunnel")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// -L connections on a server with several peers all go to the first one
+func TestForwardFirstPeer(t *testing.T) {
+	echo := echoServer(t)
+	allow := cfg.FORWARD_ALLOW
+	defer func() { cfg.FORWARD_ALLOW = allow }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg.FORWARD_ALLOW = nil
+	srv := newTestClient(t, ctx, cancel)
+	local := forward.Spec{Bind: freeAddr(t), Target: echo}
+	require.NoError(t, srv.Forward([]forward.Spec{local}, nil))
+	require.NoError(t, srv.RunServer(""))
+
+	// only the first peer lets us through, the second one denies
+	cfg.FORWARD_ALLOW = []string{echo}
+	first := newTestClient(t, ctx, cancel)
+	require.NoError(t, first.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, first.Handshaked, 10*time.Second, 50*time.Millisecond, "first handshake")
+
+	cfg.FORWARD_ALLOW = nil
+	second := newTestClient(t, ctx, cancel)
+	require.NoError(t, second.RunClient(srv.auth.AccessKey(), srv.auth.Password()))
+	require.Eventually(t, func() bool {
+		return second.Handshaked() && len(srv.readyPeers()) == 2
+	}, 10*time.Second, 50*time.Millisecond, "second handshake")
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "ping", echoThrough(t, local.Bind))
+	}
+}
@@ -4,34 +4,62 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type Connection struct {
-	UUID   string
-	Conn   net.Conn
-	Name   string
-	PubKey []byte // if nil - no handshake yet
+	mu        sync.RWMutex
+	UUID      string
+	Conn      net.Conn
+	Name      string
+	PubKey    []byte // if nil - no handshake yet
+	state     State
+	confirmed time.Time     // when the state got to Confirmed
+	firstKey  []byte        // peer key the handshake confirmed, rekeys don't change it
+	ready     chan struct{} // closed on Confirmed
+	readyOnce sync.Once
 }
 
 func New(conn net.Conn) *Connection {
 	return &Connection{
-		UUID: uuid.New().String(),
-		Conn: conn,
+		UUID:  uuid.New().String(),
+		Conn:  conn,
+		ready: make(chan struct{}),
 	}
 }
 
+// peer key is received, see State for the whole handshake.
+// key is set by the receiver and read by the input goroutine
 func (c *Connection) Handshaked() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.PubKey != nil
 }
 
+func (c *Connection) Key() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.PubKey
+}
+
+// closed when the handshake is confirmed
+func (c *Connection) Ready() <-chan struct{} {
+	return c.ready
+}
+
 func (c *Connection) UpdadeKey(pubKey []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.PubKey = pubKey
 	return nil
 }
 
 func (c *Connection) UpdateName() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	// make a name from first bytes or the hash of pub key
 	sha256Hash := sha256.Sum256(c.PubKey)
 	hash := fmt.Sprintf("%X", sha256Hash[0:2])
@@ -0,0 +1,86 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// handshake progress of the connection
+type State int
+
+const (
+	Connected     State = iota // transport is up
+	Hello                      // peer said hello
+	KeysExchanged              // peer key is received and valid
+	Confirmed                  // peer answered our key confirmation challenge, chat is open
+	Closed
+)
+
+var ErrOutOfOrder = errors.New("out of order handshake")
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Hello:
+		return "hello"
+	case KeysExchanged:
+		return "keys exchanged"
+	case Confirmed:
+		return "confirmed"
+	case Closed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// only one step forward, close from anywhere
+func (s State) canAdvance(to State) bool {
+	if s == Closed {
+		return false
+	}
+	return to == Closed || to == s+1
+}
+
+func (c *Connection) State() State {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+// move the handshake forward, Ready is closed on Confirmed
+func (c *Connection) Advance(to State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.state.canAdvance(to) {
+		return fmt.Errorf("%w: %s -> %s", ErrOutOfOrder, c.state, to)
+	}
+	c.state = to
+	if to == Confirmed {
+		c.confirmed = time.Now()
+		c.firstKey = c.PubKey
+		c.readyOnce.Do(func() { close(c.ready) })
+	}
+	return nil
+}
+
+// handshake is complete and the peer can get our messages
+func (c *Connection) Confirmed() bool {
+	return c.State() == Confirmed
+}
+
+// zero until the handshake is confirmed
+func (c *Connection) ConfirmedAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.confirmed
+}
+
+// peer key from the handshake, nil until confirmed
+func (c *Connection) ConfirmedKey() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.firstKey
+}
@@ -0,0 +1,45 @@
+package connection
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_State(t *testing.T) {
+	t.Run("handshake in order", func(t *testing.T) {
+		conn := New(nil)
+		assert.Equal(t, Connected, conn.State())
+		for _, s := range []State{Hello, KeysExchanged} {
+			require.NoError(t, conn.Advance(s))
+			assert.Equal(t, s, conn.State())
+		}
+		select {
+		case <-conn.Ready():
+			t.Fatal("ready before confirmed")
+		default:
+		}
+		require.NoError(t, conn.Advance(Confirmed))
+		assert.True(t, conn.Confirmed())
+		<-conn.Ready()
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		conn := New(nil)
+		assert.ErrorIs(t, conn.Advance(KeysExchanged), ErrOutOfOrder)
+		require.NoError(t, conn.Advance(Hello))
+		assert.ErrorIs(t, conn.Advance(Hello), ErrOutOfOrder, "second hello")
+		assert.ErrorIs(t, conn.Advance(Confirmed), ErrOutOfOrder)
+		assert.Equal(t, Hello, conn.State())
+	})
+
+	t.Run("closed is final", func(t *testing.T) {
+		conn := New(nil)
+		require.NoError(t, conn.Advance(Hello))
+		require.NoError(t, conn.Advance(Closed))
+		assert.ErrorIs(t, conn.Advance(Closed), ErrOutOfOrder)
+		assert.ErrorIs(t, conn.Advance(KeysExchanged), ErrOutOfOrder)
+		assert.False(t, conn.Confirmed())
+	})
+}
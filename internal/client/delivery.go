@@ -0,0 +1,148 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+)
+
+type DeliveryState int
+
+const (
+	Sending DeliveryState = iota
+	Delivered
+	Failed
+)
+
+func (s DeliveryState) String() string {
+	switch s {
+	case Sending:
+		return "sending"
+	case Delivered:
+		return "delivered"
+	case Failed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// outbound chat message to one peer
+type Delivery struct {
+	Seq      uint64 // same for every peer the input was sent to
+	Peer     string
+	Text     string
+	State    DeliveryState
+	Attempts int
+	Sent     time.Time // last attempt
+}
+
+type tracked struct {
+	Delivery
+	nonce uint32
+}
+
+// outbound messages waiting for the ack, keyed by nonce.
+// keeps the text, not the frame: a retransmit is encrypted again for the
+// current peer key with the same nonce, the receiver drops duplicates by nonce
+type tracker struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	timeout  time.Duration
+	maxRetry int
+	pending  map[uint32]*tracked
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		now:      time.Now,
+		timeout:  cfg.RETRANSMIT_TIMEOUT,
+		maxRetry: cfg.MAX_RETRANSMIT,
+		pending:  make(map[uint32]*tracked),
+	}
+}
+
+func (t *tracker) add(seq uint64, nonce uint32, peer, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[nonce] = &tracked{
+		Delivery: Delivery{
+			Seq:      seq,
+			Peer:     peer,
+			Text:     text,
+			State:    Sending,
+			Attempts: 1,
+			Sent:     t.now(),
+		},
+		nonce: nonce,
+	}
+}
+
+// false if the nonce is not ours, acks for keys and such
+func (t *tracker) ack(nonce uint32) (Delivery, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.pending[nonce]
+	if !ok {
+		return Delivery{}, false
+	}
+	delete(t.pending, nonce)
+	m.State = Delivered
+	return m.Delivery, true
+}
+
+// messages to send again and the ones out of retries
+func (t *tracker) due() ([]tracked, []Delivery) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var resend []tracked
+	var failed []Delivery
+	for nonce, m := range t.pending {
+		if now.Sub(m.Sent) < t.timeout {
+			continue
+		}
+		if m.Attempts > t.maxRetry {
+			delete(t.pending, nonce)
+			m.State = Failed
+			failed = append(failed, m.Delivery)
+			continue
+		}
+		m.Attempts++
+		m.Sent = now
+		resend = append(resend, *m)
+	}
+	sortDeliveries(failed)
+	return resend, failed
+}
+
+// peer is gone, nothing can be delivered anymore
+func (t *tracker) drop() []Delivery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failed := make([]Delivery, 0, len(t.pending))
+	for nonce, m := range t.pending {
+		delete(t.pending, nonce)
+		m.State = Failed
+		failed = append(failed, m.Delivery)
+	}
+	sortDeliveries(failed)
+	return failed
+}
+
+func (t *tracker) list() []Delivery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]Delivery, 0, len(t.pending))
+	for _, m := range t.pending {
+		list = append(list, m.Delivery)
+	}
+	sortDeliveries(list)
+	return list
+}
+
+func sortDeliveries(d []Delivery) {
+	sort.Slice(d, func(i, j int) bool { return d[i].Seq < d[j].Seq })
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTracker() (*tracker, *time.Time) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	t := newTracker()
+	t.now = func() time.Time { return now }
+	t.timeout = 10 * time.Second
+	t.maxRetry = 2
+	return t, &now
+}
+
+func TestTracker(t *testing.T) {
+	t.Run("ack", func(t *testing.T) {
+		tr, _ := newTestTracker()
+		tr.add(1, 7, "ABCD", "hello")
+		require.Len(t, tr.list(), 1)
+		assert.Equal(t, Sending, tr.list()[0].State)
+
+		_, ok := tr.ack(8)
+		assert.False(t, ok, "not our nonce")
+
+		d, ok := tr.ack(7)
+		require.True(t, ok)
+		assert.Equal(t, Delivered, d.State)
+		assert.Equal(t, "hello", d.Text)
+		assert.Empty(t, tr.list())
+
+		_, ok = tr.ack(7)
+		assert.False(t, ok, "duplicate ack")
+	})
+
+	t.Run("retransmit and fail", func(t *testing.T) {
+		tr, now := newTestTracker()
+		tr.add(1, 7, "ABCD", "hello")
+
+		resend, failed := tr.due()
+		assert.Empty(t, resend, "not yet")
+		assert.Empty(t, failed)
+
+		for i := 0; i < 2; i++ {
+			*now = now.Add(10 * time.Second)
+			resend, failed = tr.due()
+			require.Len(t, resend, 1)
+			assert.Equal(t, uint32(7), resend[0].nonce, "same nonce")
+			assert.Equal(t, "hello", resend[0].Text)
+			assert.Empty(t, failed)
+		}
+		assert.Equal(t, 3, tr.list()[0].Attempts)
+
+		*now = now.Add(10 * time.Second)
+		resend, failed = tr.due()
+		assert.Empty(t, resend)
+		require.Len(t, failed, 1)
+		assert.Equal(t, Failed, failed[0].State)
+		assert.Empty(t, tr.list())
+	})
+
+	t.Run("drop pending when the peer is gone", func(t *testing.T) {
+		tr, _ := newTestTracker()
+		tr.add(2, 8, "ABCD", "second")
+		tr.add(1, 7, "ABCD", "first")
+		failed := tr.drop()
+		require.Len(t, failed, 2)
+		assert.Equal(t, "first", failed[0].Text)
+		assert.Equal(t, Failed, failed[1].State)
+		assert.Empty(t, tr.list())
+	})
+}
+
+// after a rekey the peer can't read the old frame, the retransmit is encrypted again
+func TestRetransmitEncryptsAgain(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPeer(ctx, mux.New(local, true))
+	defer p.mux.Close()
+
+	var mu sync.Mutex
+	key := "old"
+	p.encrypt = func(text []byte) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []byte(key + ":" + string(text)), nil
+	}
+	p.sent.timeout = 20 * time.Millisecond
+	require.NoError(t, p.sendTracked(1, []byte("hello")))
+	first := <-p.msgCh
+	assert.Equal(t, "old:hello", string(first.Body))
+
+	mu.Lock()
+	key = "new"
+	mu.Unlock()
+	go p.retransmit()
+	select {
+	case again := <-p.msgCh:
+		assert.Equal(t, message.MSG, again.Type)
+		assert.Equal(t, first.Nonce, again.Nonce, "peer drops it if the first one made it")
+		assert.Equal(t, "new:hello", string(again.Body))
+	case <-time.After(2 * time.Second):
+		t.Fatal("no retransmit")
+	}
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/1F47E/go-shaihulud/internal/client/listner"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/auth"
+)
+
+// why the chat can't go on, the caller decides how to show it
+var (
+	ErrWrongPassword   = auth.ErrWrongPassword
+	ErrMalformedKey    = auth.ErrMalformedKey
+	ErrPeerUnreachable = errors.New("peer is unreachable")
+	ErrHandshakeFailed = errors.New("handshake failed")
+	ErrProtocol        = errors.New("protocol error")
+)
+
+// text the crypter can't carry, SendText refuses it
+var ErrMessageTooLong = errors.New("message is too long")
+
+// listner error by how far the peer got
+func peerError(err error, handshaked bool) error {
+	if handshaked {
+		return fmt.Errorf("%w: %w", ErrProtocol, err)
+	}
+	return fmt.Errorf("%w: %w", ErrHandshakeFailed, err)
+}
+
+// end the chat, err is why, nil if on purpose.
+// the first reason stays
+func (c *Client) stop(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.ctx.Err() == nil {
+		c.err = err
+	}
+	c.cancel()
+}
+
+// server reason to close the chat, nil if it was on purpose
+func leftError(left listner.Left) error {
+	switch left.Reason {
+	case message.DiscProtocol:
+		return fmt.Errorf("%w: %s", ErrProtocol, left.Text)
+	case message.DiscRejected:
+		return fmt.Errorf("%w: rejected, %s", ErrHandshakeFailed, left.Text)
+	}
+	return nil
+}
+
+// why the chat has stopped, nil if it was on purpose or is still going
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
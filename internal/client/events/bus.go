@@ -0,0 +1,144 @@
+package events
+
+import "sync"
+
+// events a subscriber can be behind, older ones are dropped after that
+const queueMax = 1024
+
+// Bus fans the events out to the subscribers.
+// Publish never blocks, every subscriber has its own queue, so a slow
+// frontend can't stall the chat. Events come in the order they were published,
+// a subscriber too far behind gets an Overflow instead of the oldest ones
+type Bus struct {
+	mu     sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+type subscriber struct {
+	mu      sync.Mutex
+	queue   []Event
+	dropped int           // since the last Overflow
+	closing bool          // bus is closed, deliver the queue and stop
+	wake    chan struct{} // something in the queue
+	done    chan struct{} // unsubscribed, drop the queue
+	out     chan Event
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*subscriber]struct{})}
+}
+
+// channel is closed after unsubscribe or when the bus is closed
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	s := &subscriber{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		out:  make(chan Event),
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		close(s.out)
+		return s.out, func() {}
+	}
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	go s.run()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, s)
+			b.mu.Unlock()
+			close(s.done)
+		})
+	}
+	return s.out, unsubscribe
+}
+
+// dropped if the bus is closed
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	for s := range b.subs {
+		s.mu.Lock()
+		if len(s.queue) >= queueMax {
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.dropped++
+		}
+		s.queue = append(s.queue, e)
+		s.mu.Unlock()
+		s.notify()
+	}
+}
+
+// subscribers get what is already published, then their channels are closed
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for s := range b.subs {
+		s.mu.Lock()
+		s.closing = true
+		s.mu.Unlock()
+		s.notify()
+	}
+}
+
+func (s *subscriber) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		if s.dropped > 0 {
+			// in place of the dropped ones, before the rest
+			e := Overflow{Dropped: s.dropped}
+			s.dropped = 0
+			s.mu.Unlock()
+			select {
+			case s.out <- e:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		if len(s.queue) == 0 {
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return
+			}
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		e := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.out <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receive(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		require.True(t, ok, "channel is closed")
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return nil
+	}
+}
+
+func TestBusOrder(t *testing.T) {
+	bus := NewBus()
+	a, _ := bus.Subscribe()
+	b, _ := bus.Subscribe()
+
+	// nobody reads yet, publish must not block
+	for i := 0; i < 1000; i++ {
+		bus.Publish(Notice{Text: fmt.Sprint(i)})
+	}
+	for _, ch := range []<-chan Event{a, b} {
+		for i := 0; i < 1000; i++ {
+			assert.Equal(t, Notice{Text: fmt.Sprint(i)}, receive(t, ch))
+		}
+	}
+}
+
+func TestBusOverflow(t *testing.T) {
+	bus := NewBus()
+	ch, _ := bus.Subscribe()
+	for i := 0; i < queueMax+10; i++ {
+		bus.Publish(Notice{Text: fmt.Sprint(i)})
+	}
+	// the subscriber can hold one in flight, so 9 or 10 are lost
+	first, held := receive(t, ch), 0
+	if n, ok := first.(Notice); ok {
+		assert.Equal(t, "0", n.Text)
+		first, held = receive(t, ch), 1
+	}
+	overflow, ok := first.(Overflow)
+	require.True(t, ok, "got %v", first)
+	assert.Equal(t, 10-held, overflow.Dropped)
+	next := receive(t, ch).(Notice)
+	assert.Equal(t, "10", next.Text, "oldest are dropped")
+	bus.Publish(Notice{Text: "last"})
+	var last Event
+	for i := 0; i < queueMax; i++ {
+		last = receive(t, ch)
+	}
+	assert.Equal(t, Notice{Text: "last"}, last)
+}
+
+func TestBusUnsubscribe(t *testing.T) {
+	bus := NewBus()
+	slow, unsubscribe := bus.Subscribe()
+	fast, _ := bus.Subscribe()
+
+	bus.Publish(KeysRotated{Peer: "alice"})
+	unsubscribe()
+	unsubscribe()
+	bus.Publish(KeysRotated{Peer: "bob"})
+
+	for range slow {
+		// at most what was queued before, then closed
+	}
+	assert.Equal(t, KeysRotated{Peer: "alice"}, receive(t, fast))
+	assert.Equal(t, KeysRotated{Peer: "bob"}, receive(t, fast))
+}
+
+func TestBusClose(t *testing.T) {
+	bus := NewBus()
+	ch, _ := bus.Subscribe()
+	bus.Publish(PeerLeft{Peer: "alice", Reason: "bye"})
+	bus.Close()
+	bus.Publish(PeerLeft{Peer: "bob"})
+
+	assert.Equal(t, PeerLeft{Peer: "alice", Reason: "bye"}, receive(t, ch), "queued events are delivered")
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	late, _ := bus.Subscribe()
+	_, ok = <-late
+	assert.False(t, ok)
+}
+
+func TestEventString(t *testing.T) {
+	at := time.Date(2024, 1, 1, 15, 4, 5, 0, time.UTC)
+	assert.Equal(t, "15:04:05 <alice> hi", MessageReceived{Peer: "alice", Text: "hi", Time: at}.String())
+	assert.Equal(t, "✗ <bob> not delivered: hello", Undelivered{Peer: "bob", Text: " hello\n"}.String())
+	assert.Equal(t, "🔁 reconnecting (attempt 2/5) in 1.5s...", Reconnecting{Attempt: 2, Max: 5, Delay: 1500 * time.Millisecond}.String())
+	assert.Equal(t, "✗ boom", Error{Err: errors.New("boom")}.String())
+	assert.Equal(t, "✗ <bob> boom", Error{Peer: "bob", Err: errors.New("boom")}.String())
+}
+
+func TestPreview(t *testing.T) {
+	assert.Equal(t, "hello", Preview("hello\n"))
+	long := "ёёёёёёёёёёёёёёёёёёёёёёёёёёёёёёёёёёёё"
+	assert.Equal(t, long[:64]+"...", Preview(long))
+}
@@ -0,0 +1,150 @@
+// Events is what the chat core tells the frontends.
+//
+// The core publishes typed events on the bus, every frontend subscribes and
+// shows them its own way. String gives the line the terminal chat prints.
+package events
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type Event interface {
+	fmt.Stringer
+	isEvent()
+}
+
+// connection is open, the handshake goes next.
+// the peer has no name before the key exchange
+type PeerConnected struct {
+	Addr string
+}
+
+// keys are confirmed, chat is open
+type HandshakeComplete struct {
+	Peer string
+}
+
+type MessageReceived struct {
+	Peer string
+	Text string
+	Time time.Time
+}
+
+// peer has acked our message, Seq is from SendText
+type Delivered struct {
+	Seq  uint64
+	Peer string
+	Text string
+}
+
+// no ack after all the retries, the message stays in the outbox
+type Undelivered struct {
+	Seq  uint64
+	Peer string
+	Text string
+}
+
+type KeysRotated struct {
+	Peer string
+}
+
+type PeerLeft struct {
+	Peer   string
+	Reason string
+}
+
+// connection is lost, the client tries again after the delay
+type Reconnecting struct {
+	Attempt int
+	Max     int
+	Delay   time.Duration
+}
+
+type Error struct {
+	Peer string // empty if not about a peer
+	Err  error
+}
+
+// everything else worth a line, like file transfers
+type Notice struct {
+	Peer string
+	Text string
+}
+
+// subscriber was too slow, the oldest events are lost
+type Overflow struct {
+	Dropped int
+}
+
+func (PeerConnected) isEvent()     {}
+func (HandshakeComplete) isEvent() {}
+func (MessageReceived) isEvent()   {}
+func (Delivered) isEvent()         {}
+func (Undelivered) isEvent()       {}
+func (KeysRotated) isEvent()       {}
+func (PeerLeft) isEvent()          {}
+func (Reconnecting) isEvent()      {}
+func (Error) isEvent()             {}
+func (Notice) isEvent()            {}
+func (Overflow) isEvent()          {}
+
+func (e PeerConnected) String() string {
+	return fmt.Sprintf("🔌 connected with %s, handshake...", e.Addr)
+}
+
+func (e HandshakeComplete) String() string {
+	return fmt.Sprintf("🤝 <%s> handshake complete, chat is encrypted", e.Peer)
+}
+
+func (e MessageReceived) String() string {
+	return fmt.Sprintf("%s <%s> %s", e.Time.Format("15:04:05"), e.Peer, e.Text)
+}
+
+func (e Delivered) String() string {
+	return fmt.Sprintf("☑︎ <%s> %s", e.Peer, Preview(e.Text))
+}
+
+func (e Undelivered) String() string {
+	return fmt.Sprintf("✗ <%s> not delivered: %s", e.Peer, Preview(e.Text))
+}
+
+func (e KeysRotated) String() string {
+	return fmt.Sprintf("🔑 <%s> session keys rotated", e.Peer)
+}
+
+func (e PeerLeft) String() string {
+	return fmt.Sprintf("<%s> left the chat: %s", e.Peer, e.Reason)
+}
+
+func (e Reconnecting) String() string {
+	return fmt.Sprintf("🔁 reconnecting (attempt %d/%d) in %s...", e.Attempt, e.Max, e.Delay.Round(time.Millisecond))
+}
+
+func (e Error) String() string {
+	if e.Peer == "" {
+		return fmt.Sprintf("✗ %v", e.Err)
+	}
+	return fmt.Sprintf("✗ <%s> %v", e.Peer, e.Err)
+}
+
+func (e Notice) String() string {
+	return e.Text
+}
+
+func (e Overflow) String() string {
+	return fmt.Sprintf("✗ %d events dropped, the screen can't keep up", e.Dropped)
+}
+
+// short message text for the delivery reports
+func Preview(text string) string {
+	const max = 32
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:max]) + "..."
+}
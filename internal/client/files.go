@@ -0,0 +1,272 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+	"github.com/1F47E/go-shaihulud/internal/client/transfer"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+var errNotConnected = errors.New("not connected")
+
+// file we offer, it goes on after a reconnect to the same peer
+type outgoing struct {
+	*transfer.Sender
+	peer    string
+	running bool
+}
+
+// file the peer offers
+type incoming struct {
+	*transfer.Incoming
+	peer     string
+	accepted bool
+	decide   chan bool // user answer while the offer is pending
+}
+
+// unfinished transfers by id
+type files struct {
+	mu  sync.Mutex
+	out map[string]*outgoing
+	in  map[string]*incoming
+
+	// what we take from peers, read from the config once
+	policy transfer.Policy
+}
+
+func newFiles() *files {
+	return &files{
+		out: make(map[string]*outgoing),
+		in:  make(map[string]*incoming),
+		policy: transfer.Policy{
+			MaxSize:            int64(cfg.FILE_MAX_SIZE),
+			Allow:              cfg.FILE_ALLOW_EXT,
+			Deny:               cfg.FILE_DENY_EXT,
+			AutoAcceptVerified: cfg.FILE_AUTO_ACCEPT_VERIFIED,
+		},
+	}
+}
+
+// offer the file to every connected peer
+func (c *Client) SendFile(path string) error {
+	peers := c.readyPeers()
+	if len(peers) == 0 {
+		return errNotConnected
+	}
+	for _, p := range peers {
+		s, err := transfer.NewSender(path)
+		if err != nil {
+			return err
+		}
+		o := &outgoing{Sender: s, peer: p.user.Name}
+		c.files.mu.Lock()
+		c.files.out[s.ID] = o
+		c.files.mu.Unlock()
+		c.notice(p.user.Name, "📎 offering %s (%s) to <%s>", s.Name, transfer.Size(s.Size), p.user.Name)
+		go c.sendFile(p, o)
+	}
+	return nil
+}
+
+// run the transfer on a new stream, keep it for resume if the link drops
+func (c *Client) sendFile(p *peer, o *outgoing) {
+	c.files.mu.Lock()
+	if o.running {
+		c.files.mu.Unlock()
+		return
+	}
+	o.running = true
+	c.files.mu.Unlock()
+
+	err := c.withSealedStream(p, streamFile, func(conn net.Conn) error {
+		return o.Run(conn, c.progress(p.user.Name, "⇡", o.Name))
+	})
+
+	c.files.mu.Lock()
+	o.running = false
+	keep := err != nil && p.ctx.Err() != nil && !errors.Is(err, transfer.ErrDeclined)
+	if !keep {
+		delete(c.files.out, o.ID)
+	}
+	c.files.mu.Unlock()
+
+	switch {
+	case err == nil:
+		c.notice(o.peer, "📎 %s sent to <%s>, hash verified", o.Name, o.peer)
+	case keep:
+		c.notice(o.peer, "⏸ %s paused, goes on after the reconnect", o.Name)
+	default:
+		c.notice(o.peer, "✗ %s not sent to <%s>: %v", o.Name, o.peer, err)
+	}
+}
+
+// offer unfinished files again, the peer accepts from what it has
+func (c *Client) resumeFiles(p *peer) {
+	c.files.mu.Lock()
+	var resume []*outgoing
+	for _, o := range c.files.out {
+		if o.peer == p.user.Name && !o.running {
+			resume = append(resume, o)
+		}
+	}
+	c.files.mu.Unlock()
+	for _, o := range resume {
+		go c.sendFile(p, o)
+	}
+}
+
+func (c *Client) receiveFile(p *peer, st *mux.Stream) {
+	log := logger.New()
+	var in *incoming
+	err := runSealedStream(p, st, func(conn net.Conn) error {
+		offer, err := transfer.ReadOffer(conn)
+		if err != nil {
+			return err
+		}
+
+		policy := c.files.policy
+		if err := policy.Check(offer.Offer); err != nil {
+			c.notice(p.user.Name, "✗ <%s> offered %s: %v", p.user.Name, offer.Name, err)
+			return transfer.Decline(conn, err.Error())
+		}
+
+		c.files.mu.Lock()
+		in = c.files.in[offer.ID]
+		if in == nil || in.peer != p.user.Name {
+			in = &incoming{Incoming: offer, peer: p.user.Name}
+			// the password is not enough, the user has to /verify the peer
+			in.accepted = policy.AutoAcceptVerified && c.verified(p)
+			c.files.in[offer.ID] = in
+			if in.accepted {
+				c.notice(p.user.Name, "📎 <%s> sends %s (%s) sha256 %x, accepted by the policy",
+					p.user.Name, offer.Name, transfer.Size(offer.Size), offer.Hash[:8])
+			}
+		}
+		accepted := in.accepted
+		if !accepted {
+			in.decide = make(chan bool, 1)
+		}
+		decide := in.decide
+		c.files.mu.Unlock()
+
+		if !accepted {
+			c.notice(p.user.Name, "📎 <%s> offers %s (%s) sha256 %x, /accept %s or /decline %s",
+				p.user.Name, offer.Name, transfer.Size(offer.Size), offer.Hash[:8], offer.ShortID(), offer.ShortID())
+			select {
+			case accepted = <-decide:
+			case <-p.ctx.Done():
+				return p.ctx.Err()
+			}
+			if !accepted {
+				c.dropIncoming(offer.ID)
+				return transfer.Decline(conn, "declined")
+			}
+			c.files.mu.Lock()
+			in.accepted = true
+			c.files.mu.Unlock()
+		}
+
+		partial := partialPath(offer.ID)
+		if err := offer.Receive(conn, partial, c.progress(p.user.Name, "⇣", offer.Name)); err != nil {
+			return err
+		}
+		dest, err := saveFile(partial, offer.Name)
+		if err != nil {
+			return err
+		}
+		c.dropIncoming(offer.ID)
+		c.notice(p.user.Name, "📎 %s saved to %s, hash verified", offer.Name, dest)
+		return nil
+	})
+	switch {
+	case err == nil:
+	case in == nil:
+		log.Warnf("<%s> bad file offer: %v", p.user.Name, err)
+	case p.ctx.Err() != nil && !errors.Is(err, transfer.ErrHash):
+		c.notice(p.user.Name, "⏸ %s paused, goes on after the reconnect", in.Name)
+	default:
+		c.dropIncoming(in.ID)
+		os.Remove(partialPath(in.ID))
+		c.notice(p.user.Name, "✗ %s not received: %v", in.Name, err)
+	}
+}
+
+func (c *Client) dropIncoming(id string) {
+	c.files.mu.Lock()
+	defer c.files.mu.Unlock()
+	delete(c.files.in, id)
+}
+
+// answer a pending offer by its short id
+func (c *Client) DecideFile(id string, accept bool) bool {
+	c.files.mu.Lock()
+	defer c.files.mu.Unlock()
+	for fullID, in := range c.files.in {
+		if strings.HasPrefix(fullID, id) && !in.accepted && in.decide != nil {
+			select {
+			case in.decide <- accept:
+			default:
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// unfinished transfers, sorted by name
+func (c *Client) Files() []string {
+	c.files.mu.Lock()
+	defer c.files.mu.Unlock()
+	var list []string
+	for _, o := range c.files.out {
+		list = append(list, fmt.Sprintf("⇡ %s %s to <%s>", o.ShortID(), o.Name, o.peer))
+	}
+	for _, in := range c.files.in {
+		state := "waiting for /accept"
+		if in.accepted {
+			state = "receiving"
+		}
+		list = append(list, fmt.Sprintf("⇣ %s %s from <%s>, %s", in.ShortID(), in.Name, in.peer, state))
+	}
+	sort.Strings(list)
+	return list
+}
+
+// progress line every 10%
+func (c *Client) progress(peer, arrow, name string) func(done, total int64) {
+	last := -1
+	return func(done, total int64) {
+		step := 10
+		if total > 0 {
+			step = int(done * 10 / total)
+		}
+		if step == last {
+			return
+		}
+		last = step
+		c.notice(peer, "%s %s %s %s/%s", arrow, name, transfer.Bar(done, total, 20), transfer.Size(done), transfer.Size(total))
+	}
+}
+
+// unverified data stays out of the download dir
+func partialPath(id string) string {
+	return filepath.Join(cfg.DOWNLOAD_DIR, ".partial", id)
+}
+
+// move the verified file to the download dir, never over an existing one
+func saveFile(partial, name string) (string, error) {
+	dest, err := transfer.Reserve(cfg.DOWNLOAD_DIR, name)
+	if err != nil {
+		return "", err
+	}
+	return dest, os.Rename(partial, dest)
+}
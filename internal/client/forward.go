@@ -0,0 +1,196 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/forward"
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+// our -L and -R rules and what the peer can ask of us
+type forwards struct {
+	local  []forward.Spec
+	remote []forward.Spec
+	allow  forward.Allowlist // targets the peer can dial through us
+	listen forward.Allowlist // binds the peer can listen on here
+	dial   time.Duration
+}
+
+func newForwards() *forwards {
+	return &forwards{
+		allow:  cfg.FORWARD_ALLOW,
+		listen: cfg.FORWARD_LISTEN,
+		dial:   cfg.FORWARD_DIAL_TIMEOUT,
+	}
+}
+
+// Forward listens on the -L binds right away, connections go to the peer
+// that was confirmed first, so a later peer never gets them while it is there.
+// -R binds are asked from every peer after the handshake.
+// Call it before RunServer or RunClient
+func (c *Client) Forward(local, remote []forward.Spec) error {
+	log := logger.New()
+	c.forwards.local, c.forwards.remote = local, remote
+	var listeners []net.Listener
+	for _, spec := range local {
+		ln, err := net.Listen("tcp", spec.Bind)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("can't forward %s: %w", spec, err)
+		}
+		listeners = append(listeners, ln)
+		log.Infof("Forwarding %s", spec)
+	}
+	for i, ln := range listeners {
+		go c.listenLocal(ln, local[i].Target)
+	}
+	return nil
+}
+
+func (c *Client) listenLocal(ln net.Listener, target string) {
+	go func() {
+		<-c.ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.forwardLocal(conn, target)
+	}
+}
+
+func (c *Client) forwardLocal(conn net.Conn, target string) {
+	peers := c.readyPeers()
+	if len(peers) == 0 {
+		logger.New().Warnf("Can't forward to %s: %v", target, errNotConnected)
+		conn.Close()
+		return
+	}
+	c.tunnel(peers[0], streamForward, target, conn)
+}
+
+// -R binds, the peer listens and sends the connections back
+func (c *Client) requestListens(p *peer) {
+	for _, spec := range c.forwards.remote {
+		go c.requestListen(p, spec)
+	}
+}
+
+func (c *Client) requestListen(p *peer, spec forward.Spec) {
+	log := logger.New()
+	err := c.withSealedStream(p, streamListen, func(conn net.Conn) error {
+		if err := forward.Request(conn, spec.Bind); err != nil {
+			return err
+		}
+		log.Infof("<%s> forwards %s", p.user.Name, spec)
+		// the peer listens while the stream is open
+		io.Copy(io.Discard, conn)
+		return nil
+	})
+	if err != nil {
+		log.Warnf("<%s> can't forward %s: %v", p.user.Name, spec, err)
+	}
+}
+
+// open a stream for the connection and join them if the peer connects
+func (c *Client) tunnel(p *peer, kind streamKind, addr string, conn net.Conn) {
+	err := c.withSealedStream(p, kind, func(st net.Conn) error {
+		if err := forward.Request(st, addr); err != nil {
+			return err
+		}
+		forward.Join(st, conn)
+		return nil
+	})
+	if err != nil {
+		logger.New().Warnf("<%s> can't forward to %s: %v", p.user.Name, addr, err)
+		conn.Close()
+	}
+}
+
+// -L of the peer, dial the target if the allowlist has it
+func (c *Client) acceptForward(p *peer, st *mux.Stream) {
+	runSealedStream(p, st, func(st net.Conn) error {
+		target, err := forward.ReadRequest(st)
+		if err != nil {
+			return err
+		}
+		if !c.forwards.allow.Allows(target) {
+			logger.New().Warnf("<%s> asked for %s, not in FORWARD_ALLOW", p.user.Name, target)
+			return forward.Reply(st, forward.ErrDenied)
+		}
+		return c.dialAndJoin(st, target)
+	})
+}
+
+// -R of the peer, listen here if the allowlist has the bind
+func (c *Client) acceptListen(p *peer, st *mux.Stream) {
+	log := logger.New()
+	runSealedStream(p, st, func(st net.Conn) error {
+		bind, err := forward.ReadRequest(st)
+		if err != nil {
+			return err
+		}
+		if !c.forwards.listen.Allows(bind) {
+			log.Warnf("<%s> asked to listen on %s, not in FORWARD_LISTEN", p.user.Name, bind)
+			return forward.Reply(st, forward.ErrDenied)
+		}
+		ln, err := net.Listen("tcp", bind)
+		if rerr := forward.Reply(st, err); rerr != nil || err != nil {
+			if ln != nil {
+				ln.Close()
+			}
+			return rerr
+		}
+		log.Infof("<%s> listens on %s", p.user.Name, bind)
+		// until the peer or the link is gone
+		go func() {
+			io.Copy(io.Discard, st)
+			ln.Close()
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return nil
+			}
+			go c.tunnel(p, streamReverse, bind, conn)
+		}
+	})
+}
+
+// connection to our -R bind on the peer side
+func (c *Client) acceptReverse(p *peer, st *mux.Stream) {
+	runSealedStream(p, st, func(st net.Conn) error {
+		bind, err := forward.ReadRequest(st)
+		if err != nil {
+			return err
+		}
+		for _, spec := range c.forwards.remote {
+			if spec.Bind == bind {
+				return c.dialAndJoin(st, spec.Target)
+			}
+		}
+		// we never asked for it
+		return forward.Reply(st, forward.ErrDenied)
+	})
+}
+
+func (c *Client) dialAndJoin(st net.Conn, target string) error {
+	conn, err := net.DialTimeout("tcp", target, c.forwards.dial)
+	if rerr := forward.Reply(st, err); rerr != nil || err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return rerr
+	}
+	forward.Join(st, conn)
+	return nil
+}
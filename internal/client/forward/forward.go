@@ -0,0 +1,195 @@
+// Forward tunnels tcp connections through the peer link, like ssh -L and -R.
+//
+// Every forwarded connection gets its own stream. The side that opens it
+// names the address, the other side checks it and answers with the status
+// before any data goes: 2 bytes len | address, then 1 byte ok | reason.
+package forward
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const maxAddr = 1024
+
+var (
+	ErrDenied   = errors.New("address is not allowed")
+	ErrProtocol = errors.New("forward protocol error")
+)
+
+// one -L or -R rule: [bind:]port:host:hostport
+type Spec struct {
+	Bind   string // listen here
+	Target string // dial this on the other end
+}
+
+func (s Spec) String() string {
+	return s.Bind + " -> " + s.Target
+}
+
+// bind host is localhost if not set, ipv6 goes in brackets
+func ParseSpec(s string) (Spec, error) {
+	parts := split(s)
+	switch len(parts) {
+	case 3:
+		parts = append([]string{"localhost"}, parts...)
+	case 4:
+	default:
+		return Spec{}, fmt.Errorf("bad forward %q, want [bind:]port:host:hostport", s)
+	}
+	for _, port := range []string{parts[1], parts[3]} {
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return Spec{}, fmt.Errorf("bad port %q in %q", port, s)
+		}
+	}
+	if parts[2] == "" {
+		return Spec{}, fmt.Errorf("no host in %q", s)
+	}
+	return Spec{
+		Bind:   net.JoinHostPort(parts[0], parts[1]),
+		Target: net.JoinHostPort(parts[2], parts[3]),
+	}, nil
+}
+
+// by colons outside of brackets, brackets are dropped
+func split(s string) []string {
+	var parts []string
+	var b strings.Builder
+	inside := false
+	for _, r := range s {
+		switch {
+		case r == '[':
+			inside = true
+		case r == ']':
+			inside = false
+		case r == ':' && !inside:
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return append(parts, b.String())
+}
+
+// host:port patterns, * is any host or port. empty allows nothing.
+// names are not resolved, localhost and 127.0.0.1 are different entries
+type Allowlist []string
+
+func (a Allowlist) Allows(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range a {
+		if pattern == "*" {
+			return true
+		}
+		h, p, err := net.SplitHostPort(pattern)
+		if err != nil {
+			continue
+		}
+		if (h == "*" || strings.EqualFold(h, host)) && (p == "*" || p == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// ask the other end for the address, nil if it is connected
+func Request(conn io.ReadWriter, addr string) error {
+	if len(addr) > maxAddr {
+		return fmt.Errorf("%w: address is too long", ErrProtocol)
+	}
+	msg := make([]byte, 2, 2+len(addr))
+	binary.BigEndian.PutUint16(msg, uint16(len(addr)))
+	if _, err := conn.Write(append(msg, addr...)); err != nil {
+		return err
+	}
+	status := make([]byte, 3)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+	if status[0] == 1 {
+		return nil
+	}
+	reason := make([]byte, binary.BigEndian.Uint16(status[1:]))
+	if _, err := io.ReadFull(conn, reason); err != nil {
+		return err
+	}
+	if string(reason) == ErrDenied.Error() {
+		return fmt.Errorf("%w: %s", ErrDenied, addr)
+	}
+	return fmt.Errorf("peer can't connect to %s: %s", addr, reason)
+}
+
+// address the other end asks for
+func ReadRequest(conn io.Reader) (string, error) {
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return "", err
+	}
+	n := binary.BigEndian.Uint16(size)
+	if n > maxAddr {
+		return "", fmt.Errorf("%w: address of %d bytes", ErrProtocol, n)
+	}
+	addr := make([]byte, n)
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return "", err
+	}
+	return string(addr), nil
+}
+
+// status of the request, nil is ok
+func Reply(conn io.Writer, err error) error {
+	if err == nil {
+		_, err := conn.Write([]byte{1, 0, 0})
+		return err
+	}
+	reason := err.Error()
+	if errors.Is(err, ErrDenied) {
+		// the peer doesn't need to know why
+		reason = ErrDenied.Error()
+	}
+	if len(reason) > maxAddr {
+		reason = reason[:maxAddr]
+	}
+	msg := make([]byte, 3, 3+len(reason))
+	binary.BigEndian.PutUint16(msg[1:], uint16(len(reason)))
+	_, werr := conn.Write(append(msg, reason...))
+	return werr
+}
+
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// copy both ways until both are done. EOF from one side closes the write
+// half of the other, an error closes both
+func Join(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(dst, src); err != nil {
+			a.Close()
+			b.Close()
+			return
+		}
+		if hc, ok := dst.(halfCloser); ok {
+			hc.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
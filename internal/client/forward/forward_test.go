@@ -0,0 +1,114 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpec(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Spec
+	}{
+		{"2222:localhost:22", Spec{"localhost:2222", "localhost:22"}},
+		{"0.0.0.0:8080:10.0.0.5:80", Spec{"0.0.0.0:8080", "10.0.0.5:80"}},
+		{"[::1]:2222:[fe80::1]:22", Spec{"[::1]:2222", "[fe80::1]:22"}},
+		{"0:db.internal:5432", Spec{"localhost:0", "db.internal:5432"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseSpec(tt.in)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+
+	for _, bad := range []string{"", "22", "localhost:22", "a:b:c:d:e", "x:localhost:22", "2222:localhost:70000", "2222::22"} {
+		_, err := ParseSpec(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	list := Allowlist{"localhost:22", "10.0.0.5:*", "*:443"}
+	assert.True(t, list.Allows("localhost:22"))
+	assert.True(t, list.Allows("LOCALHOST:22"))
+	assert.True(t, list.Allows("10.0.0.5:5432"))
+	assert.True(t, list.Allows("example.com:443"))
+	assert.False(t, list.Allows("localhost:23"))
+	assert.False(t, list.Allows("127.0.0.1:22"), "names are not resolved")
+	assert.False(t, list.Allows("10.0.0.6:80"))
+	assert.False(t, list.Allows("no port"))
+
+	assert.False(t, Allowlist(nil).Allows("localhost:22"), "empty allows nothing")
+	assert.True(t, Allowlist{"*"}.Allows("anything:1"))
+}
+
+func TestRequest(t *testing.T) {
+	serve := func(err error) error {
+		a, b := net.Pipe()
+		defer a.Close()
+		go func() {
+			defer b.Close()
+			addr, rerr := ReadRequest(b)
+			if rerr != nil || addr != "localhost:22" {
+				return
+			}
+			Reply(b, err)
+		}()
+		return Request(a, "localhost:22")
+	}
+	assert.NoError(t, serve(nil))
+	assert.ErrorIs(t, serve(ErrDenied), ErrDenied)
+	err := serve(errors.New("connection refused"))
+	assert.Contains(t, err.Error(), "connection refused")
+	assert.NotErrorIs(t, err, ErrDenied)
+}
+
+// connected tcp pair
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	conn := <-accepted
+	require.NotNil(t, conn)
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+// the far end answers after the request is closed, like a http/1.0 server
+func TestJoinHalfClose(t *testing.T) {
+	app, local := tcpPair(t)
+	far, server := tcpPair(t)
+	go func() {
+		req, _ := io.ReadAll(server)
+		server.Write(append([]byte("got "), req...))
+		server.Close()
+	}()
+	joined := make(chan struct{})
+	go func() {
+		Join(local, far)
+		close(joined)
+	}()
+
+	_, err := app.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, app.(*net.TCPConn).CloseWrite())
+	got, err := io.ReadAll(app)
+	require.NoError(t, err)
+	assert.Equal(t, "got ping", string(got))
+	<-joined
+}
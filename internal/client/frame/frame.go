@@ -0,0 +1,40 @@
+// Frame is the typed record of the pipe and file transfer streams.
+//
+// Frame: 1 byte type | 4 bytes body len | body
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const headerSize = 5
+
+var ErrTooLarge = errors.New("frame is too large")
+
+func Write(w io.Writer, typ byte, body []byte) error {
+	header := make([]byte, headerSize, headerSize+len(body))
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+	_, err := w.Write(append(header, body...))
+	return err
+}
+
+// frames with a body over max are refused before it is read
+func Read(r io.Reader, max int) (byte, []byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > uint32(max) {
+		return 0, nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
@@ -0,0 +1,36 @@
+package frame
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, 7, []byte("spice")))
+	require.NoError(t, Write(&buf, 8, nil))
+
+	typ, body, err := Read(&buf, 16)
+	require.NoError(t, err)
+	assert.Equal(t, byte(7), typ)
+	assert.Equal(t, []byte("spice"), body)
+
+	typ, body, err = Read(&buf, 16)
+	require.NoError(t, err)
+	assert.Equal(t, byte(8), typ)
+	assert.Empty(t, body)
+
+	_, _, err = Read(&buf, 16)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, 1, make([]byte, 17)))
+	_, _, err := Read(&buf, 16)
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
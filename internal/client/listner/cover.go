@@ -0,0 +1,28 @@
+package listner
+
+import (
+	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/padding"
+)
+
+// encrypted frame that looks like a chat message.
+// the peer acks it as usual, we drop the ack
+func (l *Listner) dummy(user *connection.Connection, crypter asymmetric.Asymmetric) (message.Message, error) {
+	cipher, err := crypter.Encrypt(padding.Pad(padding.Dummy, nil), user.Key())
+	if err != nil {
+		return message.Message{}, err
+	}
+	msg := message.NewMSG(cipher)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decoys.add(msg.Nonce)
+	return msg, nil
+}
+
+func (l *Listner) isDummy(nonce uint32) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.decoys.has(nonce)
+}
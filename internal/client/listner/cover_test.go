@@ -0,0 +1,60 @@
+package listner
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/padding"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoverTraffic(t *testing.T) {
+	l := newTestListner(t, 0, true, func(l *Listner) {
+		l.Cover = 20 * time.Millisecond
+	})
+	l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+	p := &testPeer{t, l, bufio.NewReader(l.remote)}
+
+	// the peer key is ours, so the test can read what the listner sends
+	read := func() (padding.Kind, []byte, *message.Message) {
+		msg := p.expect(message.MSG)
+		plain, err := l.crypter.Decrypt(msg.Body)
+		require.NoError(t, err)
+		kind, text, err := padding.Unpad(plain)
+		require.NoError(t, err)
+		return kind, text, msg
+	}
+
+	kind, _, first := read()
+	assert.Equal(t, padding.Dummy, kind, "nothing to say yet")
+	// dummy ack is not a delivery
+	p.send(message.NewAck(first.Nonce))
+
+	cipher, err := l.crypter.Encrypt(padding.Pad(padding.Data, []byte("real one")), l.user.Key())
+	require.NoError(t, err)
+	real := message.NewMSG(cipher)
+	l.msgCh <- real
+	for {
+		kind, text, msg := read()
+		if kind == padding.Data {
+			assert.Equal(t, "real one", string(text))
+			assert.Equal(t, real.Nonce, msg.Nonce)
+			assert.Equal(t, first.Len, msg.Len, "same frame size")
+			break
+		}
+	}
+
+	t.Run("incoming dummy is dropped", func(t *testing.T) {
+		cipher, err := l.crypter.Encrypt(padding.Pad(padding.Dummy, nil), l.user.Key())
+		require.NoError(t, err)
+		dummy := message.NewMSG(cipher)
+		p.send(dummy)
+		ack := p.expect(message.ACK)
+		assert.Equal(t, dummy.Nonce, ack.Nonce, "acked like a real message")
+		assert.Empty(t, l.out.String())
+	})
+}
@@ -0,0 +1,37 @@
+package listner
+
+// last seen message nonces, retransmitted messages are acked but shown once
+type nonceSet struct {
+	ring []uint32
+	next int
+	seen map[uint32]struct{}
+}
+
+func newNonceSet(size int) *nonceSet {
+	return &nonceSet{
+		ring: make([]uint32, 0, size),
+		seen: make(map[uint32]struct{}, size),
+	}
+}
+
+// false if the nonce is already there.
+// the oldest one is forgotten when the set is full
+func (s *nonceSet) add(nonce uint32) bool {
+	if _, ok := s.seen[nonce]; ok {
+		return false
+	}
+	if len(s.ring) < cap(s.ring) {
+		s.ring = append(s.ring, nonce)
+	} else {
+		delete(s.seen, s.ring[s.next])
+		s.ring[s.next] = nonce
+		s.next = (s.next + 1) % len(s.ring)
+	}
+	s.seen[nonce] = struct{}{}
+	return true
+}
+
+func (s *nonceSet) has(nonce uint32) bool {
+	_, ok := s.seen[nonce]
+	return ok
+}
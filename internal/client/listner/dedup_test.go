@@ -0,0 +1,104 @@
+package listner
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/padding"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNonceSet(t *testing.T) {
+	s := newNonceSet(2)
+	assert.True(t, s.add(1))
+	assert.False(t, s.add(1))
+	assert.True(t, s.add(2))
+	assert.True(t, s.add(3))
+	// 1 is forgotten
+	assert.True(t, s.add(1))
+	assert.False(t, s.add(3))
+}
+
+// acks the peer gets from the listner
+func readAcks(remote io.Reader) <-chan uint32 {
+	acks := make(chan uint32, 4)
+	go func() {
+		reader := bufio.NewReader(remote)
+		for {
+			m, err := message.Read(reader)
+			if err != nil {
+				return
+			}
+			if m.Type == message.ACK {
+				acks <- m.Nonce
+			}
+		}
+	}()
+	return acks
+}
+
+func TestReceiverDropsDuplicates(t *testing.T) {
+	l := newTestListner(t, 0, true)
+	remote := l.remote
+	crypter := l.crypter
+	cipher, err := crypter.Encrypt(padding.Pad(padding.Data, []byte("once")), crypter.PubKey())
+	require.NoError(t, err)
+	msg := message.NewMSG(cipher)
+	data, err := msg.Serialize()
+	require.NoError(t, err)
+
+	acks := readAcks(remote)
+
+	for i := 0; i < 2; i++ {
+		_, err = remote.Write(data)
+		require.NoError(t, err)
+		select {
+		case nonce := <-acks:
+			assert.Equal(t, msg.Nonce, nonce, "retransmit is acked too")
+		case <-time.After(5 * time.Second):
+			t.Fatal("no ack")
+		}
+	}
+	assert.Equal(t, 1, strings.Count(l.out.String(), "once"))
+}
+
+// a frame we can't decrypt is not acked and not remembered, the retransmit is shown
+func TestReceiverRetransmitAfterDecryptError(t *testing.T) {
+	l := newTestListner(t, 0, true)
+	acks := readAcks(l.remote)
+
+	broken := message.NewMSG([]byte("not for this key"))
+	data, err := broken.Serialize()
+	require.NoError(t, err)
+	_, err = l.remote.Write(data)
+	require.NoError(t, err)
+	select {
+	case nonce := <-acks:
+		t.Fatalf("broken frame %d is acked", nonce)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cipher, err := l.crypter.Encrypt(padding.Pad(padding.Data, []byte("second try")), l.crypter.PubKey())
+	require.NoError(t, err)
+	again := message.NewMSG(cipher)
+	again.Nonce = broken.Nonce
+	data, err = again.Serialize()
+	require.NoError(t, err)
+	_, err = l.remote.Write(data)
+	require.NoError(t, err)
+	select {
+	case nonce := <-acks:
+		assert.Equal(t, broken.Nonce, nonce)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ack")
+	}
+	assert.Eventually(t, func() bool {
+		return strings.Contains(l.out.String(), "second try")
+	}, time.Second, 10*time.Millisecond)
+}
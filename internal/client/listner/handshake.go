@@ -0,0 +1,133 @@
+package listner
+
+import (
+	"errors"
+
+	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/keyconfirm"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+// KeyPin returns it when there is no room for one more peer,
+// the peer is told to come back later instead of being rejected
+var ErrFull = errors.New("server is full")
+
+// frames the peer can send in each handshake state.
+// hello goes first, puzzle and key before the chat
+func allowed(state connection.State, t message.MsgType) bool {
+	switch t {
+	case message.DISC:
+		return true
+	case message.HLLO:
+		return state == connection.Connected
+	case message.PUZZ, message.SOLV, message.KEY:
+		return state == connection.Hello
+	case message.CHAL:
+		return state >= connection.Hello && state < connection.Closed
+	case message.CONF:
+		return state == connection.KeysExchanged
+	case message.ACK, message.RUOK, message.IMOK:
+		return state >= connection.Hello && state < connection.Closed
+	case message.MSG:
+		// the key alone doesn't prove the password, the peer sends its CONF first
+		return state == connection.Confirmed
+	case message.REKY:
+		return state == connection.Confirmed
+	default:
+		// unknown types are logged and skipped
+		return state != connection.Closed
+	}
+}
+
+func (l *Listner) advance(user *connection.Connection, to connection.State) error {
+	if err := user.Advance(to); err != nil {
+		return err
+	}
+	if l.OnState != nil {
+		l.OnState(to)
+	}
+	return nil
+}
+
+// check and save the peer key, false if the peer is rejected
+func (l *Listner) handleKey(user *connection.Connection, crypter asymmetric.Asymmetric, key []byte) bool {
+	log := logger.New()
+	if err := crypter.ValidateKey(key); err != nil {
+		log.Warnf("got wrong pub key from the user: %v", err)
+		l.abort(message.DiscProtocol, err)
+		return false
+	}
+	if !l.checkKey(key) {
+		return false
+	}
+	// save guest key
+	if err := user.UpdadeKey(key); err != nil {
+		l.abort(message.DiscProtocol, err)
+		return false
+	}
+	user.UpdateName()
+	if err := l.advance(user, connection.KeysExchanged); err != nil {
+		l.abort(message.DiscProtocol, err)
+		return false
+	}
+
+	// ask the peer to prove it can use the keys
+	challenge, err := keyconfirm.NewChallenge()
+	if err == nil {
+		var cipher []byte
+		cipher, err = crypter.Encrypt(challenge, key)
+		l.challenge = challenge
+		if err == nil {
+			return l.queue(message.NewChallenge(cipher))
+		}
+	}
+	l.abort(message.DiscProtocol, err)
+	return false
+}
+
+// KeyCheck before anything costly, false if the peer is rejected
+func (l *Listner) checkKey(key []byte) bool {
+	if l.KeyCheck == nil {
+		return true
+	}
+	if err := l.KeyCheck(key); err != nil {
+		logger.New().Warnf("peer key rejected: %v", err)
+		l.abort(message.DiscRejected, err)
+		return false
+	}
+	return true
+}
+
+// prove we hold our private key and got the peer key intact
+func (l *Listner) answer(user *connection.Connection, crypter asymmetric.Asymmetric, msg *message.Message) bool {
+	challenge, err := crypter.Decrypt(msg.Body)
+	if err != nil || len(challenge) != keyconfirm.ChallengeSize {
+		logger.New().Errorf("<%s> sent a challenge we can't decrypt, wrong key?", user.Name)
+		l.abort(message.DiscProtocol, keyconfirm.ErrMismatch)
+		return false
+	}
+	proof := keyconfirm.Proof(challenge, l.Secret, crypter.PubKey(), user.Key())
+	return l.queue(message.NewConfirm(proof))
+}
+
+// false if the listner is done
+func (l *Listner) queue(msg message.Message) bool {
+	select {
+	case l.msgCh <- msg:
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+// peer has proven the keys, chat is open
+func (l *Listner) confirm(user *connection.Connection) {
+	if err := l.advance(user, connection.Confirmed); err != nil {
+		return
+	}
+	logger.New().Infof("<%s> entered the chat", user.Name)
+	l.Emit(events.HandshakeComplete{Peer: user.Name})
+}
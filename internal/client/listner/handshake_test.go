@@ -0,0 +1,247 @@
+package listner
+
+import (
+	"bufio"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	myrsa "github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rsa"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/keyconfirm"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/pow"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowed(t *testing.T) {
+	assert.True(t, allowed(connection.Connected, message.HLLO))
+	assert.True(t, allowed(connection.Connected, message.DISC))
+	assert.False(t, allowed(connection.Connected, message.KEY))
+	assert.False(t, allowed(connection.Connected, message.MSG))
+	assert.False(t, allowed(connection.Connected, message.ACK))
+	assert.False(t, allowed(connection.Hello, message.HLLO))
+	assert.True(t, allowed(connection.Hello, message.KEY))
+	assert.False(t, allowed(connection.Hello, message.MSG))
+	assert.False(t, allowed(connection.KeysExchanged, message.MSG), "not before the confirmation")
+	assert.False(t, allowed(connection.KeysExchanged, message.KEY))
+	assert.True(t, allowed(connection.Confirmed, message.MSG))
+	assert.False(t, allowed(connection.Closed, message.ACK))
+	assert.True(t, allowed(connection.Hello, message.CHAL), "kept until we have the key")
+	assert.False(t, allowed(connection.Hello, message.CONF))
+	assert.True(t, allowed(connection.KeysExchanged, message.CONF))
+	assert.False(t, allowed(connection.Confirmed, message.CONF))
+	assert.False(t, allowed(connection.KeysExchanged, message.REKY), "only after the confirmation")
+	assert.True(t, allowed(connection.Confirmed, message.REKY))
+}
+
+// play the peer side of the handshake frame by frame
+type testPeer struct {
+	t      *testing.T
+	l      *testListner
+	reader *bufio.Reader
+}
+
+func (p *testPeer) send(msg message.Message) {
+	data, err := msg.Serialize()
+	require.NoError(p.t, err)
+	_, err = p.l.remote.Write(data)
+	require.NoError(p.t, err)
+}
+
+// next frame of the type, skipping the rest
+func (p *testPeer) expect(typ message.MsgType) *message.Message {
+	for {
+		msg, err := message.Read(p.reader)
+		require.NoError(p.t, err, "waiting for %s", typ)
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+func newTestPeer(t *testing.T) *testPeer {
+	l := newTestListner(t, 0, false)
+	l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testPeer{t, l, bufio.NewReader(l.remote)}
+}
+
+func TestHandshake(t *testing.T) {
+	peerKey, err := myrsa.New()
+	require.NoError(t, err)
+
+	// answer the listner challenge
+	confirm := func(p *testPeer, secret []byte) {
+		key := p.expect(message.KEY)
+		p.send(message.NewHello())
+		p.send(message.NewKey(peerKey.PubKey()))
+		chal := p.expect(message.CHAL)
+		assert.Equal(t, connection.KeysExchanged, p.l.user.State())
+		challenge, err := peerKey.Decrypt(chal.Body)
+		require.NoError(t, err)
+		p.send(message.NewConfirm(keyconfirm.Proof(challenge, secret, peerKey.PubKey(), key.Body)))
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		p := newTestPeer(t)
+		select {
+		case <-p.l.user.Ready():
+			t.Fatal("confirmed before the key confirmation")
+		default:
+		}
+		confirm(p, p.l.Secret)
+		select {
+		case <-p.l.user.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("handshake is not confirmed")
+		}
+		assert.Contains(t, p.l.out.String(), "handshake complete")
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		p := newTestPeer(t)
+		confirm(p, []byte("wrong"))
+		disc := p.expect(message.DISC)
+		reason, _ := message.ParseDisconnect(disc.Body)
+		assert.Equal(t, message.DiscProtocol, reason)
+		assert.ErrorIs(t, p.l.Err(), keyconfirm.ErrMismatch)
+		assert.False(t, p.l.user.Confirmed())
+	})
+
+	t.Run("key pinned after the confirmation", func(t *testing.T) {
+		var pinned [][]byte
+		l := newTestListner(t, 0, false, func(l *Listner) {
+			l.KeyPin = func(key []byte) error {
+				pinned = append(pinned, key)
+				return errors.New("chat is locked")
+			}
+		})
+		l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+		p := &testPeer{t, l, bufio.NewReader(l.remote)}
+		confirm(p, l.Secret)
+		disc := p.expect(message.DISC)
+		reason, _ := message.ParseDisconnect(disc.Body)
+		assert.Equal(t, message.DiscRejected, reason)
+		assert.Equal(t, [][]byte{peerKey.PubKey()}, pinned)
+		assert.False(t, l.user.Confirmed())
+	})
+
+	t.Run("wrong password is not pinned", func(t *testing.T) {
+		pinned := false
+		l := newTestListner(t, 0, false, func(l *Listner) {
+			l.KeyPin = func(key []byte) error {
+				pinned = true
+				return nil
+			}
+		})
+		l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+		p := &testPeer{t, l, bufio.NewReader(l.remote)}
+		confirm(p, []byte("wrong"))
+		p.expect(message.DISC)
+		assert.False(t, pinned)
+	})
+
+	t.Run("challenge we can't decrypt", func(t *testing.T) {
+		p := newTestPeer(t)
+		p.expect(message.KEY)
+		p.send(message.NewHello())
+		p.send(message.NewKey(peerKey.PubKey()))
+		p.send(message.NewChallenge([]byte("not for us")))
+		p.expect(message.DISC)
+		assert.ErrorIs(t, p.l.Err(), keyconfirm.ErrMismatch)
+	})
+
+	t.Run("key before hello", func(t *testing.T) {
+		p := newTestPeer(t)
+		p.send(message.NewKey(peerKey.PubKey()))
+		disc := p.expect(message.DISC)
+		reason, text := message.ParseDisconnect(disc.Body)
+		assert.Equal(t, message.DiscProtocol, reason)
+		assert.Contains(t, text, "out of order")
+		assert.ErrorIs(t, p.l.Err(), connection.ErrOutOfOrder)
+	})
+
+	t.Run("message before the key", func(t *testing.T) {
+		p := newTestPeer(t)
+		p.send(message.NewHello())
+		p.send(message.NewMSG([]byte("too early")))
+		p.expect(message.DISC)
+		assert.ErrorIs(t, p.l.Err(), connection.ErrOutOfOrder)
+		assert.NotContains(t, p.l.out.String(), "too early")
+	})
+
+	t.Run("message before the confirmation", func(t *testing.T) {
+		p := newTestPeer(t)
+		p.expect(message.KEY)
+		p.send(message.NewHello())
+		p.send(message.NewKey(peerKey.PubKey()))
+		p.expect(message.CHAL)
+		// the key is in, but the peer hasn't shown it knows the password
+		p.send(message.NewMSG([]byte("too early")))
+		p.expect(message.DISC)
+		assert.ErrorIs(t, p.l.Err(), connection.ErrOutOfOrder)
+		assert.NotContains(t, p.l.out.String(), "too early")
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		p := newTestPeer(t)
+		p.send(message.NewHello())
+		p.send(message.NewKey([]byte("garbage")))
+		disc := p.expect(message.DISC)
+		reason, _ := message.ParseDisconnect(disc.Body)
+		assert.Equal(t, message.DiscProtocol, reason)
+		assert.False(t, p.l.user.Handshaked())
+	})
+}
+
+func TestPuzzle(t *testing.T) {
+	puzzle := func(t *testing.T, difficulty int) message.Message {
+		challenge, err := pow.NewChallenge(difficulty)
+		require.NoError(t, err)
+		return message.NewPuzzle(challenge.Marshal())
+	}
+
+	t.Run("server with the puzzle off", func(t *testing.T) {
+		p := newTestPeer(t)
+		p.send(message.NewHello())
+		p.send(puzzle(t, pow.MaxDifficulty))
+		disc := p.expect(message.DISC)
+		reason, _ := message.ParseDisconnect(disc.Body)
+		assert.Equal(t, message.DiscProtocol, reason)
+		assert.ErrorIs(t, p.l.Err(), connection.ErrOutOfOrder)
+	})
+
+	t.Run("locked out key before the solution", func(t *testing.T) {
+		peerKey, err := myrsa.New()
+		require.NoError(t, err)
+		challenge, err := pow.NewChallenge(pow.MaxDifficulty)
+		require.NoError(t, err)
+		l := newTestListner(t, 0, false, func(l *Listner) {
+			l.Puzzle = challenge
+			l.KeyCheck = func(key []byte) error { return errors.New("chat is locked") }
+		})
+		l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+		p := &testPeer{t, l, bufio.NewReader(l.remote)}
+		p.send(message.NewHello())
+		p.send(message.NewKey(peerKey.PubKey()))
+		// no solution is ever sent
+		disc := p.expect(message.DISC)
+		reason, _ := message.ParseDisconnect(disc.Body)
+		assert.Equal(t, message.DiscRejected, reason)
+		assert.False(t, l.user.Handshaked(), "key is not taken")
+	})
+
+	t.Run("one per connection", func(t *testing.T) {
+		l := newTestListner(t, 0, false, func(l *Listner) { l.Dialer = true })
+		l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+		p := &testPeer{t, l, bufio.NewReader(l.remote)}
+		p.send(message.NewHello())
+		p.send(puzzle(t, 1))
+		p.expect(message.SOLV)
+		p.send(puzzle(t, 1))
+		p.expect(message.DISC)
+		assert.ErrorIs(t, p.l.Err(), connection.ErrOutOfOrder)
+	})
+}
@@ -0,0 +1,117 @@
+package listner
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+var ErrPeerDead = errors.New("peer is not responding")
+
+// link quality from the heartbeats
+type Health struct {
+	Latency  time.Duration // last ping round trip, 0 if not measured yet
+	Missed   int           // pings without a reply in a row
+	LastSeen time.Time     // last frame from the peer
+}
+
+func (h Health) Status() string {
+	switch {
+	case h.Missed == 0:
+		return "ok"
+	case h.Missed == 1:
+		return "slow"
+	default:
+		return "lost"
+	}
+}
+
+func (h Health) String() string {
+	if h.Latency == 0 {
+		return h.Status()
+	}
+	return fmt.Sprintf("%s %dms", h.Status(), h.Latency.Milliseconds())
+}
+
+// current link quality
+func (l *Listner) Health() Health {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.health
+}
+
+// any frame from the peer proves the link is alive
+func (l *Listner) seen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.health.LastSeen = time.Now()
+	l.health.Missed = 0
+}
+
+func (l *Listner) pong(nonce uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if nonce != l.pingNonce || l.pingSent.IsZero() {
+		return
+	}
+	l.health.Latency = time.Since(l.pingSent)
+	l.pingSent = time.Time{}
+}
+
+// ping the idle connection and drop it after MaxMissed pings without a reply.
+// runs after the handshake
+func (l *Listner) heartbeat(user *connection.Connection) {
+	log := logger.New()
+	select {
+	case <-user.Ready():
+	case <-l.ctx.Done():
+		return
+	}
+	l.seen()
+
+	ticker := time.NewTicker(l.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		idle := time.Since(l.health.LastSeen) >= l.Heartbeat
+		if idle && !l.pingSent.IsZero() {
+			l.health.Missed++
+		}
+		missed := l.health.Missed
+		l.mu.Unlock()
+		if !idle {
+			continue
+		}
+
+		if missed >= l.MaxMissed {
+			log.Warnf("<%s> is not responding, %d pings missed", user.Name, missed)
+			// not a protocol error, tor circuits just die sometimes
+			l.Disconnect(message.DiscTimeout, ErrPeerDead.Error())
+			return
+		}
+		if missed > 0 {
+			log.Warnf("<%s> link is unstable, %d ping(s) missed", user.Name, missed)
+		}
+
+		ping := message.NewPing()
+		l.mu.Lock()
+		l.pingNonce = ping.Nonce
+		l.pingSent = time.Now()
+		l.mu.Unlock()
+		select {
+		case l.msgCh <- ping:
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
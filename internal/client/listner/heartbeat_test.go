@@ -0,0 +1,137 @@
+package listner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	myrsa "github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rsa"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chat output shared between goroutines
+type syncWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// events as the chat prints them
+func (w *syncWriter) emit(e events.Event) {
+	fmt.Fprintln(w, e)
+}
+
+func (w *syncWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+type testListner struct {
+	*Listner
+	user    *connection.Connection
+	remote  net.Conn // the test plays the peer on this end
+	out     *syncWriter
+	crypter asymmetric.Asymmetric
+}
+
+// listner on one end of the pipe, optionally after the handshake.
+// the peer key is ours, so the test can encrypt messages for the listner
+func newTestListner(t *testing.T, heartbeat time.Duration, handshaked bool, opts ...func(*Listner)) *testListner {
+	crypter, err := myrsa.New()
+	require.NoError(t, err)
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	user := connection.New(local)
+	if handshaked {
+		require.NoError(t, user.UpdadeKey(crypter.PubKey()))
+		for _, s := range []connection.State{connection.Hello, connection.KeysExchanged, connection.Confirmed} {
+			require.NoError(t, user.Advance(s))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	l := New(ctx, cancel, make(chan message.Message, 16))
+	out := &syncWriter{}
+	l.Emit = out.emit
+	l.Heartbeat = heartbeat
+	l.MaxMissed = 2
+	l.Secret = []byte("ABCD-1234")
+	for _, opt := range opts {
+		opt(l)
+	}
+	go l.Sender(user, crypter)
+	go l.Receiver(user, crypter)
+	return &testListner{l, user, remote, out, crypter}
+}
+
+func TestHeartbeat(t *testing.T) {
+	t.Run("peer replies", func(t *testing.T) {
+		l := newTestListner(t, 20*time.Millisecond, true)
+		remote := l.remote
+		reader := bufio.NewReader(remote)
+		pings := 0
+		for pings < 3 {
+			msg, err := message.Read(reader)
+			require.NoError(t, err)
+			if msg.Type != message.RUOK {
+				continue
+			}
+			pings++
+			time.Sleep(5 * time.Millisecond)
+			pong := message.NewPong(msg.Nonce)
+			data, err := pong.Serialize()
+			require.NoError(t, err)
+			_, err = remote.Write(data)
+			require.NoError(t, err)
+		}
+
+		require.Eventually(t, func() bool {
+			return l.Health().Latency > 0
+		}, time.Second, 5*time.Millisecond)
+		h := l.Health()
+		assert.Equal(t, 0, h.Missed)
+		assert.Equal(t, "ok", h.Status())
+		assert.GreaterOrEqual(t, h.Latency, 5*time.Millisecond)
+		assert.NoError(t, l.ctx.Err())
+	})
+
+	t.Run("dead peer is dropped", func(t *testing.T) {
+		l := newTestListner(t, 20*time.Millisecond, true)
+		remote := l.remote
+		// read everything and never reply
+		var disc *message.Message
+		reader := bufio.NewReader(remote)
+		for disc == nil {
+			msg, err := message.Read(reader)
+			require.NoError(t, err)
+			if msg.Type == message.DISC {
+				disc = msg
+			}
+		}
+
+		reason, text := message.ParseDisconnect(disc.Body)
+		assert.Equal(t, message.DiscTimeout, reason)
+		assert.Equal(t, ErrPeerDead.Error(), text)
+		assert.Error(t, l.ctx.Err())
+		assert.NoError(t, l.Err(), "dead link is not a protocol error")
+	})
+}
@@ -3,21 +3,69 @@ package listner
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"sync"
 	"time"
 
 	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/events"
 	"github.com/1F47E/go-shaihulud/internal/client/message"
-	cfg "github.com/1F47E/go-shaihulud/internal/config"
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
 	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/keyconfirm"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/padding"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/pow"
 	"github.com/1F47E/go-shaihulud/internal/logger"
 )
 
+// how many message nonces to remember for retransmit dedup
+const dedupSize = 256
+
 type Listner struct {
-	ctx    context.Context
-	cancel context.CancelFunc
-	msgCh  chan message.Message
+	ctx      context.Context
+	cancel   context.CancelFunc
+	msgCh    chan message.Message
+	Emit     func(events.Event)     // chat events for the frontends
+	KeyCheck func(key []byte) error // optional peer key check
+	KeyPin   func(key []byte) error // optional, once the key is confirmed
+	Puzzle   *pow.Challenge         // server only, peer has to solve it before the key exchange
+	Dialer   bool                   // we connected to the peer, only this side solves puzzles
+	OnAck    func(nonce uint32)     // optional delivery callback
+	OnState  func(connection.State) // optional handshake progress callback
+	// ping the idle peer every Heartbeat, 0 is off.
+	// drop it after MaxMissed pings without a reply
+	Heartbeat time.Duration
+	MaxMissed int
+	mu        sync.Mutex
+	err       error // why the receiver stopped
+	left      *Left // set if the peer sent a disconnect
+	health    Health
+	pingNonce uint32
+	pingSent  time.Time // zero if no ping is in flight
+	// session password mixed into the key confirmation
+	Secret    []byte
+	challenge []byte // our key confirmation challenge, receiver only
+	// rotate the session keys, needs a crypter with Rotate
+	Rekey RekeyPolicy
+	rekey rekeyState
+	// constant rate chat: one MSG frame every Cover, a dummy if nothing is queued.
+	// 0 sends messages right away
+	Cover  time.Duration
+	decoys *nonceSet // sent dummy nonces, guarded by mu
+}
+
+// peer disconnect reason
+type Left struct {
+	Reason message.DiscReason
+	Text   string
+}
+
+func (l Left) String() string {
+	if l.Text == "" {
+		return l.Reason.String()
+	}
+	return fmt.Sprintf("%s (%s)", l.Reason, l.Text)
 }
 
 func New(ctx context.Context, cancel context.CancelFunc, msgCh chan message.Message) *Listner {
@@ -25,6 +73,9 @@ func New(ctx context.Context, cancel context.CancelFunc, msgCh chan message.Mess
 		ctx:    ctx,
 		cancel: cancel,
 		msgCh:  msgCh,
+		Emit:   func(events.Event) {},
+		rekey:  rekeyState{requests: make(chan struct{}, 1)},
+		decoys: newNonceSet(dedupSize),
 	}
 }
 
@@ -32,33 +83,99 @@ func New(ctx context.Context, cancel context.CancelFunc, msgCh chan message.Mess
 func (l *Listner) Sender(user *connection.Connection, crypter asymmetric.Asymmetric) {
 	log := logger.New()
 	log.Debug("Listner.Sender: Starting")
+	writer := bufio.NewWriter(user.Conn)
 	defer func() {
 		log.Debug("Sender: exit")
 		l.cancel() // cancel only listners&senders ctx
+		// deliver what's left, like acks and disconnect, then close
+		l.flush(user, writer)
+		user.Conn.Close()
 	}()
 
 	// do handshake
-	// send our pubkic key
+	// say hello, send the puzzle and then our public key
+	key := message.NewKey(crypter.PubKey())
+	// hello is written first, before any ack from the queue
+	hello := message.NewHello()
+	if err := l.write(writer, &hello); err != nil {
+		log.Errorf("Sender: hello write error: %v", err)
+		return
+	}
 	go func() {
-		l.msgCh <- message.NewKey(crypter.PubKey())
-		log.Debug("Sender: sent key")
+		if l.Puzzle != nil {
+			select {
+			case l.msgCh <- message.NewPuzzle(l.Puzzle.Marshal()):
+				log.Debugf("Sender: sent puzzle, difficulty %d", l.Puzzle.Difficulty)
+			case <-l.ctx.Done():
+				return
+			}
+		}
+		select {
+		case l.msgCh <- key:
+			log.Debug("Sender: sent key")
+		case <-l.ctx.Done():
+		}
 	}()
 
+	if l.Heartbeat > 0 {
+		go l.heartbeat(user)
+	}
+	go l.rekeyLoop(user, crypter)
+
+	// with the cover traffic chat waits for the next tick
+	var held []message.Message
+	var ready <-chan struct{}
+	var tick <-chan time.Time
+	if l.Cover > 0 {
+		ready = user.Ready()
+	}
+
 	// TODO: sign every message with a HMAC from password
-	writer := bufio.NewWriter(user.Conn)
 	for {
 		select {
 		case <-l.ctx.Done():
 			return
+		case <-ready:
+			ready = nil
+			ticker := time.NewTicker(l.Cover)
+			defer ticker.Stop()
+			tick = ticker.C
+		case <-tick:
+			var msg message.Message
+			if len(held) > 0 {
+				msg, held = held[0], held[1:]
+			} else {
+				var err error
+				if msg, err = l.dummy(user, crypter); err != nil {
+					log.Errorf("Sender: dummy error: %v", err)
+					continue
+				}
+			}
+			l.countTraffic(len(msg.Body))
+			if err := l.write(writer, &msg); err != nil {
+				log.Errorf("Sender: write error: %v", err)
+				return
+			}
 		case msg := <-l.msgCh:
-			// TODO: check is there was a handshake
+			if msg.Type == message.MSG && !user.Confirmed() {
+				log.Errorf("Sender: dropped a message before the handshake")
+				continue
+			}
+			if msg.Type == message.MSG && l.Cover > 0 {
+				held = append(held, msg)
+				continue
+			}
+			if msg.Type == message.MSG {
+				l.countTraffic(len(msg.Body))
+			}
 			log.Debugf("Sender: Got msg: %v\n", msg)
 			// send bytes to the connection
 			mBytes, _ := msg.Serialize()
 
 			w, err := writer.Write(mBytes)
 			if err != nil {
-				log.Fatalf("Sender: write error: %v\n", err)
+				log.Errorf("Sender: write error: %v", err)
+				return
 			}
 			err = writer.Flush()
 			if err != nil {
@@ -70,59 +187,154 @@ func (l *Listner) Sender(user *connection.Connection, crypter asymmetric.Asymmet
 	}
 }
 
+func (l *Listner) write(writer *bufio.Writer, msg *message.Message) error {
+	mBytes, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(mBytes); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// write queued messages with a short deadline
+func (l *Listner) flush(user *connection.Connection, writer *bufio.Writer) {
+	user.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	for {
+		select {
+		case msg := <-l.msgCh:
+			mBytes, _ := msg.Serialize()
+			if _, err := writer.Write(mBytes); err != nil {
+				return
+			}
+		default:
+			writer.Flush()
+			return
+		}
+	}
+}
+
+// queue a disconnect and stop the listner
+func (l *Listner) Disconnect(reason message.DiscReason, text string) {
+	select {
+	case l.msgCh <- message.NewDisconnect(reason, text):
+	default:
+		// queue is full, just close
+	}
+	l.cancel()
+}
+
+// set if the peer has sent a disconnect
+func (l *Listner) Left() (Left, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.left == nil {
+		return Left{}, false
+	}
+	return *l.left, true
+}
+
+// receiver error after the listner is done, nil on normal close
+func (l *Listner) Err() error {
+	<-l.ctx.Done()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *Listner) fail(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+}
+
 // goroutine per connection
 func (l *Listner) Receiver(user *connection.Connection, crypter asymmetric.Asymmetric) {
 	log := logger.New()
 
 	log.Debug("Listner.Receiver: Starting")
 
-	ticker := time.NewTicker(1 * time.Second)
 	defer func() {
 		log.Debug("Listner: exit")
-		ticker.Stop()
+		l.advance(user, connection.Closed)
 		l.cancel() // cancel only local context for listners
 	}()
 
+	if user.Conn == nil {
+		log.Warn("Listner: No connection")
+		return
+	}
+	reader := bufio.NewReader(user.Conn)
+	solved := l.Puzzle == nil
+	var pendingKey *message.Message  // key received before the puzzle is solved
+	var pendingChal *message.Message // peer challenge before we have its key
+	answered := false                // peer challenge is answered, only one is allowed
+	puzzled := false                 // got the server puzzle, only one is allowed
+	received := newNonceSet(dedupSize)
 	for {
 		select {
 		case <-l.ctx.Done():
 			return
-		case <-ticker.C:
-			// read bytes from the connection
-			if user.Conn == nil {
-				log.Warn("Listner: No connection")
-				return
-			}
-			bytes := make([]byte, cfg.MSG_MAX_SIZE)
-			n, err := user.Conn.Read(bytes)
+		default:
+			// read one message from the connection
+			msg, err := message.Read(reader)
 			if err != nil {
-				if err == io.EOF {
-					log.Warn("Listner: Connection closed")
+				// stream is out of sync after a bad frame
+				if errors.Is(err, message.ErrMalformed) || errors.Is(err, mux.ErrProtocol) {
+					log.Errorf("Listner: Read error: %v", err)
+					l.abort(message.DiscProtocol, err)
 					return
 				}
-				log.Errorf("Listner: Read error: %v", err)
-				continue
-			}
-			log.Debugf("Received: %d bytes:\n", n)
-			log.Debugf("raw: %v\n", bytes)
-			msg, err := message.Deserialize(bytes)
-			if err != nil {
-				log.Errorf("deserialize error: %v\n", err)
+				// reset, broken pipe or a dead circuit is not the peer's fault
+				log.Warnf("Listner: Connection closed: %v", err)
+				return
 			}
 			log.Debugf("Msg type: %s\n", msg.Type)
+			// peer pings don't make the link busy, we still measure our own latency
+			if msg.Type != message.RUOK {
+				l.seen()
+			}
+
+			if !allowed(user.State(), msg.Type) {
+				log.Warnf("got %s in %s state", msg.Type, user.State())
+				l.abort(message.DiscProtocol, fmt.Errorf("%w: %s in %s state", connection.ErrOutOfOrder, msg.Type, user.State()))
+				return
+			}
 
 			// react on incoming message
 
 			switch msg.Type {
 
 			case message.HLLO:
-				log.Info(">>Hello!")
+				log.Debug(">>Hello!")
+				l.advance(user, connection.Hello)
 
 			case message.ACK:
 				log.Debugf(">> Ack! msg %d delivered", msg.Nonce)
-				println("☑︎")
+				if l.isDummy(msg.Nonce) {
+					break
+				}
+				if l.OnAck != nil {
+					l.OnAck(msg.Nonce)
+				}
+
+			case message.RUOK:
+				select {
+				case l.msgCh <- message.NewPong(msg.Nonce):
+				case <-l.ctx.Done():
+					return
+				}
+
+			case message.IMOK:
+				l.pong(msg.Nonce)
 
 			case message.MSG:
+				if received.has(msg.Nonce) {
+					log.Debugf("duplicate msg %d, ack again", msg.Nonce)
+					break
+				}
+				l.countTraffic(len(msg.Body))
 				log.Debugf("\nraw msg %d bytes:\n=====\n%x\n=====\n", len(msg.Body), msg.Body)
 				// decode msg
 				decrypted, err := crypter.Decrypt(msg.Body)
@@ -130,35 +342,176 @@ func (l *Listner) Receiver(user *connection.Connection, crypter asymmetric.Asymm
 					log.Errorf("error decrypting msg: %v\n", err)
 					continue
 				}
-				now := time.Now().Format("15:04:05")
-				fmt.Printf("%s <%s> %s\n", now, user.Name, string(decrypted))
+				kind, text, err := padding.Unpad(decrypted)
+				if err != nil {
+					log.Errorf("error unpadding msg: %v\n", err)
+					continue
+				}
+				// only a frame we could read counts, the retransmit of a broken one is read again
+				received.add(msg.Nonce)
+				if kind == padding.Dummy {
+					// acked like a real one, so the peer traffic looks the same
+					break
+				}
+				l.Emit(events.MessageReceived{Peer: user.Name, Text: string(text), Time: time.Now()})
 
 			case message.KEY:
 				log.Debugf("got public key from user: %d bytes\n%v", len(msg.Body), msg.Body)
-				// save guest key
-				err := user.UpdadeKey(msg.Body)
+				if !solved {
+					// a locked out key is turned away now, before the puzzle.
+					// the rest is checked after it, acked after that
+					// so the peer can't send messages yet
+					if !l.checkKey(msg.Body) {
+						return
+					}
+					pendingKey = msg
+					continue
+				}
+				if !l.handleKey(user, crypter, msg.Body) {
+					return
+				}
+				if pendingChal != nil && !l.answer(user, crypter, pendingChal) {
+					return
+				}
+
+			case message.PUZZ:
+				// solving is costly, the accepting side never does it, even with the puzzle off
+				if !l.Dialer || puzzled {
+					l.abort(message.DiscProtocol, fmt.Errorf("%w: unexpected puzzle", connection.ErrOutOfOrder))
+					return
+				}
+				puzzled = true
+				challenge, err := pow.Unmarshal(msg.Body)
 				if err != nil {
-					log.Error("got wrong pub key from the user")
-					// TODO: disconnect user
-				} else {
-					user.UpdateName()
-					log.Infof("<%s> entered the chat", user.Name)
+					log.Errorf("got invalid puzzle: %v", err)
+					l.abort(message.DiscProtocol, err)
+					return
+				}
+				go l.solve(challenge)
+
+			case message.SOLV:
+				if l.Puzzle == nil || solved {
+					break
+				}
+				if err := l.Puzzle.Verify(msg.Body); err != nil {
+					log.Warnf("puzzle is not solved: %v", err)
+					l.abort(message.DiscProtocol, err)
+					return
+				}
+				log.Debug("puzzle solved")
+				solved = true
+				if pendingKey != nil {
+					if !l.handleKey(user, crypter, pendingKey.Body) || !l.ack(pendingKey) {
+						return
+					}
+					if pendingChal != nil && !l.answer(user, crypter, pendingChal) {
+						return
+					}
+				}
+
+			case message.CHAL:
+				if answered || pendingChal != nil {
+					l.abort(message.DiscProtocol, fmt.Errorf("%w: second challenge", connection.ErrOutOfOrder))
+					return
+				}
+				answered = true
+				if user.State() == connection.Hello {
+					// answered after the key
+					pendingChal = msg
+					break
+				}
+				if !l.answer(user, crypter, msg) {
+					return
+				}
+
+			case message.CONF:
+				if err := keyconfirm.Verify(msg.Body, l.challenge, l.Secret, crypter.PubKey(), user.Key()); err != nil {
+					log.Errorf("<%s> %v", user.Name, err)
+					l.abort(message.DiscProtocol, err)
+					return
+				}
+				if l.KeyPin != nil {
+					if err := l.KeyPin(user.Key()); err != nil {
+						log.Warnf("<%s> key rejected: %v", user.Name, err)
+						reason := message.DiscRejected
+						if errors.Is(err, ErrFull) {
+							reason = message.DiscFull
+						}
+						l.abort(reason, err)
+						return
+					}
+				}
+				l.confirm(user)
+
+			case message.REKY:
+				if err := l.handleRekey(user, crypter, msg); err != nil {
+					log.Errorf("<%s> rekey error: %v", user.Name, err)
+					l.abort(message.DiscProtocol, err)
+					return
 				}
+
 			case message.DISC:
-				log.Warnf("<%s> disconnected", user.Name)
+				reason, text := message.ParseDisconnect(msg.Body)
+				left := Left{reason, text}
+				l.mu.Lock()
+				l.left = &left
+				l.mu.Unlock()
+				log.Debugf("<%s> left the chat: %s", user.Name, left)
+				// ack and stop, the sender flushes the ack
+				l.ack(msg)
+				return
 
 			default:
 				log.Warnf("unknown message type: %s\n", msg.Type)
 				if msg.Len > 0 {
-					fmt.Printf("len: %d\n", msg.Len)
-					fmt.Printf("data: %s\n", string(msg.Body))
+					log.Debugf("len: %d, data: %s", msg.Len, string(msg.Body))
 				}
 			}
 
 			// send delivery confirmation (ACK)
-			if msg.Type != message.ACK && msg.Nonce > 0 {
-				l.msgCh <- message.NewAck(msg.Nonce)
+			if !l.ack(msg) {
+				return
 			}
 		}
 	}
 }
+
+// send delivery confirmation, false if the listner is done
+func (l *Listner) ack(msg *message.Message) bool {
+	// heartbeats are answered with a pong
+	switch msg.Type {
+	case message.ACK, message.RUOK, message.IMOK:
+		return true
+	}
+	if msg.Nonce == 0 {
+		return true
+	}
+	select {
+	case l.msgCh <- message.NewAck(msg.Nonce):
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+// tell the peer why we drop it
+func (l *Listner) abort(reason message.DiscReason, err error) {
+	l.fail(err)
+	l.Disconnect(reason, err.Error())
+}
+
+// solve the server puzzle in background, it can take a while
+func (l *Listner) solve(challenge *pow.Challenge) {
+	log := logger.New()
+	log.Infof("Solving connection puzzle, difficulty %d...", challenge.Difficulty)
+	start := time.Now()
+	nonce, err := challenge.Solve(l.ctx)
+	if err != nil {
+		return
+	}
+	log.Debugf("puzzle solved in %s", time.Since(start))
+	select {
+	case l.msgCh <- message.NewSolution(nonce):
+	case <-l.ctx.Done():
+	}
+}
@@ -0,0 +1,201 @@
+package listner
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/keyconfirm"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+var ErrRekeyUnsupported = errors.New("crypter can't rotate keys")
+
+// how long our rekey waits for the reply without the heartbeat
+const rekeyTimeout = time.Minute
+
+// when to rotate the session keys, zero values are off
+type RekeyPolicy struct {
+	Messages int // sent and received
+	Bytes    int
+	Interval time.Duration
+}
+
+// crypter that can switch to a new keypair mid session
+type rotator interface {
+	asymmetric.Asymmetric
+	Rotate() error
+}
+
+type rekeyState struct {
+	mu       sync.Mutex // one rotation at a time, ours or the reply
+	requests chan struct{}
+	msgs     atomic.Int64
+	bytes    atomic.Int64
+	since    time.Time // guarded by Listner.mu
+	pending  time.Time // our rekey waits for the peer since, zero if not. guarded by Listner.mu
+	count    int       // done rekeys, guarded by Listner.mu
+}
+
+// rotate the keys now
+func (l *Listner) RequestRekey() {
+	select {
+	case l.rekey.requests <- struct{}{}:
+	default:
+	}
+}
+
+// number of completed rekeys
+func (l *Listner) Rekeys() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rekey.count
+}
+
+// chat traffic for the rekey policy
+func (l *Listner) countTraffic(n int) {
+	l.rekey.msgs.Add(1)
+	l.rekey.bytes.Add(int64(n))
+}
+
+// a live peer answers the rekey before the heartbeat gives up on it,
+// after that the rekey is lost and the next one can go
+func (l *Listner) rekeyWait() time.Duration {
+	if l.Heartbeat > 0 && l.MaxMissed > 0 {
+		return l.Heartbeat * time.Duration(l.MaxMissed+1)
+	}
+	return rekeyTimeout
+}
+
+func (l *Listner) rekeyDue() bool {
+	p := l.Rekey
+	if p.Messages > 0 && l.rekey.msgs.Load() >= int64(p.Messages) {
+		return true
+	}
+	if p.Bytes > 0 && l.rekey.bytes.Load() >= int64(p.Bytes) {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return p.Interval > 0 && time.Since(l.rekey.since) >= p.Interval
+}
+
+func (l *Listner) rekeyDone() {
+	l.rekey.msgs.Store(0)
+	l.rekey.bytes.Store(0)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rekey.since = time.Now()
+}
+
+// check the policy and serve rekey requests after the handshake
+func (l *Listner) rekeyLoop(user *connection.Connection, crypter asymmetric.Asymmetric) {
+	rot, ok := crypter.(rotator)
+	if !ok {
+		return
+	}
+	select {
+	case <-user.Ready():
+	case <-l.ctx.Done():
+		return
+	}
+	l.rekeyDone()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-l.rekey.requests:
+		case <-ticker.C:
+			if !l.rekeyDue() {
+				continue
+			}
+		}
+		if err := l.startRekey(user, rot); err != nil {
+			logger.New().Errorf("rekey error: %v", err)
+		}
+	}
+}
+
+// rotate our keypair and send the new public key
+func (l *Listner) startRekey(user *connection.Connection, rot rotator) error {
+	l.rekey.mu.Lock()
+	defer l.rekey.mu.Unlock()
+	l.mu.Lock()
+	if !l.rekey.pending.IsZero() && time.Since(l.rekey.pending) < l.rekeyWait() {
+		l.mu.Unlock()
+		return nil
+	}
+	l.rekey.pending = time.Now()
+	l.mu.Unlock()
+
+	oldKey := rot.PubKey()
+	if err := rot.Rotate(); err != nil {
+		l.mu.Lock()
+		l.rekey.pending = time.Time{}
+		l.mu.Unlock()
+		return err
+	}
+	newKey := rot.PubKey()
+	logger.New().Debugf("rekey: sent new key to <%s>", user.Name)
+	l.queue(message.NewRekey(false, newKey, keyconfirm.RekeyMAC(l.Secret, oldKey, newKey)))
+	return nil
+}
+
+// peer has a new key. reply with ours unless we have started the rekey too,
+// then both sides have switched already
+func (l *Listner) handleRekey(user *connection.Connection, crypter asymmetric.Asymmetric, msg *message.Message) error {
+	l.rekey.mu.Lock()
+	defer l.rekey.mu.Unlock()
+	reply, newKey, mac, err := message.ParseRekey(msg.Body)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	pending := !l.rekey.pending.IsZero()
+	l.mu.Unlock()
+	if reply && !pending {
+		return fmt.Errorf("%w: rekey reply we didn't ask for", connection.ErrOutOfOrder)
+	}
+	if err := keyconfirm.VerifyRekey(mac, l.Secret, user.Key(), newKey); err != nil {
+		return err
+	}
+	if err := crypter.ValidateKey(newKey); err != nil {
+		return err
+	}
+	if err := user.UpdadeKey(newKey); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.rekey.pending = time.Time{}
+	l.mu.Unlock()
+	if !reply && !pending {
+		rot, ok := crypter.(rotator)
+		if !ok {
+			return ErrRekeyUnsupported
+		}
+		oldKey := rot.PubKey()
+		if err := rot.Rotate(); err != nil {
+			return err
+		}
+		ourKey := rot.PubKey()
+		l.queue(message.NewRekey(true, ourKey, keyconfirm.RekeyMAC(l.Secret, oldKey, ourKey)))
+	}
+
+	// done either way: we replied, got the reply, or both sides started at once
+	l.mu.Lock()
+	l.rekey.count++
+	l.mu.Unlock()
+	l.rekeyDone()
+	l.Emit(events.KeysRotated{Peer: user.Name})
+	return nil
+}
@@ -0,0 +1,74 @@
+package listner
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rotating"
+	myrsa "github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rsa"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/keyconfirm"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRekeyForged(t *testing.T) {
+	l := newTestListner(t, 0, true)
+	l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+	p := &testPeer{t, l, bufio.NewReader(l.remote)}
+	evil, err := myrsa.New()
+	require.NoError(t, err)
+	oldKey := l.user.Key()
+
+	// mac without the session password
+	p.send(message.NewRekey(false, evil.PubKey(), keyconfirm.RekeyMAC([]byte("wrong"), oldKey, evil.PubKey())))
+	disc := p.expect(message.DISC)
+	reason, _ := message.ParseDisconnect(disc.Body)
+	assert.Equal(t, message.DiscProtocol, reason)
+	assert.ErrorIs(t, l.Err(), keyconfirm.ErrMismatch)
+	assert.Equal(t, oldKey, l.user.Key(), "peer key is kept")
+	assert.Equal(t, 0, l.Rekeys())
+}
+
+func TestRekeyReplyUnasked(t *testing.T) {
+	l := newTestListner(t, 0, true)
+	l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+	p := &testPeer{t, l, bufio.NewReader(l.remote)}
+	next, err := myrsa.New()
+	require.NoError(t, err)
+	oldKey := l.user.Key()
+
+	p.send(message.NewRekey(true, next.PubKey(), keyconfirm.RekeyMAC(l.Secret, oldKey, next.PubKey())))
+	disc := p.expect(message.DISC)
+	reason, _ := message.ParseDisconnect(disc.Body)
+	assert.Equal(t, message.DiscProtocol, reason)
+	assert.ErrorIs(t, l.Err(), connection.ErrOutOfOrder)
+	assert.Equal(t, oldKey, l.user.Key(), "peer key is kept")
+}
+
+func TestRekeyLost(t *testing.T) {
+	l := newTestListner(t, 0, true)
+	l.remote.SetDeadline(time.Now().Add(10 * time.Second))
+	p := &testPeer{t, l, bufio.NewReader(l.remote)}
+	rot := rotating.New(l.crypter, func() (asymmetric.Asymmetric, error) { return myrsa.New() })
+
+	require.NoError(t, l.startRekey(l.user, rot))
+	first := p.expect(message.REKY)
+	key := rot.PubKey()
+
+	// the peer never answers, one rekey at a time until the deadline
+	require.NoError(t, l.startRekey(l.user, rot))
+	assert.Equal(t, key, rot.PubKey())
+
+	l.mu.Lock()
+	l.rekey.pending = time.Now().Add(-l.rekeyWait())
+	l.mu.Unlock()
+	require.NoError(t, l.startRekey(l.user, rot))
+	second := p.expect(message.REKY)
+	assert.NotEqual(t, key, rot.PubKey())
+	assert.NotEqual(t, first.Body, second.Body)
+}
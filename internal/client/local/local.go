@@ -4,21 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net"
-
-	"github.com/1F47E/go-shaihulud/internal/client/message"
 )
 
 type ClientLocal struct {
 	ctx    context.Context
 	cancel context.CancelFunc
-	msgCh  chan message.Message
 }
 
-func New(ctx context.Context, cancel context.CancelFunc, msgCh chan message.Message) *ClientLocal {
+func New(ctx context.Context, cancel context.CancelFunc) *ClientLocal {
 	return &ClientLocal{
 		ctx:    ctx,
 		cancel: cancel,
-		msgCh:  msgCh,
 	}
 }
 
@@ -37,3 +33,7 @@ func (c *ClientLocal) RunClient(address string) (net.Conn, error) {
 	}
 	return conn, err
 }
+
+func (c *ClientLocal) Close() error {
+	return nil
+}
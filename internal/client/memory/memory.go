@@ -0,0 +1,105 @@
+package client_memory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// in-process network for tests, connections are net.Pipe
+// so clients can chat inside one process without ports
+var (
+	mu        sync.Mutex
+	listeners = make(map[string]*listener)
+)
+
+type MemoryClient struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	ln     *listener
+}
+
+func New(ctx context.Context, cancel context.CancelFunc) *MemoryClient {
+	return &MemoryClient{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (c *MemoryClient) RunServer(address string, _ []byte) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := listeners[address]; ok {
+		return nil, fmt.Errorf("address already in use: %s", address)
+	}
+	ln := &listener{
+		addr:  address,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	listeners[address] = ln
+	c.ln = ln
+	return ln, nil
+}
+
+func (c *MemoryClient) RunClient(address string) (net.Conn, error) {
+	mu.Lock()
+	ln, ok := listeners[address]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("connection refused: %s", address)
+	}
+
+	server, client := net.Pipe()
+	select {
+	case ln.conns <- server:
+		return client, nil
+	case <-ln.done:
+		return nil, fmt.Errorf("connection refused: %s", address)
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	}
+}
+
+func (c *MemoryClient) Close() error {
+	if c.ln == nil {
+		return nil
+	}
+	return c.ln.Close()
+}
+
+type listener struct {
+	addr  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		mu.Lock()
+		delete(listeners, l.addr)
+		mu.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr(l.addr)
+}
+
+type addr string
+
+func (a addr) Network() string { return "memory" }
+func (a addr) String() string  { return string(a) }
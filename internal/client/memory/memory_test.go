@@ -0,0 +1,71 @@
+package client_memory
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := New(ctx, cancel)
+	cli := New(ctx, cancel)
+
+	t.Run("connect", func(t *testing.T) {
+		ln, err := srv.RunServer("test-connect", nil)
+		require.NoError(t, err)
+		defer srv.Close()
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+
+		conn, err := cli.RunClient("test-connect")
+		require.NoError(t, err)
+		defer conn.Close()
+		go conn.Write([]byte("ping"))
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(reply))
+	})
+
+	t.Run("address in use", func(t *testing.T) {
+		_, err := srv.RunServer("test-in-use", nil)
+		require.NoError(t, err)
+		defer srv.Close()
+		_, err = New(ctx, cancel).RunServer("test-in-use", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		_, err := cli.RunClient("test-nobody")
+		assert.Error(t, err)
+	})
+
+	t.Run("close unblocks accept", func(t *testing.T) {
+		ln, err := srv.RunServer("test-close", nil)
+		require.NoError(t, err)
+		done := make(chan error)
+		go func() {
+			_, err := ln.Accept()
+			done <- err
+		}()
+		srv.Close()
+		assert.ErrorIs(t, <-done, net.ErrClosed)
+
+		// address is free again
+		_, err = cli.RunClient("test-close")
+		assert.Error(t, err)
+	})
+}
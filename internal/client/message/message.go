@@ -21,13 +21,20 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	mrand "math/rand"
 
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
 	"github.com/1F47E/go-shaihulud/internal/logger"
 )
 
 var log = logger.New()
 
+// type + nonce + len
+const HeaderSize = 12
+
 type MsgType uint32
 
 const (
@@ -38,6 +45,11 @@ const (
 	RUOK         // ping
 	IMOK         // pong
 	DISC         // disconnect
+	PUZZ         // proof of work challenge
+	SOLV         // proof of work solution
+	CHAL         // key confirmation challenge, encrypted with the peer key
+	CONF         // key confirmation proof
+	REKY         // new public key during the session
 )
 
 type Message struct {
@@ -74,15 +86,75 @@ func NewHello() Message {
 	}
 }
 
-func NewDisconnect() Message {
+// heartbeat, the peer replies with IMOK and the same nonce
+func NewPing() Message {
 	return Message{
-		Type:  DISC,
-		Nonce: 0,
+		Type:  RUOK,
+		Nonce: nonce(),
 		Len:   0,
 		Body:  nil,
 	}
 }
 
+func NewPong(nonce uint32) Message {
+	return Message{
+		Type:  IMOK,
+		Nonce: nonce,
+		Len:   0,
+		Body:  nil,
+	}
+}
+
+// why the peer left
+type DiscReason uint8
+
+const (
+	DiscQuit DiscReason = iota
+	DiscTimeout
+	DiscProtocol // protocol error
+	DiscKicked
+	DiscRejected // locked or banned, don't come back
+	DiscFull     // no room for now, try again later
+)
+
+func (r DiscReason) String() string {
+	switch r {
+	case DiscQuit:
+		return "quit"
+	case DiscTimeout:
+		return "timeout"
+	case DiscProtocol:
+		return "protocol error"
+	case DiscKicked:
+		return "kicked"
+	case DiscRejected:
+		return "rejected"
+	case DiscFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+// body is 1 byte reason + optional text.
+// has a nonce so the peer can ack it
+func NewDisconnect(reason DiscReason, text string) Message {
+	body := append([]byte{byte(reason)}, text...)
+	return Message{
+		Type:  DISC,
+		Nonce: nonce(),
+		Len:   uint32(len(body)),
+		Body:  body,
+	}
+}
+
+func ParseDisconnect(body []byte) (DiscReason, string) {
+	if len(body) == 0 {
+		return DiscQuit, ""
+	}
+	return DiscReason(body[0]), string(body[1:])
+}
+
 func NewKey(key []byte) Message {
 	return Message{
 		Type:  KEY,
@@ -92,6 +164,69 @@ func NewKey(key []byte) Message {
 	}
 }
 
+func NewPuzzle(challenge []byte) Message {
+	return Message{
+		Type:  PUZZ,
+		Nonce: nonce(),
+		Len:   uint32(len(challenge)),
+		Body:  challenge,
+	}
+}
+
+func NewSolution(solution []byte) Message {
+	return Message{
+		Type:  SOLV,
+		Nonce: nonce(),
+		Len:   uint32(len(solution)),
+		Body:  solution,
+	}
+}
+
+func NewChallenge(cipher []byte) Message {
+	return Message{
+		Type:  CHAL,
+		Nonce: nonce(),
+		Len:   uint32(len(cipher)),
+		Body:  cipher,
+	}
+}
+
+func NewConfirm(proof []byte) Message {
+	return Message{
+		Type:  CONF,
+		Nonce: nonce(),
+		Len:   uint32(len(proof)),
+		Body:  proof,
+	}
+}
+
+// rekey body: 1 byte reply flag | 2 bytes key len | new key | mac
+func NewRekey(reply bool, key, mac []byte) Message {
+	body := make([]byte, 3, 3+len(key)+len(mac))
+	if reply {
+		body[0] = 1
+	}
+	binary.BigEndian.PutUint16(body[1:], uint16(len(key)))
+	body = append(append(body, key...), mac...)
+	return Message{
+		Type:  REKY,
+		Nonce: nonce(),
+		Len:   uint32(len(body)),
+		Body:  body,
+	}
+}
+
+func ParseRekey(body []byte) (reply bool, key, mac []byte, err error) {
+	if len(body) < 3 {
+		return false, nil, nil, fmt.Errorf("rekey is too short")
+	}
+	keyLen := int(binary.BigEndian.Uint16(body[1:]))
+	if len(body) < 3+keyLen {
+		return false, nil, nil, fmt.Errorf("rekey key is truncated")
+	}
+	return body[0] == 1, body[3 : 3+keyLen], body[3+keyLen:], nil
+}
+
 // math/rand is not cryptographically secure but good enough for nonce
 func nonce() uint32 {
 	b := make([]byte, 4)
@@ -118,6 +253,16 @@ func (t MsgType) String() string {
 		return "RUOK"
 	case IMOK:
 		return "IMOK"
+	case PUZZ:
+		return "PUZZLE"
+	case SOLV:
+		return "SOLUTION"
+	case CHAL:
+		return "CHALLENGE"
+	case CONF:
+		return "CONFIRM"
+	case REKY:
+		return "REKEY"
 	default:
 		return "Unknown"
 	}
@@ -198,3 +343,29 @@ func Deserialize(data []byte) (*Message, error) {
 
 	return &Message{MsgType(msgType), msgNonce, msgLen, body}, nil
 }
+
+// frame the peer has sent is broken, not the connection
+var ErrMalformed = errors.New("malformed message")
+
+// read exactly one message from the stream.
+// a single conn.Read can return a part of a message or several messages at once
+func Read(r io.Reader) (*Message, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	msgLen := binary.BigEndian.Uint32(header[8:])
+	if msgLen > uint32(cfg.MSG_MAX_SIZE) {
+		return nil, fmt.Errorf("%w: %d bytes is too big", ErrMalformed, msgLen)
+	}
+	data := make([]byte, HeaderSize+int(msgLen))
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[HeaderSize:]); err != nil {
+		return nil, err
+	}
+	msg, err := Deserialize(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,404 @@
+// Mux runs independent streams over one connection.
+//
+// Every stream has its own flow control window, so a slow reader of one
+// stream doesn't block the others, and a priority: session frames go
+// first, then chat, then bulk transfers. Big writes are cut into frames,
+// so a file transfer can't hold the connection for long.
+//
+// Stream 0 exists on both ends from the start, the chat runs on it.
+// Other streams are opened by either side, client ids are odd, server ids even,
+// once the other side has called Listen.
+//
+// Frame: 1 byte type | 4 bytes stream id | 4 bytes body len | body
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	headerSize = 9
+	// max body of a data frame
+	MaxFrame = 16 << 10
+	// bytes the peer can send before we have read them
+	Window = 256 << 10
+	// opened by the peer and not accepted yet
+	acceptBacklog = 16
+	// streams we remember sending a reset for
+	maxResets = 256
+)
+
+type frameType uint8
+
+const (
+	typeData   frameType = iota
+	typeOpen             // new stream, body is the priority
+	typeWindow           // body is the window increment
+	typeClose            // sender has no more data for the stream
+	typeReady            // sender accepts streams from now on
+	typeReset            // stream is closed, sender drops the data
+)
+
+type Priority uint8
+
+const (
+	Control Priority = iota // session frames
+	Chat
+	Bulk
+	priorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Control:
+		return "control"
+	case Chat:
+		return "chat"
+	case Bulk:
+		return "bulk"
+	default:
+		return fmt.Sprintf("priority(%d)", p)
+	}
+}
+
+var (
+	ErrProtocol = errors.New("mux protocol error")
+	ErrBacklog  = errors.New("too many streams waiting to be accepted")
+	ErrReset    = errors.New("stream closed by the peer")
+)
+
+type frame struct {
+	typ  frameType
+	id   uint32
+	body []byte
+	done chan error // written or the session is gone, nil if nobody waits
+}
+
+type Session struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	queues  [priorities][]*frame // guarded by mu
+	wake    chan struct{}        // new frame in the queues
+	accept  chan *Stream
+	done    chan struct{}
+	err     error // why the session is closed, guarded by mu
+	once    sync.Once
+
+	listening bool          // peer can open streams, guarded by mu
+	ready     chan struct{} // closed when the peer listens
+
+	// read loop only
+	peerMax  uint32          // highest stream id the peer has opened
+	resets   map[uint32]bool // late data after the reset is dropped
+	resetIDs []uint32        // oldest first, to forget them
+}
+
+// wrap the connection, client and server have to pick different roles
+func New(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		wake:    make(chan struct{}, 1),
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+		ready:   make(chan struct{}),
+		resets:  make(map[uint32]bool),
+	}
+	if client {
+		s.nextID = 1
+	}
+	s.streams[0] = newStream(s, 0, Chat)
+	go s.readLoop()
+	go s.writeLoop()
+	return s
+}
+
+// stream 0, opened with the session
+func (s *Session) Main() *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[0]
+}
+
+// open a stream, the peer gets it from Accept.
+// waits until the peer listens
+func (s *Session) Open(priority Priority) (*Stream, error) {
+	if priority >= priorities {
+		return nil, fmt.Errorf("unknown priority %d", priority)
+	}
+	select {
+	case <-s.ready:
+	case <-s.done:
+		return nil, s.Err()
+	}
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id, priority)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.send(Control, &frame{typ: typeOpen, id: id, body: []byte{byte(priority)}}); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// let the peer open streams, call it once the peer is trusted.
+// opens before that are a protocol error, nothing is buffered for them
+func (s *Session) Listen() error {
+	s.mu.Lock()
+	if s.listening {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listening = true
+	s.mu.Unlock()
+	return s.enqueue(Control, &frame{typ: typeReady})
+}
+
+// next stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// close the connection and all streams
+func (s *Session) Close() error {
+	s.fail(net.ErrClosed)
+	return nil
+}
+
+// closed when the session is gone
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) fail(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := make([]*Stream, 0, len(s.streams))
+		for _, st := range s.streams {
+			streams = append(streams, st)
+		}
+		s.mu.Unlock()
+		close(s.done)
+		s.conn.Close()
+		for _, st := range streams {
+			st.notify()
+		}
+	})
+}
+
+// queue the frame and wait until it is written
+func (s *Session) send(priority Priority, f *frame) error {
+	f.done = make(chan error, 1)
+	if err := s.enqueue(priority, f); err != nil {
+		return err
+	}
+	select {
+	case err := <-f.done:
+		return err
+	case <-s.done:
+		return s.Err()
+	}
+}
+
+// queue the frame, don't wait
+func (s *Session) enqueue(priority Priority, f *frame) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	s.queues[priority] = append(s.queues[priority], f)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next frame, higher priority first
+func (s *Session) next() *frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.queues {
+		if q := s.queues[p]; len(q) > 0 {
+			f := q[0]
+			q[0] = nil
+			s.queues[p] = q[1:]
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *Session) writeLoop() {
+	header := make([]byte, headerSize)
+	for {
+		f := s.next()
+		if f == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		header[0] = byte(f.typ)
+		binary.BigEndian.PutUint32(header[1:], f.id)
+		binary.BigEndian.PutUint32(header[5:], uint32(len(f.body)))
+		_, err := s.conn.Write(append(header, f.body...))
+		if f.done != nil {
+			f.done <- err
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *Session) readLoop() {
+	reader := bufio.NewReader(s.conn)
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			s.fail(err)
+			return
+		}
+		typ := frameType(header[0])
+		id := binary.BigEndian.Uint32(header[1:])
+		size := binary.BigEndian.Uint32(header[5:])
+		if size > MaxFrame {
+			s.fail(fmt.Errorf("%w: frame of %d bytes", ErrProtocol, size))
+			return
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			s.fail(io.EOF)
+			return
+		}
+		if err := s.handle(typ, id, body); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handle(typ frameType, id uint32, body []byte) error {
+	s.mu.Lock()
+	st := s.streams[id]
+	listening := s.listening
+	s.mu.Unlock()
+
+	switch typ {
+	case typeOpen:
+		if !listening {
+			return fmt.Errorf("%w: stream %d opened before listen", ErrProtocol, id)
+		}
+		if st != nil || len(body) != 1 || Priority(body[0]) >= priorities || id%2 == s.nextID%2 {
+			return fmt.Errorf("%w: bad open of stream %d", ErrProtocol, id)
+		}
+		if id > s.peerMax {
+			s.peerMax = id
+		}
+		st = newStream(s, id, Priority(body[0]))
+		select {
+		case s.accept <- st:
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+		default:
+			// nobody accepts, refuse the stream
+			return s.enqueue(Control, &frame{typ: typeClose, id: id})
+		}
+	case typeData:
+		if st == nil {
+			return s.reset(id)
+		}
+		return st.push(body)
+	case typeWindow:
+		if len(body) != 4 {
+			return fmt.Errorf("%w: bad window update", ErrProtocol)
+		}
+		if st != nil {
+			st.grow(binary.BigEndian.Uint32(body))
+		}
+	case typeClose:
+		if st != nil {
+			st.remoteClose()
+		}
+	case typeReady:
+		select {
+		case <-s.ready:
+			return fmt.Errorf("%w: second ready", ErrProtocol)
+		default:
+			close(s.ready)
+		}
+	case typeReset:
+		if st != nil {
+			st.remoteReset()
+		}
+	default:
+		return fmt.Errorf("%w: unknown frame type %d", ErrProtocol, typ)
+	}
+	return nil
+}
+
+// stream is closed on our side, late data is dropped and the writer stopped.
+// one reset per stream, the peer can't make us queue one for every frame
+func (s *Session) reset(id uint32) error {
+	s.mu.Lock()
+	ours := id%2 == s.nextID%2
+	opened := ours && id < s.nextID || !ours && id <= s.peerMax
+	s.mu.Unlock()
+	if !opened {
+		return fmt.Errorf("%w: data for unknown stream %d", ErrProtocol, id)
+	}
+	if s.resets[id] {
+		return nil
+	}
+	if len(s.resetIDs) == maxResets {
+		delete(s.resets, s.resetIDs[0])
+		s.resetIDs = s.resetIDs[1:]
+	}
+	s.resets[id] = true
+	s.resetIDs = append(s.resetIDs, id)
+	return s.enqueue(Control, &frame{typ: typeReset, id: id})
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
@@ -0,0 +1,274 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPair(t *testing.T) (*Session, *Session) {
+	client, server := newSessions(t)
+	require.NoError(t, client.Listen())
+	require.NoError(t, server.Listen())
+	return client, server
+}
+
+func newSessions(t *testing.T) (*Session, *Session) {
+	a, b := net.Pipe()
+	client, server := New(a, true), New(b, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMainStream(t *testing.T) {
+	client, server := newPair(t)
+
+	go client.Main().Write([]byte("hello"))
+	buf := make([]byte, 16)
+	n, err := server.Main().Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestOpenAccept(t *testing.T) {
+	client, server := newPair(t)
+
+	st, err := client.Open(Bulk)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), st.ID())
+	second, err := server.Open(Chat)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), second.ID())
+
+	remote, err := server.Accept()
+	require.NoError(t, err)
+	assert.Equal(t, st.ID(), remote.ID())
+	assert.Equal(t, Bulk, remote.Priority())
+
+	// big write goes in frames and through the window updates
+	data := make([]byte, 3*Window)
+	rand.Read(data)
+	go func() {
+		st.Write(data)
+		st.Close()
+	}()
+	got, err := io.ReadAll(remote)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+}
+
+func TestCloseWrite(t *testing.T) {
+	client, server := newPair(t)
+	st, err := client.Open(Bulk)
+	require.NoError(t, err)
+	remote, err := server.Accept()
+	require.NoError(t, err)
+
+	_, err = st.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, st.CloseWrite())
+	_, err = st.Write([]byte("more"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	got, err := io.ReadAll(remote)
+	require.NoError(t, err)
+	assert.Equal(t, "request", string(got))
+
+	// the other way still works
+	_, err = remote.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, remote.Close())
+	got, err = io.ReadAll(st)
+	require.NoError(t, err)
+	assert.Equal(t, "response", string(got))
+	require.NoError(t, st.Close())
+}
+
+func TestListen(t *testing.T) {
+	t.Run("open waits for the peer", func(t *testing.T) {
+		client, server := newSessions(t)
+		opened := make(chan *Stream, 1)
+		go func() {
+			st, err := client.Open(Bulk)
+			if err == nil {
+				opened <- st
+			}
+		}()
+		select {
+		case <-opened:
+			t.Fatal("opened before the peer listens")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		require.NoError(t, server.Listen())
+		st := <-opened
+		remote, err := server.Accept()
+		require.NoError(t, err)
+		assert.Equal(t, st.ID(), remote.ID())
+	})
+
+	t.Run("open before listen", func(t *testing.T) {
+		a, b := net.Pipe()
+		s := New(a, false)
+		defer s.Close()
+		go io.Copy(io.Discard, b)
+		go b.Write([]byte{byte(typeOpen), 0, 0, 0, 1, 0, 0, 0, 1, byte(Bulk)})
+		<-s.Done()
+		assert.ErrorIs(t, s.Err(), ErrProtocol)
+	})
+}
+
+// peer closed the stream and doesn't read, the writer fails instead of waiting for the window
+func TestWriteAfterPeerClose(t *testing.T) {
+	client, server := newPair(t)
+	st, err := client.Open(Bulk)
+	require.NoError(t, err)
+	_, err = st.Write([]byte{1})
+	require.NoError(t, err)
+	remote, err := server.Accept()
+	require.NoError(t, err)
+	require.NoError(t, remote.Close())
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(make([]byte, 2*Window))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		assert.ErrorIs(t, err, ErrReset)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write is stuck")
+	}
+	// what the peer wrote before the close is still there
+	_, err = io.ReadAll(st)
+	require.NoError(t, err)
+}
+
+func TestBulkDoesNotBlockChat(t *testing.T) {
+	client, server := newPair(t)
+
+	bulk, err := client.Open(Bulk)
+	require.NoError(t, err)
+	// nobody reads the bulk stream, the writer is stuck on the window
+	written := make(chan int, 1)
+	go func() {
+		n, _ := bulk.Write(make([]byte, 2*Window))
+		written <- n
+	}()
+
+	go client.Main().Write([]byte("still here"))
+	server.Main().SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := server.Main().Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "still here", string(buf[:n]))
+
+	select {
+	case <-written:
+		t.Fatal("write is not limited by the window")
+	default:
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	_, server := newPair(t)
+	st := server.Main()
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := st.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := newPair(t)
+	st, err := client.Open(Chat)
+	require.NoError(t, err)
+	remote, err := server.Accept()
+	require.NoError(t, err)
+
+	client.Close()
+	_, err = remote.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "peer is gone")
+	_, err = st.Write([]byte("late"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = client.Open(Chat)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	<-server.Done()
+}
+
+func TestProtocolError(t *testing.T) {
+	a, b := net.Pipe()
+	s := New(a, false)
+	defer s.Close()
+	// data frame bigger than a frame can be
+	go b.Write([]byte{byte(typeData), 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff})
+	<-s.Done()
+	assert.ErrorIs(t, s.Err(), ErrProtocol)
+}
+
+// late data for a closed stream gets one reset, not one per frame
+func TestResetOnce(t *testing.T) {
+	a, b := net.Pipe()
+	s := New(a, false)
+	defer s.Close()
+	resets := make(chan uint32, 16)
+	go func() {
+		header := make([]byte, headerSize)
+		for {
+			if _, err := io.ReadFull(b, header); err != nil {
+				return
+			}
+			body := make([]byte, binary.BigEndian.Uint32(header[5:]))
+			if _, err := io.ReadFull(b, body); err != nil {
+				return
+			}
+			if frameType(header[0]) == typeReset {
+				resets <- binary.BigEndian.Uint32(header[1:])
+			}
+		}
+	}()
+	frame := func(typ frameType, id uint32, body ...byte) {
+		header := make([]byte, headerSize)
+		header[0] = byte(typ)
+		binary.BigEndian.PutUint32(header[1:], id)
+		binary.BigEndian.PutUint32(header[5:], uint32(len(body)))
+		_, err := b.Write(append(header, body...))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.Listen())
+	frame(typeOpen, 1, byte(Bulk))
+	st, err := s.Accept()
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	for i := 0; i < 100; i++ {
+		frame(typeData, 1, 1)
+	}
+	assert.Equal(t, uint32(1), <-resets)
+	select {
+	case id := <-resets:
+		t.Fatalf("second reset for %d", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// never opened, the peer is broken
+	frame(typeData, 3, 1)
+	<-s.Done()
+	assert.ErrorIs(t, s.Err(), ErrProtocol)
+}
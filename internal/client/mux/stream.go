@@ -0,0 +1,320 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// logical connection inside the session, implements net.Conn
+type Stream struct {
+	id       uint32
+	priority Priority
+	s        *Session
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	recvLeft uint32 // peer can send this much more
+	consumed uint32 // read since the last window update
+	sendLeft uint32 // we can send this much more
+	closed   bool   // by us
+	wclosed  bool   // writes are closed by us, reads go on
+	eof      bool   // peer has closed
+	reset    bool   // peer drops what we write
+	resetOut bool   // we told the peer to stop writing
+	rdl, wdl time.Time
+	// data, window, close or a new deadline
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newStream(s *Session, id uint32, priority Priority) *Stream {
+	return &Stream{
+		id:       id,
+		priority: priority,
+		s:        s,
+		recvLeft: Window,
+		sendLeft: Window,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Priority() Priority {
+	return st.priority
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.consumed += uint32(n)
+			var update uint32
+			// give the window back in big steps, not a frame per read
+			if st.consumed >= Window/2 && !st.eof {
+				update, st.consumed = st.consumed, 0
+				st.recvLeft += update
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				body := make([]byte, 4)
+				binary.BigEndian.PutUint32(body, update)
+				st.s.enqueue(Control, &frame{typ: typeWindow, id: st.id, body: body})
+			}
+			return n, nil
+		}
+		if st.eof {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline := st.rdl
+		st.mu.Unlock()
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// cut into frames as the peer window allows
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		if st.closed || st.wclosed {
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if st.reset {
+			st.mu.Unlock()
+			return written, ErrReset
+		}
+		deadline := st.wdl
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			st.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		n := uint32(len(p) - written)
+		if n > MaxFrame {
+			n = MaxFrame
+		}
+		if n > st.sendLeft {
+			n = st.sendLeft
+		}
+		if n == 0 {
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		st.sendLeft -= n
+		st.mu.Unlock()
+
+		body := append([]byte(nil), p[written:written+int(n)]...)
+		if err := st.sendFrame(&frame{typ: typeData, id: st.id, body: body}, deadline); err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// queued frame waits for its turn, the deadline stops the waiting only
+func (st *Stream) sendFrame(f *frame, deadline time.Time) error {
+	f.done = make(chan error, 1)
+	if err := st.s.enqueue(st.priority, f); err != nil {
+		return err
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-f.done:
+		return err
+	case <-st.s.done:
+		return st.s.Err()
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// wait for the stream to change
+func (st *Stream) wait(wake <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-wake:
+		return nil
+	case <-st.s.done:
+		// data read before the session is gone is still there
+		st.mu.Lock()
+		pending := st.buf.Len() > 0
+		st.mu.Unlock()
+		if pending && wake == st.readable {
+			return nil
+		}
+		return st.s.Err()
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (st *Stream) notify() {
+	for _, ch := range []chan struct{}{st.readable, st.writable} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// data from the peer
+func (st *Stream) push(data []byte) error {
+	st.mu.Lock()
+	if uint32(len(data)) > st.recvLeft {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: stream %d window exceeded", ErrProtocol, st.id)
+	}
+	st.recvLeft -= uint32(len(data))
+	if !st.closed {
+		st.buf.Write(data)
+		st.mu.Unlock()
+		st.notify()
+		return nil
+	}
+	// nobody reads it, stop the writer instead of leaving it on a spent window
+	reset := !st.resetOut
+	st.resetOut = true
+	st.mu.Unlock()
+	if reset {
+		return st.s.enqueue(Control, &frame{typ: typeReset, id: st.id})
+	}
+	return nil
+}
+
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendLeft += n
+	st.notify()
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.eof = true
+	done := st.closed
+	st.mu.Unlock()
+	st.notify()
+	if done {
+		st.s.remove(st.id)
+	}
+}
+
+func (st *Stream) remoteReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	st.notify()
+}
+
+// no more writes, the peer reads the rest and gets EOF.
+// data the peer sends after that is dropped and its writes fail
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf.Reset()
+	done := st.eof
+	sent := st.wclosed
+	st.mu.Unlock()
+	st.notify()
+	if done {
+		st.s.remove(st.id)
+	}
+	if sent {
+		return nil
+	}
+	return st.sendClose()
+}
+
+// no more writes, the peer gets EOF and can still send.
+// like the tcp half close
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.wclosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.wclosed = true
+	st.mu.Unlock()
+	st.notify()
+	return st.sendClose()
+}
+
+func (st *Stream) sendClose() error {
+	// same queue as the data, so it can't overtake it
+	err := st.s.enqueue(st.priority, &frame{typ: typeClose, id: st.id})
+	if err == net.ErrClosed {
+		return nil
+	}
+	return err
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.s.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.s.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdl, st.wdl = t, t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdl = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wdl = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
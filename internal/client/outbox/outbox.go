@@ -0,0 +1,325 @@
+// Outbox keeps chat messages until the peers it went to ack them.
+//
+// The file is encrypted with a key derived from a secret that outlives
+// the process, so queued messages survive a restart without leaking to the disk.
+// File format: 32 bytes salt | 12 bytes nonce | AES-GCM sealed json.
+// Without a path the outbox lives only in memory.
+package outbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	saltSize = 32
+	keySize  = 32
+	keyFile  = "local.key"
+)
+
+var ErrDecrypt = errors.New("can't decrypt the outbox, wrong secret or corrupted file")
+
+type Item struct {
+	Seq     uint64
+	Text    []byte
+	Created time.Time
+}
+
+type state struct {
+	Next  uint64
+	Items []Item
+}
+
+type Outbox struct {
+	mu    sync.Mutex
+	path  string
+	key   []byte
+	salt  []byte
+	state state
+	// who got what, in memory only: peer names are new after a restart
+	sent map[uint64]*recipients
+}
+
+type recipients struct {
+	waiting map[string]bool
+	acked   map[string]bool
+}
+
+// random secret of this install, made on the first call.
+// the server password is new on every run, it can't be the secret
+func LocalKey(dir string) ([]byte, error) {
+	path := filepath.Join(dir, keyFile)
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("%s has %d bytes instead of %d", path, len(key), keySize)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	key = make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	// another process can be first, its key wins
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return LocalKey(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+// in memory only
+func New() *Outbox {
+	return &Outbox{}
+}
+
+// load the outbox file or start a new one
+func Open(path string, secret []byte) (*Outbox, error) {
+	o := &Outbox{path: path}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		o.salt = make([]byte, saltSize)
+		if _, err := rand.Read(o.salt); err != nil {
+			return nil, err
+		}
+		if o.key, err = deriveKey(secret, o.salt); err != nil {
+			return nil, err
+		}
+		return o, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if len(data) < saltSize {
+		return nil, ErrDecrypt
+	}
+	o.salt = data[:saltSize]
+	if o.key, err = deriveKey(secret, o.salt); err != nil {
+		return nil, err
+	}
+	plain, err := o.open(data[saltSize:])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if err := json.Unmarshal(plain, &o.state); err != nil {
+		return nil, fmt.Errorf("outbox is corrupted: %w", err)
+	}
+	return o, nil
+}
+
+// queue a message, it gets the next sequence number
+func (o *Outbox) Add(text []byte) (Item, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.state.Next++
+	item := Item{
+		Seq:     o.state.Next,
+		Text:    append([]byte(nil), text...),
+		Created: time.Now(),
+	}
+	o.state.Items = append(o.state.Items, item)
+	return item, o.save()
+}
+
+// message went to the peers, it stays until all of them ack
+func (o *Outbox) Sent(seq uint64, peers ...string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sent == nil {
+		o.sent = make(map[uint64]*recipients)
+	}
+	r := o.sent[seq]
+	if r == nil {
+		r = &recipients{waiting: make(map[string]bool), acked: make(map[string]bool)}
+		o.sent[seq] = r
+	}
+	for _, peer := range peers {
+		r.waiting[peer] = true
+	}
+}
+
+// peer has the message, it is removed when nobody else waits for it
+func (o *Outbox) Ack(seq uint64, peer string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if r := o.sent[seq]; r != nil {
+		delete(r.waiting, peer)
+		r.acked[peer] = true
+		if len(r.waiting) > 0 {
+			return nil
+		}
+	}
+	return o.remove(seq)
+}
+
+// peer can never get the message, like one too long for its key
+func (o *Outbox) Drop(seq uint64, peer string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r := o.sent[seq]
+	if r == nil {
+		return o.remove(seq)
+	}
+	delete(r.waiting, peer)
+	if len(r.waiting) > 0 {
+		return nil
+	}
+	return o.remove(seq)
+}
+
+// peer is gone without the acks, its messages wait for the next one
+func (o *Outbox) Forget(peer string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, r := range o.sent {
+		delete(r.waiting, peer)
+	}
+}
+
+// true if the peer has acked the message, it isn't sent to it again
+func (o *Outbox) Acked(seq uint64, peer string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r := o.sent[seq]
+	return r != nil && r.acked[peer]
+}
+
+// message is delivered
+func (o *Outbox) Remove(seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.remove(seq)
+}
+
+func (o *Outbox) remove(seq uint64) error {
+	delete(o.sent, seq)
+	for i, item := range o.state.Items {
+		if item.Seq == seq {
+			o.state.Items = append(o.state.Items[:i], o.state.Items[i+1:]...)
+			return o.save()
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) Has(seq uint64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.has(seq)
+}
+
+func (o *Outbox) has(seq uint64) bool {
+	for _, item := range o.state.Items {
+		if item.Seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// queued messages, oldest first
+func (o *Outbox) Items() []Item {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Item(nil), o.state.Items...)
+}
+
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.state.Items)
+}
+
+// rewrite the file, empty outbox is removed from the disk
+func (o *Outbox) save() error {
+	if o.path == "" {
+		return nil
+	}
+	if len(o.state.Items) == 0 {
+		err := os.Remove(o.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	plain, err := json.Marshal(o.state)
+	if err != nil {
+		return err
+	}
+	sealed, err := o.seal(plain)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.path), 0700); err != nil {
+		return err
+	}
+	// write a temp file and rename, so a crash never leaves half a file
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, append(append([]byte(nil), o.salt...), sealed...), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
+
+func (o *Outbox) seal(plain []byte) ([]byte, error) {
+	gcm, err := o.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (o *Outbox) open(data []byte) ([]byte, error) {
+	gcm, err := o.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func (o *Outbox) gcm() (cipher.AEAD, error) {
+	c, err := aes.NewCipher(o.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+// derived once per file, every save reuses the key
+func deriveKey(secret, salt []byte) ([]byte, error) {
+	return scrypt.Key(secret, salt, 1<<15, 8, 1, 32)
+}
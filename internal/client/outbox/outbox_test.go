@@ -0,0 +1,122 @@
+package outbox
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox", "session")
+	secret := []byte("ABCD-1234")
+
+	o, err := Open(path, secret)
+	require.NoError(t, err)
+	first, err := o.Add([]byte("first secret message"))
+	require.NoError(t, err)
+	second, err := o.Add([]byte("second"))
+	require.NoError(t, err)
+	assert.Equal(t, first.Seq+1, second.Seq)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(data, []byte("first secret message")), "plain text on disk")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	t.Run("survives restart", func(t *testing.T) {
+		o, err := Open(path, secret)
+		require.NoError(t, err)
+		items := o.Items()
+		require.Len(t, items, 2)
+		assert.Equal(t, []byte("first secret message"), items[0].Text)
+		assert.Equal(t, second.Seq, items[1].Seq)
+
+		// sequence keeps growing after the restart
+		third, err := o.Add([]byte("third"))
+		require.NoError(t, err)
+		assert.Equal(t, second.Seq+1, third.Seq)
+		require.NoError(t, o.Remove(third.Seq))
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		_, err := Open(path, []byte("nope"))
+		assert.ErrorIs(t, err, ErrDecrypt)
+	})
+
+	t.Run("empty outbox is removed", func(t *testing.T) {
+		o, err := Open(path, secret)
+		require.NoError(t, err)
+		require.NoError(t, o.Remove(first.Seq))
+		assert.True(t, o.Has(second.Seq))
+		require.NoError(t, o.Remove(second.Seq))
+		assert.Equal(t, 0, o.Len())
+		_, err = os.Stat(path)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestOutboxInMemory(t *testing.T) {
+	o := New()
+	item, err := o.Add([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), item.Seq)
+	assert.Equal(t, 1, o.Len())
+	require.NoError(t, o.Remove(item.Seq))
+	assert.Equal(t, 0, o.Len())
+}
+
+func TestOutboxRecipients(t *testing.T) {
+	o := New()
+	item, err := o.Add([]byte("to both"))
+	require.NoError(t, err)
+	o.Sent(item.Seq, "alice", "bob")
+
+	require.NoError(t, o.Ack(item.Seq, "alice"))
+	assert.True(t, o.Has(item.Seq), "bob hasn't acked yet")
+	assert.True(t, o.Acked(item.Seq, "alice"))
+	assert.False(t, o.Acked(item.Seq, "bob"))
+
+	require.NoError(t, o.Ack(item.Seq, "bob"))
+	assert.False(t, o.Has(item.Seq))
+
+	t.Run("dropped peer doesn't hold it", func(t *testing.T) {
+		item, err := o.Add([]byte("too long for bob"))
+		require.NoError(t, err)
+		o.Sent(item.Seq, "alice", "bob")
+		require.NoError(t, o.Drop(item.Seq, "bob"))
+		assert.True(t, o.Has(item.Seq))
+		require.NoError(t, o.Ack(item.Seq, "alice"))
+		assert.False(t, o.Has(item.Seq))
+	})
+
+	t.Run("never sent", func(t *testing.T) {
+		item, err := o.Add([]byte("restored"))
+		require.NoError(t, err)
+		require.NoError(t, o.Ack(item.Seq, "alice"))
+		assert.False(t, o.Has(item.Seq))
+	})
+}
+
+func TestLocalKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	key, err := LocalKey(dir)
+	require.NoError(t, err)
+	assert.Len(t, key, keySize)
+	info, err := os.Stat(filepath.Join(dir, keyFile))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	again, err := LocalKey(dir)
+	require.NoError(t, err)
+	assert.Equal(t, key, again, "same key on the next run")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, keyFile), []byte("short"), 0600))
+	_, err = LocalKey(dir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/connection"
+	"github.com/1F47E/go-shaihulud/internal/client/listner"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+const sendQueueSize = 64
+
+// connected user with its own outbound queue and lifecycle
+type peer struct {
+	user   *connection.Connection // chat runs on the main stream
+	mux    *mux.Session
+	msgCh  chan message.Message // outbound queue, drained by the sender
+	lstnr  *listner.Listner
+	acks   chan uint32 // delivered nonces
+	sent   *tracker    // chat messages waiting for the ack
+	report func(Delivery)
+	ctx    context.Context
+	cancel context.CancelFunc
+	keys   asymmetric.Asymmetric // ours for this peer, rotated on rekey
+
+	// chat text for the current peer key, the key changes on rekey
+	encrypt func(text []byte) ([]byte, error)
+}
+
+func newPeer(ctx context.Context, session *mux.Session) *peer {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &peer{
+		user:   connection.New(session.Main()),
+		mux:    session,
+		msgCh:  make(chan message.Message, sendQueueSize),
+		acks:   make(chan uint32, sendQueueSize),
+		sent:   newTracker(),
+		report: func(Delivery) {},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	p.lstnr = listner.New(ctx, cancel, p.msgCh)
+	p.lstnr.OnAck = func(nonce uint32) {
+		if d, ok := p.sent.ack(nonce); ok {
+			p.report(d)
+		}
+		select {
+		case p.acks <- nonce:
+		default:
+		}
+	}
+	return p
+}
+
+// false if the peer is gone before the message is queued
+func (p *peer) send(msg message.Message) bool {
+	select {
+	case p.msgCh <- msg:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// send a chat message and track its delivery
+func (p *peer) sendTracked(seq uint64, text []byte) error {
+	cipher, err := p.encrypt(text)
+	if err != nil {
+		return err
+	}
+	msg := message.NewMSG(cipher)
+	p.sent.add(seq, msg.Nonce, p.user.Name, string(text))
+	p.send(msg)
+	return nil
+}
+
+// resend unacked messages until they are delivered or out of retries.
+// whatever is pending when the peer is gone has failed
+func (p *peer) retransmit() {
+	ticker := time.NewTicker(p.sent.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			for _, d := range p.sent.drop() {
+				p.report(d)
+			}
+			return
+		case <-ticker.C:
+			resend, failed := p.sent.due()
+			for _, m := range resend {
+				// the old frame can be for a key the peer has dropped
+				cipher, err := p.encrypt([]byte(m.Text))
+				if err != nil {
+					logger.New().Errorf("can't resend a message to <%s>: %v", m.Peer, err)
+					continue
+				}
+				msg := message.NewMSG(cipher)
+				msg.Nonce = m.nonce
+				if !p.send(msg) {
+					break
+				}
+			}
+			for _, d := range failed {
+				p.report(d)
+			}
+		}
+	}
+}
+
+// graceful disconnect: send the reason, wait for the ack and close
+func (p *peer) disconnect(reason message.DiscReason, text string, timeout time.Duration) {
+	msg := message.NewDisconnect(reason, text)
+	if !p.send(msg) {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case nonce := <-p.acks:
+			if nonce != msg.Nonce {
+				continue
+			}
+		case <-timer.C:
+		case <-p.ctx.Done():
+		}
+		p.cancel()
+		return
+	}
+}
+
+// true once the handshake is done, even after the peer is gone
+func (p *peer) handshaked() bool {
+	select {
+	case <-p.user.Ready():
+		return true
+	default:
+		return false
+	}
+}
+
+// seal a stream key for the peer, only its private key opens it
+func (p *peer) encryptKey(key []byte) ([]byte, error) {
+	return p.keys.Encrypt(key, p.user.Key())
+}
+
+func (p *peer) close() {
+	p.cancel()
+	p.mux.Close()
+}
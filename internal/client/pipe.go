@@ -0,0 +1,50 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+	"github.com/1F47E/go-shaihulud/internal/client/pipe"
+)
+
+// byte stream instead of the chat
+type pipeMode struct {
+	in   io.Reader
+	out  io.Writer
+	once sync.Once // one pipe per run
+	done chan error
+}
+
+// Pipe sends in to the peer and writes what the peer sends to out, no chat.
+// The client opens the pipe after the handshake, the server takes the first one.
+// Call it before RunServer or RunClient, the channel gets the result
+func (c *Client) Pipe(in io.Reader, out io.Writer) <-chan error {
+	c.pipe = &pipeMode{in: in, out: out, done: make(chan error, 1)}
+	return c.pipe.done
+}
+
+func (c *Client) openPipe(p *peer) {
+	c.pipe.once.Do(func() {
+		go func() {
+			c.pipe.done <- c.withSealedStream(p, streamPipe, c.runPipe)
+		}()
+	})
+}
+
+func (c *Client) acceptPipe(p *peer, st *mux.Stream) {
+	first := false
+	c.pipe.once.Do(func() {
+		first = true
+	})
+	if !first {
+		st.Close()
+		return
+	}
+	c.pipe.done <- runSealedStream(p, st, c.runPipe)
+}
+
+func (c *Client) runPipe(conn net.Conn) error {
+	return pipe.Run(conn, c.pipe.in, c.pipe.out)
+}
@@ -0,0 +1,140 @@
+// Pipe streams bytes both ways, like netcat over the peer link.
+//
+// Each side sends its input as data frames and then an end frame with the
+// status: ok on EOF, or the reason if the input broke. The pipe is done when
+// both ends are in. The result is known then, a last bye from both sides
+// keeps the link up until the peer has read everything too.
+//
+// Frames are the ones of the frame package.
+package pipe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/1F47E/go-shaihulud/internal/client/frame"
+)
+
+const (
+	chunkSize = 32 << 10
+	frameMax  = chunkSize + 1024
+)
+
+type frameType byte
+
+const (
+	frameData frameType = iota + 1
+	frameEnd            // 1 byte ok | reason
+	frameBye            // both ends are in
+)
+
+// exit codes of the pipe command
+const (
+	ExitOK    = 0
+	ExitError = 1 // local input or output failed
+	ExitUsage = 2
+	ExitPeer  = 3 // peer input failed
+	ExitLost  = 4 // connection lost before the end
+)
+
+var (
+	ErrPeer     = errors.New("peer input failed")
+	ErrLost     = errors.New("connection lost before the end")
+	ErrProtocol = errors.New("pipe protocol error")
+)
+
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrPeer):
+		return ExitPeer
+	case errors.Is(err, ErrLost), errors.Is(err, ErrProtocol):
+		return ExitLost
+	default:
+		return ExitError
+	}
+}
+
+// send in to the peer and write what it sends to out, until both ends are in.
+// a broken output returns right away, the input can block forever
+func Run(conn io.ReadWriter, in io.Reader, out io.Writer) error {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- send(conn, in)
+	}()
+
+	var peerErr error
+	for done := false; !done; {
+		typ, body, err := readFrame(conn)
+		if err != nil {
+			return lost(err)
+		}
+		switch typ {
+		case frameData:
+			if _, err := out.Write(body); err != nil {
+				return fmt.Errorf("output: %w", err)
+			}
+		case frameEnd:
+			if len(body) == 0 {
+				return fmt.Errorf("%w: empty end", ErrProtocol)
+			}
+			if body[0] != 1 {
+				peerErr = fmt.Errorf("%w: %s", ErrPeer, body[1:])
+			}
+			done = true
+		default:
+			return fmt.Errorf("%w: got %d instead of data", ErrProtocol, typ)
+		}
+	}
+	sendErr := <-sent
+
+	// the peer is done with us after its bye, errors don't change the result
+	if writeFrame(conn, frameBye, nil) == nil {
+		readFrame(conn)
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	return peerErr
+}
+
+// input as data frames, then the end
+func send(w io.Writer, in io.Reader) error {
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			if err := writeFrame(w, frameData, buf[:n]); err != nil {
+				return lost(err)
+			}
+		}
+		if err == io.EOF {
+			return lost(writeFrame(w, frameEnd, []byte{1}))
+		}
+		if err != nil {
+			writeFrame(w, frameEnd, append([]byte{0}, err.Error()...))
+			return fmt.Errorf("input: %w", err)
+		}
+	}
+}
+
+func lost(err error) error {
+	if err == nil || errors.Is(err, ErrProtocol) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrLost, err)
+}
+
+func writeFrame(w io.Writer, typ frameType, body []byte) error {
+	return frame.Write(w, byte(typ), body)
+}
+
+func readFrame(r io.Reader) (frameType, []byte, error) {
+	typ, body, err := frame.Read(r, frameMax)
+	if errors.Is(err, frame.ErrTooLarge) {
+		err = fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	return frameType(typ), body, err
+}
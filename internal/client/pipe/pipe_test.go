@@ -0,0 +1,101 @@
+package pipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// two ends of a stream, buffered like the real link
+func streams(t *testing.T) (*mux.Stream, *mux.Stream, func()) {
+	a, b := net.Pipe()
+	sa, sb := mux.New(a, true), mux.New(b, false)
+	t.Cleanup(func() {
+		sa.Close()
+		sb.Close()
+	})
+	return sa.Main(), sb.Main(), func() { sa.Close() }
+}
+
+func random(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+type result struct {
+	out bytes.Buffer
+	err error
+}
+
+func run(conn io.ReadWriter, in io.Reader) chan *result {
+	done := make(chan *result, 1)
+	go func() {
+		r := &result{}
+		r.err = Run(conn, in, &r.out)
+		done <- r
+	}()
+	return done
+}
+
+func TestPipe(t *testing.T) {
+	a, b, _ := streams(t)
+	up, down := random(3*chunkSize+100), random(10)
+
+	ra := run(a, bytes.NewReader(up))
+	rb := run(b, bytes.NewReader(down))
+	gotA, gotB := <-ra, <-rb
+	require.NoError(t, gotA.err)
+	require.NoError(t, gotB.err)
+	assert.True(t, bytes.Equal(down, gotA.out.Bytes()))
+	assert.True(t, bytes.Equal(up, gotB.out.Bytes()))
+}
+
+func TestPipeOneWay(t *testing.T) {
+	a, b, _ := streams(t)
+	ra := run(a, bytes.NewReader([]byte("tar data")))
+	rb := run(b, bytes.NewReader(nil))
+	gotA, gotB := <-ra, <-rb
+	require.NoError(t, gotA.err)
+	require.NoError(t, gotB.err)
+	assert.Empty(t, gotA.out.Bytes())
+	assert.Equal(t, "tar data", gotB.out.String())
+}
+
+func TestPipeInputFails(t *testing.T) {
+	a, b, _ := streams(t)
+	broken := io.MultiReader(bytes.NewReader([]byte("half")), iotest.ErrReader(errors.New("disk on fire")))
+	ra := run(a, broken)
+	rb := run(b, bytes.NewReader(nil))
+	gotA, gotB := <-ra, <-rb
+
+	assert.Equal(t, ExitError, ExitCode(gotA.err))
+	assert.ErrorIs(t, gotB.err, ErrPeer)
+	assert.Contains(t, gotB.err.Error(), "disk on fire")
+	assert.Equal(t, ExitPeer, ExitCode(gotB.err))
+	assert.Equal(t, "half", gotB.out.String(), "data before the failure is delivered")
+}
+
+func TestPipeLost(t *testing.T) {
+	a, _, drop := streams(t)
+	// the peer never sends its end
+	ra := run(a, bytes.NewReader([]byte("hello")))
+	drop()
+	got := <-ra
+	assert.ErrorIs(t, got.err, ErrLost)
+	assert.Equal(t, ExitLost, ExitCode(got.err))
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, ExitOK, ExitCode(nil))
+	assert.Equal(t, ExitLost, ExitCode(ErrProtocol))
+	assert.Equal(t, ExitError, ExitCode(errors.New("output: broken pipe")))
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/1F47E/go-shaihulud/internal/client/outbox"
+)
+
+// user input waiting to be sent to the peer
+type inputQueue struct {
+	mu     sync.Mutex
+	items  []outbox.Item
+	notify chan struct{} // signals a new item
+}
+
+func newInputQueue() *inputQueue {
+	return &inputQueue{notify: make(chan struct{}, 1)}
+}
+
+func (q *inputQueue) push(item outbox.Item) {
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// item is removed only after it's sent
+func (q *inputQueue) peek() (outbox.Item, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return outbox.Item{}, false
+	}
+	return q.items[0], true
+}
+
+func (q *inputQueue) pop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) > 0 {
+		q.items = q.items[1:]
+	}
+}
+
+func (q *inputQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// queued sequence numbers
+func (q *inputQueue) seqs() map[uint64]bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	seqs := make(map[uint64]bool, len(q.items))
+	for _, item := range q.items {
+		seqs[item.Seq] = true
+	}
+	return seqs
+}
@@ -0,0 +1,61 @@
+package client_socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+
+	"golang.org/x/net/proxy"
+)
+
+// dial through any SOCKS5 proxy:
+// external tor daemon, whonix gateway or a corporate proxy
+type SocksClient struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	proxyAddr string
+	auth      *proxy.Auth // nil if no auth
+}
+
+func New(ctx context.Context, cancel context.CancelFunc) *SocksClient {
+	var auth *proxy.Auth
+	if cfg.PROXY_USER != "" {
+		auth = &proxy.Auth{User: cfg.PROXY_USER, Password: cfg.PROXY_PASSWORD}
+	}
+	return &SocksClient{
+		ctx:       ctx,
+		cancel:    cancel,
+		proxyAddr: cfg.PROXY_ADDR,
+		auth:      auth,
+	}
+}
+
+// hosting an onion needs a tor control port, proxy can only dial
+func (c *SocksClient) RunServer(_ string, _ []byte) (net.Listener, error) {
+	return nil, fmt.Errorf("socks connector can't run a server, use tor or local")
+}
+
+func (c *SocksClient) RunClient(address string) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", c.proxyAddr, c.auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("socks dialer create error: %w", err)
+	}
+
+	dialCtx, dialCancel := context.WithTimeout(c.ctx, cfg.PROXY_DIAL_TIMEOUT)
+	defer dialCancel()
+	conn, err := dialer.(proxy.ContextDialer).DialContext(dialCtx, "tcp", address)
+	if err != nil {
+		if strings.Contains(err.Error(), "host unreachable") {
+			return nil, fmt.Errorf("server is down :(")
+		}
+		return nil, fmt.Errorf("socks dial error: %w", err)
+	}
+	return conn, nil
+}
+
+func (c *SocksClient) Close() error {
+	return nil
+}
@@ -0,0 +1,202 @@
+package client_socks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// minimal SOCKS5 server (RFC 1928, RFC 1929), CONNECT only
+type socksServer struct {
+	ln         net.Listener
+	user, pass string
+}
+
+func newSocksServer(t *testing.T, user, pass string) *socksServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &socksServer{ln: ln, user: user, pass: pass}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *socksServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// greeting: ver, nmethods, methods
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if s.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		// user/pass auth: ver, ulen, user, plen, pass
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != s.user || string(pass) != s.pass {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// request: ver, cmd, rsv, atyp, addr, port
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		l := make([]byte, 1)
+		io.ReadFull(conn, l)
+		name := make([]byte, l[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		// host unreachable
+		conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// echo server as a chat peer
+func newEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+func newTestClient(proxyAddr string, auth *proxy.Auth) *SocksClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, cancel)
+	c.proxyAddr = proxyAddr
+	c.auth = auth
+	return c
+}
+
+func echo(t *testing.T, conn net.Conn) {
+	msg := []byte("hello via socks")
+	_, err := conn.Write(msg)
+	require.NoError(t, err)
+	reply := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, msg, reply)
+}
+
+func TestSocksClient(t *testing.T) {
+	target := newEchoServer(t)
+
+	t.Run("no auth", func(t *testing.T) {
+		srv := newSocksServer(t, "", "")
+		c := newTestClient(srv.ln.Addr().String(), nil)
+		defer c.cancel()
+
+		conn, err := c.RunClient(target)
+		require.NoError(t, err)
+		defer conn.Close()
+		echo(t, conn)
+	})
+
+	t.Run("user and password", func(t *testing.T) {
+		srv := newSocksServer(t, "user", "secret")
+		c := newTestClient(srv.ln.Addr().String(), &proxy.Auth{User: "user", Password: "secret"})
+		defer c.cancel()
+
+		conn, err := c.RunClient(target)
+		require.NoError(t, err)
+		defer conn.Close()
+		echo(t, conn)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		srv := newSocksServer(t, "user", "secret")
+		c := newTestClient(srv.ln.Addr().String(), &proxy.Auth{User: "user", Password: "nope"})
+		defer c.cancel()
+
+		_, err := c.RunClient(target)
+		assert.Error(t, err)
+	})
+
+	t.Run("target is down", func(t *testing.T) {
+		srv := newSocksServer(t, "", "")
+		c := newTestClient(srv.ln.Addr().String(), nil)
+		defer c.cancel()
+
+		// grab a free port and close it
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		down := ln.Addr().String()
+		ln.Close()
+
+		_, err = c.RunClient(down)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "server is down")
+	})
+
+	t.Run("server is not supported", func(t *testing.T) {
+		c := newTestClient("127.0.0.1:0", nil)
+		defer c.cancel()
+		_, err := c.RunServer("", nil)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"io"
+	"net"
+
+	"github.com/1F47E/go-shaihulud/internal/client/mux"
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/streamcrypt"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+// first byte on a stream opened by the peer, tells what runs on it
+type streamKind byte
+
+const (
+	streamFile streamKind = iota + 1
+	streamPipe
+	streamForward // -L connection, dial the address
+	streamListen  // -R rule, listen on the address
+	streamReverse // connection to a -R listener
+)
+
+// streams opened by the peer, after the handshake only
+func (c *Client) acceptStreams(p *peer) {
+	select {
+	case <-p.user.Ready():
+	case <-p.ctx.Done():
+		return
+	}
+	if err := p.mux.Listen(); err != nil {
+		return
+	}
+	for {
+		st, err := p.mux.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleStream(p, st)
+	}
+}
+
+func (c *Client) handleStream(p *peer, st *mux.Stream) {
+	log := logger.New()
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(st, kind); err != nil {
+		st.Close()
+		return
+	}
+	switch k := streamKind(kind[0]); {
+	// pipe mode has nobody to answer file offers
+	case k == streamFile && c.pipe == nil:
+		c.receiveFile(p, st)
+	case k == streamPipe && c.pipe != nil:
+		c.acceptPipe(p, st)
+	case k == streamForward:
+		c.acceptForward(p, st)
+	case k == streamListen:
+		c.acceptListen(p, st)
+	case k == streamReverse:
+		c.acceptReverse(p, st)
+	default:
+		log.Warnf("<%s> opened a %d stream, closing it", p.user.Name, k)
+		st.Close()
+	}
+}
+
+// stream is closed when the peer is gone or the work is done
+func (c *Client) withStream(p *peer, kind streamKind, fn func(st *mux.Stream) error) error {
+	st, err := p.mux.Open(mux.Bulk)
+	if err != nil {
+		return err
+	}
+	if _, err := st.Write([]byte{byte(kind)}); err != nil {
+		st.Close()
+		return err
+	}
+	return runStream(p, st, fn)
+}
+
+// like withStream, the mux is plain so the stream goes sealed with its own key
+func (c *Client) withSealedStream(p *peer, kind streamKind, fn func(conn net.Conn) error) error {
+	return c.withStream(p, kind, func(st *mux.Stream) error {
+		conn, err := streamcrypt.Client(st, p.encryptKey)
+		if err != nil {
+			return err
+		}
+		return fn(conn)
+	})
+}
+
+// sealed stream opened by the peer, it has sent the key
+func runSealedStream(p *peer, st *mux.Stream, fn func(conn net.Conn) error) error {
+	return runStream(p, st, func(st *mux.Stream) error {
+		conn, err := streamcrypt.Server(st, p.keys.Decrypt)
+		if err != nil {
+			return err
+		}
+		return fn(conn)
+	})
+}
+
+func runStream(p *peer, st *mux.Stream, fn func(st *mux.Stream) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			st.Close()
+		case <-done:
+		}
+	}()
+	defer st.Close()
+	return fn(st)
+}
@@ -0,0 +1,212 @@
+package client_tor
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bridge line formats (same as torrc without the "Bridge" keyword)
+// 1.2.3.4:443 FINGERPRINT
+// obfs4 1.2.3.4:443 FINGERPRINT cert=... iat-mode=0
+// snowflake 192.0.2.3:80 FINGERPRINT fingerprint=... url=... front=...
+// meek_lite 192.0.2.18:80 FINGERPRINT url=... front=...
+
+var transportName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+type Bridge struct {
+	Transport   string // empty for vanilla bridges
+	Addr        string
+	Fingerprint string
+	Args        []string // key=value transport args
+}
+
+// bridges and pluggable transports for censored networks
+type BridgeConf struct {
+	Bridges    []Bridge
+	Transports map[string]string // transport name -> plugin binary
+}
+
+func ParseBridge(line string) (Bridge, error) {
+	var b Bridge
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "bridge") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return b, fmt.Errorf("empty bridge line")
+	}
+
+	// first field is a transport name unless it's an address
+	if !isAddr(fields[0]) {
+		if !transportName.MatchString(fields[0]) {
+			return b, fmt.Errorf("invalid transport name: %q", fields[0])
+		}
+		b.Transport = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) == 0 || !isAddr(fields[0]) {
+		return b, fmt.Errorf("bridge address is missing or invalid: %q", line)
+	}
+	b.Addr = fields[0]
+	fields = fields[1:]
+
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		fp := fields[0]
+		if len(fp) != 40 {
+			return b, fmt.Errorf("invalid bridge fingerprint len: %q", fp)
+		}
+		if _, err := hex.DecodeString(fp); err != nil {
+			return b, fmt.Errorf("invalid bridge fingerprint: %q", fp)
+		}
+		b.Fingerprint = strings.ToUpper(fp)
+		fields = fields[1:]
+	}
+
+	for _, arg := range fields {
+		k, _, ok := strings.Cut(arg, "=")
+		if !ok || k == "" {
+			return b, fmt.Errorf("invalid bridge argument: %q", arg)
+		}
+		b.Args = append(b.Args, arg)
+	}
+	if b.Transport == "" && len(b.Args) > 0 {
+		return b, fmt.Errorf("vanilla bridge can't have arguments: %q", line)
+	}
+	return b, nil
+}
+
+func (b Bridge) String() string {
+	parts := make([]string, 0, 3+len(b.Args))
+	if b.Transport != "" {
+		parts = append(parts, b.Transport)
+	}
+	parts = append(parts, b.Addr)
+	if b.Fingerprint != "" {
+		parts = append(parts, b.Fingerprint)
+	}
+	parts = append(parts, b.Args...)
+	return strings.Join(parts, " ")
+}
+
+// format is name=path separated by commas
+// obfs4=/usr/bin/obfs4proxy,snowflake=/usr/bin/snowflake-client
+func ParseTransports(s string) (map[string]string, error) {
+	transports := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(part, "=")
+		name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid transport %q, expected name=path", part)
+		}
+		if !transportName.MatchString(name) {
+			return nil, fmt.Errorf("invalid transport name: %q", name)
+		}
+		transports[name] = path
+	}
+	return transports, nil
+}
+
+// read bridge lines from the file (one per line, # for comments)
+// and check that transport plugins are installed
+func LoadBridgeConf(bridgesFile, transports string) (*BridgeConf, error) {
+	conf := &BridgeConf{}
+	var err error
+	conf.Transports, err = ParseTransports(transports)
+	if err != nil {
+		return nil, err
+	}
+
+	if bridgesFile != "" {
+		f, err := os.Open(bridgesFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't open bridges file: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		n := 0
+		for scanner.Scan() {
+			n++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			b, err := ParseBridge(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", bridgesFile, n, err)
+			}
+			conf.Bridges = append(conf.Bridges, b)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	for name, path := range conf.Transports {
+		if _, err := exec.LookPath(path); err != nil {
+			return nil, fmt.Errorf("transport %s plugin not found: %w", name, err)
+		}
+	}
+	return conf, nil
+}
+
+// every bridge transport should have a plugin
+func (c *BridgeConf) Validate() error {
+	for _, b := range c.Bridges {
+		if b.Transport == "" {
+			continue
+		}
+		if _, ok := c.Transports[b.Transport]; !ok {
+			return fmt.Errorf("no plugin configured for transport %q", b.Transport)
+		}
+	}
+	return nil
+}
+
+func (c *BridgeConf) Enabled() bool {
+	return c != nil && len(c.Bridges) > 0
+}
+
+// torrc options for the bridges
+func (c *BridgeConf) Torrc() string {
+	if !c.Enabled() {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("UseBridges 1\n")
+	names := make([]string, 0, len(c.Transports))
+	for name := range c.Transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&sb, "ClientTransportPlugin %s exec %s\n", name, c.Transports[name])
+	}
+	for _, b := range c.Bridges {
+		fmt.Fprintf(&sb, "Bridge %s\n", b)
+	}
+	return sb.String()
+}
+
+func isAddr(s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p < 65536
+}
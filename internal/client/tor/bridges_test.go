@@ -0,0 +1,169 @@
+package client_tor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+	"github.com/cretz/bine/tor"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFP = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
+
+func TestParseBridge(t *testing.T) {
+	t.Run("valid lines", func(t *testing.T) {
+		tests := []struct {
+			line string
+			want Bridge
+		}{
+			{
+				"1.2.3.4:443 " + testFP,
+				Bridge{Addr: "1.2.3.4:443", Fingerprint: testFP},
+			},
+			{
+				"Bridge obfs4 1.2.3.4:443 " + testFP + " cert=abc iat-mode=0",
+				Bridge{Transport: "obfs4", Addr: "1.2.3.4:443", Fingerprint: testFP, Args: []string{"cert=abc", "iat-mode=0"}},
+			},
+			{
+				"snowflake 192.0.2.3:80 " + testFP + " url=https://snowflake-broker.torproject.net/ front=cdn.sstatic.net",
+				Bridge{Transport: "snowflake", Addr: "192.0.2.3:80", Fingerprint: testFP, Args: []string{"url=https://snowflake-broker.torproject.net/", "front=cdn.sstatic.net"}},
+			},
+			{
+				"meek_lite [2001:db8::1]:443 url=https://meek.example.com/",
+				Bridge{Transport: "meek_lite", Addr: "[2001:db8::1]:443", Args: []string{"url=https://meek.example.com/"}},
+			},
+		}
+		for _, tt := range tests {
+			b, err := ParseBridge(tt.line)
+			require.NoError(t, err, tt.line)
+			assert.Equal(t, tt.want, b)
+		}
+	})
+
+	t.Run("invalid lines", func(t *testing.T) {
+		lines := []string{
+			"",
+			"Bridge",
+			"obfs4",
+			"obfs4 1.2.3.4",
+			"obfs4 1.2.3.4:99999 " + testFP,
+			"OBFS4! 1.2.3.4:443",
+			"1.2.3.4:443 ABCDEF",
+			"1.2.3.4:443 " + testFP[:39] + "Z",
+			"1.2.3.4:443 " + testFP + " cert=abc",
+			"obfs4 1.2.3.4:443 " + testFP + " =abc",
+		}
+		for _, line := range lines {
+			_, err := ParseBridge(line)
+			assert.Error(t, err, line)
+		}
+	})
+
+	t.Run("string round trip", func(t *testing.T) {
+		line := "obfs4 1.2.3.4:443 " + testFP + " cert=abc iat-mode=0"
+		b, err := ParseBridge(line)
+		require.NoError(t, err)
+		assert.Equal(t, line, b.String())
+	})
+}
+
+func TestParseTransports(t *testing.T) {
+	tr, err := ParseTransports(" obfs4=/usr/bin/obfs4proxy, snowflake=/usr/bin/snowflake-client ,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"obfs4":     "/usr/bin/obfs4proxy",
+		"snowflake": "/usr/bin/snowflake-client",
+	}, tr)
+
+	tr, err = ParseTransports("")
+	require.NoError(t, err)
+	assert.Empty(t, tr)
+
+	_, err = ParseTransports("obfs4")
+	assert.Error(t, err)
+	_, err = ParseTransports("obfs4=")
+	assert.Error(t, err)
+	_, err = ParseTransports("Bad Name=/bin/true")
+	assert.Error(t, err)
+}
+
+func TestLoadBridgeConf(t *testing.T) {
+	// the test binary itself is a valid executable for plugin lookup
+	plugin, err := os.Executable()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bridges")
+	data := "# my bridges\n\nobfs4 1.2.3.4:443 " + testFP + " cert=abc iat-mode=0\n5.6.7.8:9001\n"
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+
+	t.Run("torrc", func(t *testing.T) {
+		conf, err := LoadBridgeConf(path, "obfs4="+plugin)
+		require.NoError(t, err)
+		require.True(t, conf.Enabled())
+		require.Len(t, conf.Bridges, 2)
+
+		expected := "UseBridges 1\n" +
+			"ClientTransportPlugin obfs4 exec " + plugin + "\n" +
+			"Bridge obfs4 1.2.3.4:443 " + testFP + " cert=abc iat-mode=0\n" +
+			"Bridge 5.6.7.8:9001\n"
+		assert.Equal(t, expected, conf.Torrc())
+	})
+
+	t.Run("missing plugin config", func(t *testing.T) {
+		_, err := LoadBridgeConf(path, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("plugin binary not found", func(t *testing.T) {
+		_, err := LoadBridgeConf(path, "obfs4="+filepath.Join(dir, "nope"))
+		assert.Error(t, err)
+	})
+
+	t.Run("bad line reports line number", func(t *testing.T) {
+		bad := filepath.Join(dir, "bad")
+		require.NoError(t, os.WriteFile(bad, []byte("# ok\nobfs4 nope\n"), 0600))
+		_, err := LoadBridgeConf(bad, "obfs4="+plugin)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), bad+":2")
+	})
+
+	t.Run("no bridges", func(t *testing.T) {
+		conf, err := LoadBridgeConf("", "")
+		require.NoError(t, err)
+		assert.False(t, conf.Enabled())
+		assert.Empty(t, conf.Torrc())
+	})
+}
+
+func TestCloseRemovesTorrc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridges")
+	require.NoError(t, os.WriteFile(path, []byte("1.2.3.4:443 "+testFP+"\n"), 0600))
+	file := cfg.TOR_BRIDGES_FILE
+	cfg.TOR_BRIDGES_FILE = path
+	t.Cleanup(func() { cfg.TOR_BRIDGES_FILE = file })
+
+	// ephemeral data dir, the torrc goes to temp
+	c := &TorClient{}
+	conf := &tor.StartConf{}
+	require.NoError(t, c.setupBridges(conf))
+	require.FileExists(t, conf.TorrcFile)
+
+	// tor never started
+	require.NoError(t, c.Close())
+	assert.NoFileExists(t, conf.TorrcFile)
+}
+
+func TestStatus(t *testing.T) {
+	c := New(context.Background(), func() {})
+	assert.Equal(t, "starting", c.Status())
+	c.setState("bootstrap 45%", nil)
+	assert.Equal(t, "bootstrap 45%", c.Status())
+	require.NoError(t, c.Close())
+	assert.Equal(t, "down", c.Status())
+}
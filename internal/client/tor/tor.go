@@ -4,32 +4,69 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 
-	"github.com/1F47E/go-shaihulud/internal/client/message"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+	"github.com/1F47E/go-shaihulud/internal/logger"
 
+	"github.com/cretz/bine/control"
 	"github.com/cretz/bine/tor"
 	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/sirupsen/logrus"
 )
 
+var log = logger.New()
+
 type TorClient struct {
 	ctx    context.Context
 	cancel context.CancelFunc
-	msgCh  chan message.Message
+	tor    *tor.Tor
+	torrc  string // temp torrc to remove on close
+
+	mu    sync.Mutex
+	state string        // bootstrap progress, guarded by mu
+	ctrl  *control.Conn // set once bootstrapped, asked for the circuit
 }
 
-func New(ctx context.Context, cancel context.CancelFunc, msgCh chan message.Message) *TorClient {
+func New(ctx context.Context, cancel context.CancelFunc) *TorClient {
 	return &TorClient{
 		ctx:    ctx,
 		cancel: cancel,
-		msgCh:  msgCh,
+		state:  "starting",
+	}
+}
+
+// bootstrap progress, then if tor has a circuit, for the status bar.
+// the control port is busy with the events until the bootstrap is done
+func (c *TorClient) Status() string {
+	c.mu.Lock()
+	state, ctrl := c.state, c.ctrl
+	c.mu.Unlock()
+	if ctrl == nil {
+		return state
+	}
+	info, err := ctrl.GetInfo("status/circuit-established")
+	if err != nil || len(info) != 1 {
+		return "down"
+	}
+	if info[0].Val == "1" {
+		return "circuit up"
 	}
+	return "circuit down"
+}
+
+func (c *TorClient) setState(state string, ctrl *control.Conn) {
+	c.mu.Lock()
+	c.state, c.ctrl = state, ctrl
+	c.mu.Unlock()
 }
 
 // Start the tor service and return the listener
 func (c *TorClient) RunServer(_ string, onionPrivKey []byte) (net.Listener, error) {
-	t, err := tor.Start(c.ctx, nil)
+	t, err := c.start("server")
 	if err != nil {
 		return nil, err
 	}
@@ -44,23 +81,20 @@ func (c *TorClient) RunServer(_ string, onionPrivKey []byte) (net.Listener, erro
 }
 
 func (c *TorClient) RunClient(address string) (net.Conn, error) {
-	// Start tor with default config (can set start conf's DebugWriter to os.Stdout for debug logs)
-	t, err := tor.Start(c.ctx, nil)
+	t, err := c.start("client")
 	if err != nil {
-		return nil, fmt.Errorf("tor start error: %w", err)
+		return nil, err
 	}
 
-	// Wait at most a minute to start network and get
-	dialCtx, dialCancel := context.WithTimeout(context.Background(), time.Minute)
-	defer dialCancel()
-
-	// custom tor dialer
-	dialer, err := t.Dialer(dialCtx, nil)
+	// custom tor dialer, network is already bootstrapped
+	dialer, err := t.Dialer(c.ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("tor dialer create error: %w", err)
 	}
 
-	conn, err := dialer.Dial("tcp", address)
+	dialCtx, dialCancel := context.WithTimeout(c.ctx, cfg.TOR_DIAL_TIMEOUT)
+	defer dialCancel()
+	conn, err := dialer.DialContext(dialCtx, "tcp", address)
 	if err != nil {
 		if strings.Contains(err.Error(), "host unreachable") {
 			return nil, fmt.Errorf("tor server is down :(")
@@ -70,3 +104,146 @@ func (c *TorClient) RunClient(address string) (net.Conn, error) {
 
 	return conn, nil
 }
+
+// stop tor, ephemeral data dir is removed by bine on close.
+// the temp torrc lists the bridges, it goes even if tor never started
+func (c *TorClient) Close() error {
+	c.setState("down", nil)
+	if c.torrc != "" {
+		os.Remove(c.torrc)
+		c.torrc = ""
+	}
+	if c.tor == nil {
+		return nil
+	}
+	err := c.tor.Close()
+	c.tor = nil
+	return err
+}
+
+// start tor process and wait for the network bootstrap.
+// role separates data dirs so server and client can run from the same folder
+func (c *TorClient) start(role string) (*tor.Tor, error) {
+	// already running, reconnect
+	if c.tor != nil {
+		return c.tor, nil
+	}
+	conf := &tor.StartConf{}
+	if cfg.TOR_EPHEMERAL {
+		conf.TempDataDirBase = os.TempDir()
+	} else {
+		conf.DataDir = filepath.Join(cfg.TOR_DATA_DIR, role)
+		log.Debugf("tor data dir: %s\n", conf.DataDir)
+	}
+	if os.Getenv("DEBUG") == "1" {
+		conf.DebugWriter = log.WriterLevel(logrus.DebugLevel)
+	}
+	if err := c.setupBridges(conf); err != nil {
+		return nil, err
+	}
+
+	t, err := tor.Start(c.ctx, conf)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("tor start error: %w", err)
+	}
+	c.tor = t
+
+	startCtx, startCancel := context.WithTimeout(c.ctx, cfg.TOR_START_TIMEOUT)
+	defer startCancel()
+	if err := c.bootstrap(startCtx, t); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("tor bootstrap error: %w", err)
+	}
+	c.setState("ready", t.Control)
+	return t, nil
+}
+
+// enable the network and report bootstrap progress until it's done.
+// same as tor.EnableNetwork but with the progress events
+func (c *TorClient) bootstrap(ctx context.Context, t *tor.Tor) error {
+	// listen first, the phase check below can't miss the 100% then
+	events := make(chan control.Event, 16)
+	if err := t.Control.AddEventListener(events, control.EventCodeStatusClient); err != nil {
+		return err
+	}
+	defer t.Control.RemoveEventListener(events, control.EventCodeStatusClient)
+
+	if err := t.Control.SetConf(control.KeyVals("DisableNetwork", "0")...); err != nil {
+		return err
+	}
+
+	// with the cached consensus tor can be done before the first event
+	if info, err := t.Control.GetInfo("status/bootstrap-phase"); err == nil && len(info) == 1 {
+		status := control.ParseStatusEvent(control.EventCodeStatusClient, info[0].Val)
+		if status.Arguments["PROGRESS"] == "100" {
+			log.Info("Tor bootstrap 100%: Done")
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- t.Control.HandleEvents(ctx) }()
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case evt := <-events:
+			status, _ := evt.(*control.StatusEvent)
+			if status == nil || status.Action != "BOOTSTRAP" {
+				continue
+			}
+			if status.Severity == "ERR" {
+				return fmt.Errorf("tor warning: %v", status.Arguments["WARNING"])
+			}
+			progress := status.Arguments["PROGRESS"]
+			if progress != last {
+				last = progress
+				log.Infof("Tor bootstrap %s%%: %s", progress, status.Arguments["SUMMARY"])
+				c.setState(fmt.Sprintf("bootstrap %s%%", progress), nil)
+			}
+			if progress == "100" {
+				return nil
+			}
+		}
+	}
+}
+
+// write bridges torrc if configured
+func (c *TorClient) setupBridges(conf *tor.StartConf) error {
+	bridges, err := LoadBridgeConf(cfg.TOR_BRIDGES_FILE, cfg.TOR_TRANSPORTS)
+	if err != nil {
+		return fmt.Errorf("tor bridges config error: %w", err)
+	}
+	if !bridges.Enabled() {
+		return nil
+	}
+	log.Infof("Using %d tor bridges", len(bridges.Bridges))
+
+	var f *os.File
+	if conf.DataDir != "" {
+		if err := os.MkdirAll(conf.DataDir, 0700); err != nil {
+			return err
+		}
+		f, err = os.OpenFile(filepath.Join(conf.DataDir, "torrc"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	} else {
+		f, err = os.CreateTemp("", "torrc-")
+		if err == nil {
+			c.torrc = f.Name()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("can't create torrc: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(bridges.Torrc()); err != nil {
+		return fmt.Errorf("can't write torrc: %w", err)
+	}
+	conf.TorrcFile = f.Name()
+	return nil
+}
@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxNameLen = 255
+
+var ErrPolicy = errors.New("file is not allowed")
+
+// what the receiver takes, checked before the offer is shown
+type Policy struct {
+	MaxSize int64    // 0 is unlimited
+	Allow   []string // extensions without the dot, empty allows any
+	Deny    []string
+	// accept without asking from peers the user has verified
+	AutoAcceptVerified bool
+}
+
+func (p Policy) Check(offer Offer) error {
+	if p.MaxSize > 0 && offer.Size > p.MaxSize {
+		return fmt.Errorf("%w: %s is over the %s limit", ErrPolicy, Size(offer.Size), Size(p.MaxSize))
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(offer.Name), "."))
+	for _, deny := range p.Deny {
+		if ext != "" && ext == strings.ToLower(deny) {
+			return fmt.Errorf("%w: .%s files are denied", ErrPolicy, ext)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, allow := range p.Allow {
+		if ext != "" && ext == strings.ToLower(allow) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: only %s files are allowed", ErrPolicy, strings.Join(p.Allow, ", "))
+}
+
+// names reserved by windows, with any extension
+var reserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// peer name made safe to show and to save:
+// no dirs, no control or bidi chars, no hidden or reserved names
+func SanitizeName(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	// both separators, the peer can be on windows
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "/" {
+		name = ""
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			// escape sequences, nul, rtl override tricks
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.Trim(b.String(), " .")
+	if name == "" {
+		return "file"
+	}
+	base := strings.SplitN(name, ".", 2)[0]
+	if reserved[strings.ToUpper(strings.TrimSpace(base))] {
+		name = "_" + name
+	}
+	return truncateName(name)
+}
+
+// keep the extension, cut the name on a rune
+func truncateName(name string) string {
+	if len(name) <= maxNameLen {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	base := name[:maxNameLen-len(ext)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + ext
+}
+
+// create an empty file with the name or the next free "name (n).ext".
+// the file is ours, a rename over it can't replace anything else
+func Reserve(dir, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i < 1000; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		p := filepath.Join(dir, candidate)
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return p, f.Close()
+	}
+	return "", fmt.Errorf("no free name for %s", name)
+}
@@ -0,0 +1,91 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"unicode", "пряность.txt", "пряность.txt"},
+		{"traversal", "../../etc/passwd", "passwd"},
+		{"windows traversal", `..\..\Windows\System32\cmd.exe`, "cmd.exe"},
+		{"absolute", "/etc/shadow", "shadow"},
+		{"dir only", "dir/", "dir"},
+		{"dot dot", "..", "file"},
+		{"dot", ".", "file"},
+		{"empty", "", "file"},
+		{"slashes only", "///", "file"},
+		{"hidden", ".bashrc", "bashrc"},
+		{"trailing dots and spaces", "  notes.txt. . ", "notes.txt"},
+		{"nul", "name\x00.txt", "name.txt"},
+		{"newline", "fake\nprompt.txt", "fakeprompt.txt"},
+		{"terminal escape", "\x1b[2J\x1b[31mred.txt", "[2J[31mred.txt"},
+		{"rtl override", "invoice‮gpj.exe", "invoicegpj.exe"},
+		{"zero width", "a​b.txt", "ab.txt"},
+		{"windows chars", `a:b*c?"d<e>f|g.txt`, "a_b_c__d_e_f_g.txt"},
+		{"reserved", "CON.txt", "_CON.txt"},
+		{"reserved lower", "nul", "_nul"},
+		{"not reserved", "CONSOLE.txt", "CONSOLE.txt"},
+		{"invalid utf8", "bad\xff\xfe.txt", "bad.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, SanitizeName(tt.in))
+		})
+	}
+
+	t.Run("long name keeps the extension", func(t *testing.T) {
+		got := SanitizeName(strings.Repeat("я", 300) + ".tar")
+		assert.LessOrEqual(t, len(got), maxNameLen)
+		assert.True(t, strings.HasSuffix(got, ".tar"))
+		assert.True(t, utf8.ValidString(got))
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	p := Policy{
+		MaxSize: 1 << 20,
+		Deny:    []string{"exe", "sh"},
+	}
+	assert.NoError(t, p.Check(Offer{Name: "photo.jpg", Size: 1000}))
+	assert.NoError(t, p.Check(Offer{Name: "README", Size: 1000}))
+	assert.ErrorIs(t, p.Check(Offer{Name: "photo.jpg", Size: 2 << 20}), ErrPolicy)
+	assert.ErrorIs(t, p.Check(Offer{Name: "setup.EXE"}), ErrPolicy, "case doesn't matter")
+	assert.ErrorIs(t, p.Check(Offer{Name: "invoice.pdf.exe"}), ErrPolicy, "last extension counts")
+
+	p.Allow = []string{"jpg", "PDF"}
+	assert.NoError(t, p.Check(Offer{Name: "scan.pdf"}))
+	assert.ErrorIs(t, p.Check(Offer{Name: "notes.txt"}), ErrPolicy)
+	assert.ErrorIs(t, p.Check(Offer{Name: "README"}), ErrPolicy)
+
+	assert.NoError(t, Policy{}.Check(Offer{Name: "any.exe", Size: 1 << 40}), "zero policy takes anything")
+}
+
+func TestReserve(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "downloads")
+	first, err := Reserve(dir, "spice.txt")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "spice.txt"), first)
+	second, err := Reserve(dir, "spice.txt")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "spice (1).txt"), second)
+	third, err := Reserve(dir, "spice.txt")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "spice (2).txt"), third)
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
@@ -0,0 +1,132 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// offer from the peer
+type Incoming struct {
+	Offer
+}
+
+// read the offer that opens the stream
+func ReadOffer(conn io.Reader) (*Incoming, error) {
+	typ, body, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if typ != frameOffer {
+		return nil, fmt.Errorf("%w: got %d instead of offer", ErrProtocol, typ)
+	}
+	offer, err := decodeOffer(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Incoming{offer}, nil
+}
+
+func Decline(conn io.Writer, reason string) error {
+	return writeFrame(conn, frameDecline, []byte(reason))
+}
+
+// receive into the partial file, it keeps the chunks between reconnects.
+// the file is complete and verified if there is no error
+func (in *Incoming) Receive(conn io.ReadWriter, partial string, progress func(done, total int64)) error {
+	if err := os.MkdirAll(filepath.Dir(partial), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	from, err := in.resume(f)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(conn, frameAccept, indexBody(from)); err != nil {
+		return err
+	}
+	if progress != nil && from > 0 {
+		progress(int64(from)*ChunkSize, in.Size)
+	}
+
+	for i := from; i < in.Chunks(); i++ {
+		typ, body, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+		if typ != frameChunk {
+			return fmt.Errorf("%w: got %d instead of chunk", ErrProtocol, typ)
+		}
+		got, err := index(body)
+		if err != nil {
+			return err
+		}
+		if got != i {
+			return fmt.Errorf("%w: chunk %d instead of %d", ErrProtocol, got, i)
+		}
+		chunk := body[8:]
+		if len(chunk) != in.chunkLen(i) {
+			return fmt.Errorf("%w: chunk %d has %d bytes", ErrProtocol, i, len(chunk))
+		}
+		if _, err := f.WriteAt(chunk, int64(i)*ChunkSize); err != nil {
+			return err
+		}
+		if err := writeFrame(conn, frameAck, indexBody(i)); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(int64(i)*ChunkSize+int64(len(chunk)), in.Size)
+		}
+	}
+
+	if err := in.verify(f); err != nil {
+		writeFrame(conn, frameDone, append([]byte{0}, err.Error()...))
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return writeFrame(conn, frameDone, []byte{1})
+}
+
+// first missing chunk, a cut chunk at the end is dropped
+func (in *Incoming) resume(f *os.File) (uint64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == in.Size {
+		return in.Chunks(), nil
+	}
+	if size > in.Size {
+		size = 0
+	}
+	have := size / ChunkSize
+	if err := f.Truncate(have * ChunkSize); err != nil {
+		return 0, err
+	}
+	return uint64(have), nil
+}
+
+func (in *Incoming) verify(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), in.Hash) {
+		return ErrHash
+	}
+	return nil
+}
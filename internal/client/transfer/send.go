@@ -0,0 +1,143 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// outgoing file, can be run again after a reconnect
+type Sender struct {
+	Offer
+	Path string
+}
+
+// hash the file and make a new offer for it
+func NewSender(path string) (*Sender, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a file", path)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{
+		Offer: Offer{
+			ID:   id,
+			Name: filepath.Base(path),
+			Size: info.Size(),
+			Hash: hash.Sum(nil),
+		},
+		Path: path,
+	}, nil
+}
+
+// offer the file and send the chunks the peer doesn't have.
+// conn is sealed by the caller, progress gets the acked bytes
+func (s *Sender) Run(conn io.ReadWriter, progress func(done, total int64)) error {
+	body, err := encodeOffer(s.Offer)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(conn, frameOffer, body); err != nil {
+		return err
+	}
+
+	// the peer can take a while to decide
+	typ, body, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case frameDecline:
+		return fmt.Errorf("%w: %s", ErrDeclined, body)
+	case frameAccept:
+	default:
+		return fmt.Errorf("%w: got %d instead of accept", ErrProtocol, typ)
+	}
+	from, err := index(body)
+	if err != nil {
+		return err
+	}
+	chunks := s.Chunks()
+	if from > chunks {
+		return fmt.Errorf("%w: peer asks for chunk %d of %d", ErrProtocol, from, chunks)
+	}
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- s.readAcks(conn, progress)
+	}()
+
+	buf := make([]byte, ChunkSize)
+	for i := from; i < chunks; i++ {
+		// peer gave up before the end, after the last chunk done is fine
+		select {
+		case err := <-result:
+			if err == nil {
+				err = fmt.Errorf("%w: done before the last chunk", ErrProtocol)
+			}
+			return err
+		default:
+		}
+		chunk := buf[:s.chunkLen(i)]
+		if _, err := f.ReadAt(chunk, int64(i)*ChunkSize); err != nil {
+			return fmt.Errorf("file has changed: %w", err)
+		}
+		if err := writeFrame(conn, frameChunk, append(indexBody(i), chunk...)); err != nil {
+			return err
+		}
+	}
+	return <-result
+}
+
+// acks and the final verdict
+func (s *Sender) readAcks(conn io.Reader, progress func(done, total int64)) error {
+	for {
+		typ, body, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case frameAck:
+			i, err := index(body)
+			if err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(int64(i)*ChunkSize+int64(s.chunkLen(i)), s.Size)
+			}
+		case frameDone:
+			if len(body) > 0 && body[0] == 1 {
+				return nil
+			}
+			if len(body) > 1 && string(body[1:]) == ErrHash.Error() {
+				return ErrHash
+			}
+			return fmt.Errorf("peer has failed the transfer: %s", body[1:])
+		default:
+			return fmt.Errorf("%w: got %d instead of ack", ErrProtocol, typ)
+		}
+	}
+}
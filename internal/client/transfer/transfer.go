@@ -0,0 +1,157 @@
+// Transfer sends a file over its own stream.
+//
+// The sender offers the file with name, size and sha256. The stream is
+// sealed by the caller with streamcrypt, a new key for every run, so nothing
+// here is encrypted again. The receiver accepts from the first chunk it
+// doesn't have yet, so a transfer cut by a reconnect goes on where it
+// stopped. The whole file hash is checked at the end.
+//
+// Frames are the ones of the frame package.
+package transfer
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/1F47E/go-shaihulud/internal/client/frame"
+)
+
+const (
+	ChunkSize = 32 << 10
+	frameMax  = ChunkSize + 1024
+)
+
+type frameType byte
+
+const (
+	frameOffer   frameType = iota + 1 // offer json
+	frameAccept                       // first chunk to send
+	frameDecline                      // reason
+	frameChunk                        // chunk index | data
+	frameAck                          // chunk index is written
+	frameDone                         // 1 byte ok | reason
+)
+
+var (
+	ErrDeclined = errors.New("file is declined")
+	ErrHash     = errors.New("file hash doesn't match")
+	ErrProtocol = errors.New("file transfer protocol error")
+)
+
+type Offer struct {
+	ID   string
+	Name string
+	Size int64
+	Hash []byte // sha256
+}
+
+// first 8 chars, enough to pick an offer
+func (o Offer) ShortID() string {
+	if len(o.ID) < 8 {
+		return o.ID
+	}
+	return o.ID[:8]
+}
+
+func (o Offer) Chunks() uint64 {
+	return uint64((o.Size + ChunkSize - 1) / ChunkSize)
+}
+
+// size of the chunk, the last one can be shorter
+func (o Offer) chunkLen(index uint64) int {
+	if rest := o.Size - int64(index)*ChunkSize; rest < ChunkSize {
+		return int(rest)
+	}
+	return ChunkSize
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func encodeOffer(offer Offer) ([]byte, error) {
+	return json.Marshal(offer)
+}
+
+func decodeOffer(body []byte) (Offer, error) {
+	var offer Offer
+	if err := json.Unmarshal(body, &offer); err != nil {
+		return offer, fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	// id names the partial file, only our own format is accepted
+	if id, err := hex.DecodeString(offer.ID); err != nil || len(id) != 16 {
+		return offer, fmt.Errorf("%w: bad offer id", ErrProtocol)
+	}
+	if offer.Size < 0 || len(offer.Hash) != 32 {
+		return offer, fmt.Errorf("%w: bad offer", ErrProtocol)
+	}
+	// the name is shown and saved, never trust it
+	offer.Name = SanitizeName(offer.Name)
+	return offer, nil
+}
+
+func writeFrame(w io.Writer, typ frameType, body []byte) error {
+	return frame.Write(w, byte(typ), body)
+}
+
+func readFrame(r io.Reader) (frameType, []byte, error) {
+	typ, body, err := frame.Read(r, frameMax)
+	if errors.Is(err, frame.ErrTooLarge) {
+		err = fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	return frameType(typ), body, err
+}
+
+func index(body []byte) (uint64, error) {
+	if len(body) < 8 {
+		return 0, fmt.Errorf("%w: short frame", ErrProtocol)
+	}
+	return binary.BigEndian.Uint64(body), nil
+}
+
+func indexBody(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
+
+// [=====     ] 50%
+func Bar(done, total int64, width int) string {
+	percent := 100
+	if total > 0 {
+		percent = int(done * 100 / total)
+	}
+	filled := percent * width / 100
+	bar := make([]byte, width)
+	for i := range bar {
+		if i < filled {
+			bar[i] = '='
+		} else {
+			bar[i] = ' '
+		}
+	}
+	return fmt.Sprintf("[%s] %3d%%", bar, percent)
+}
+
+// 1.5 MB
+func Size(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,132 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFile(t *testing.T, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path, data
+}
+
+// run both sides over a pipe, returns both errors and the first progress
+func run(t *testing.T, s *Sender, partial string, accept bool) (error, error, int64) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.Run(a, nil)
+	}()
+
+	in, err := ReadOffer(b)
+	require.NoError(t, err)
+	assert.Equal(t, s.Offer, in.Offer)
+	if !accept {
+		require.NoError(t, Decline(b, "no thanks"))
+		return <-sent, nil, 0
+	}
+	var first int64 = -1
+	err = in.Receive(b, partial, func(done, total int64) {
+		if first < 0 {
+			first = done
+		}
+	})
+	return <-sent, err, first
+}
+
+func TestTransfer(t *testing.T) {
+	path, data := newFile(t, 3*ChunkSize+100)
+	s, err := NewSender(path)
+	require.NoError(t, err)
+	assert.Equal(t, "report.pdf", s.Name)
+	assert.Equal(t, uint64(4), s.Chunks())
+	partial := filepath.Join(t.TempDir(), ".partial", s.ID)
+
+	sendErr, recvErr, _ := run(t, s, partial, true)
+	require.NoError(t, sendErr)
+	require.NoError(t, recvErr)
+	got, err := os.ReadFile(partial)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got))
+
+	t.Run("resume from the last chunk on disk", func(t *testing.T) {
+		partial := filepath.Join(t.TempDir(), s.ID)
+		// two chunks and a cut one from the last run
+		require.NoError(t, os.WriteFile(partial, data[:2*ChunkSize+10], 0600))
+		sendErr, recvErr, first := run(t, s, partial, true)
+		require.NoError(t, sendErr)
+		require.NoError(t, recvErr)
+		assert.Equal(t, int64(2*ChunkSize), first, "starts after the chunks it has")
+		got, err := os.ReadFile(partial)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got))
+	})
+
+	t.Run("corrupted partial fails the hash", func(t *testing.T) {
+		partial := filepath.Join(t.TempDir(), s.ID)
+		bad := append([]byte(nil), data[:ChunkSize]...)
+		bad[0] ^= 0xff
+		require.NoError(t, os.WriteFile(partial, bad, 0600))
+		sendErr, recvErr, _ := run(t, s, partial, true)
+		assert.ErrorIs(t, recvErr, ErrHash)
+		assert.ErrorIs(t, sendErr, ErrHash)
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		sendErr, _, _ := run(t, s, "", false)
+		assert.ErrorIs(t, sendErr, ErrDeclined)
+		assert.Contains(t, sendErr.Error(), "no thanks")
+	})
+}
+
+func TestEmptyFile(t *testing.T) {
+	path, _ := newFile(t, 0)
+	s, err := NewSender(path)
+	require.NoError(t, err)
+	partial := filepath.Join(t.TempDir(), s.ID)
+	sendErr, recvErr, _ := run(t, s, partial, true)
+	require.NoError(t, sendErr)
+	require.NoError(t, recvErr)
+}
+
+func TestOfferChecks(t *testing.T) {
+	path, _ := newFile(t, 10)
+	s, err := NewSender(path)
+	require.NoError(t, err)
+	body, err := encodeOffer(s.Offer)
+	require.NoError(t, err)
+	got, err := decodeOffer(body)
+	require.NoError(t, err)
+	assert.Equal(t, s.Offer, got)
+
+	_, err = decodeOffer([]byte("not json"))
+	assert.ErrorIs(t, err, ErrProtocol)
+
+	// id becomes a file name on the receiver
+	evil := s.Offer
+	evil.ID = "../../../../etc/passwd"
+	body, err = encodeOffer(evil)
+	require.NoError(t, err)
+	_, err = decodeOffer(body)
+	assert.ErrorIs(t, err, ErrProtocol)
+}
+
+func TestBar(t *testing.T) {
+	assert.Equal(t, "[=====     ]  50%", Bar(50, 100, 10))
+	assert.Equal(t, "[==========] 100%", Bar(0, 0, 10))
+	assert.Equal(t, "1.5 KB", Size(1536))
+	assert.Equal(t, "10 B", Size(10))
+}
@@ -0,0 +1,103 @@
+package client_unix
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// local IPC over a unix socket, only the owner can connect
+type UnixClient struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func New(ctx context.Context, cancel context.CancelFunc) *UnixClient {
+	return &UnixClient{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// address is a socket file path
+func (c *UnixClient) RunServer(address string, _ []byte) (net.Listener, error) {
+	if err := removeStale(address); err != nil {
+		return nil, err
+	}
+	// bind in a private dir, nobody can connect before the chmod.
+	// then move it in place, same dir so it's the same filesystem
+	dir, err := os.MkdirTemp(filepath.Dir(address), ".sock-")
+	if err != nil {
+		return nil, fmt.Errorf("socket dir error: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	// restrict access to the current user
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("socket chmod error: %w", err)
+	}
+	if err := os.Rename(tmp, address); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("socket rename error: %w", err)
+	}
+	return &listener{Listener: ln, path: address}, nil
+}
+
+// removes the socket at the final path, the net one only knows the temp one
+type listener struct {
+	net.Listener
+	path string
+}
+
+func (l *listener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	if err == nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+func (c *UnixClient) RunClient(address string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(c.ctx, "unix", address)
+	if err != nil {
+		return nil, fmt.Errorf("RunClient connection error: %w", err)
+	}
+	return conn, nil
+}
+
+// socket file is removed by the listener on close
+func (c *UnixClient) Close() error {
+	return nil
+}
+
+// socket file left after a crash blocks the listen
+func removeStale(address string) error {
+	info, err := os.Stat(address)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", address)
+	}
+	if conn, err := net.Dial("unix", address); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", address)
+	}
+	return os.Remove(address)
+}
@@ -0,0 +1,85 @@
+package client_unix
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := New(ctx, cancel)
+	path := filepath.Join(t.TempDir(), "chat.sock")
+
+	t.Run("connect and permissions", func(t *testing.T) {
+		ln, err := c.RunServer(path, nil)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		assert.Equal(t, path, ln.Addr().String())
+		// the private bind dir is gone
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+
+		conn, err := c.RunClient(path)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(reply))
+
+		// second server on the same socket
+		_, err = c.RunServer(path, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("stale socket is removed", func(t *testing.T) {
+		// leave the socket file behind like after a crash
+		ln, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+
+		ln, err = c.RunServer(path, nil)
+		require.NoError(t, err)
+		ln.Close()
+		assert.NoFileExists(t, path, "removed on close")
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(file, nil, 0600))
+		_, err := c.RunServer(file, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("no server", func(t *testing.T) {
+		_, err := c.RunClient(filepath.Join(t.TempDir(), "nope.sock"))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// the key confirmation proves the peer knows the password, not who it is.
+// both sides hash the two handshake keys to the same safety code,
+// users compare it over another channel and /verify the peer.
+// a man in the middle has his own keys on each side and the codes differ
+type fingerprint [sha256.Size]byte
+
+func newFingerprint(ours, theirs []byte) fingerprint {
+	a, b := ours, theirs
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha256.New()
+	h.Write(a)
+	h.Write(b)
+	var f fingerprint
+	copy(f[:], h.Sum(nil))
+	return f
+}
+
+// first 6 bytes as AB12-CD34-EF56
+func (f fingerprint) Code() string {
+	hex := fmt.Sprintf("%X", f[:6])
+	return strings.Join([]string{hex[0:4], hex[4:8], hex[8:12]}, "-")
+}
+
+// keys of our first keypair and the peer one from the handshake.
+// rekeys don't change it, the new keys come with a mac over the old ones
+func (c *Client) fingerprint(p *peer) fingerprint {
+	return newFingerprint(c.crypter.PubKey(), p.user.ConfirmedKey())
+}
+
+func (c *Client) verified(p *peer) bool {
+	f := c.fingerprint(p)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.trusted[f]
+}
+
+// safety code to compare with the peer, empty if there is no such peer
+func (c *Client) SafetyCode(name string) string {
+	for _, p := range c.readyPeers() {
+		if p.user.Name == name {
+			return c.fingerprint(p).Code()
+		}
+	}
+	return ""
+}
+
+// mark the peer as verified after the users compared the safety code.
+// kept for the run, a reconnect with the same keys stays verified
+func (c *Client) Verify(name string) bool {
+	for _, p := range c.readyPeers() {
+		if p.user.Name == name {
+			f := c.fingerprint(p)
+			c.mu.Lock()
+			c.trusted[f] = true
+			c.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
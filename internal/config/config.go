@@ -1,7 +1,116 @@
 package config
 
+import (
+	"path/filepath"
+	"time"
+)
+
 var ADDR = "localhost:3000"
+
+// wait for the peer to ack our disconnect
+var DISC_TIMEOUT = envDuration("DISC_TIMEOUT", 2*time.Second)
+
+// ping idle peers, drop the link after HEARTBEAT_MAX_MISSED pings without a reply.
+// tor circuits can die silently
+var HEARTBEAT_INTERVAL = envDuration("HEARTBEAT_INTERVAL", 15*time.Second)
+var HEARTBEAT_MAX_MISSED = envInt("HEARTBEAT_MAX_MISSED", 3)
+
+// resend unacked messages after the timeout, give up after MAX_RETRANSMIT tries
+var RETRANSMIT_TIMEOUT = envDuration("RETRANSMIT_TIMEOUT", 10*time.Second)
+var MAX_RETRANSMIT = envInt("MAX_RETRANSMIT", 3)
+
+// rotate the session keys after this many chat messages, bytes or time, 0 is off.
+// /rekey rotates them right away
+var REKEY_MESSAGES = envInt("REKEY_MESSAGES", 1000)
+var REKEY_BYTES = envInt("REKEY_BYTES", 10<<20)
+var REKEY_INTERVAL = envInterval("REKEY_INTERVAL", time.Hour)
+
+// send one chat frame every COVER_INTERVAL, a dummy one if there is nothing to say.
+// hides when the chat happens, 0 is off
+var COVER_INTERVAL = envInterval("COVER_INTERVAL", 0)
+
+// server admission policy
+var MAX_PEERS = envInt("MAX_PEERS", 0) // 0 is unlimited
+// 1:1 chat, only the first peer can connect (and reconnect).
+// the lock is taken by the first peer that passed the key confirmation.
+// it is on the peer key, made fresh on every start, so a restarted
+// peer is locked out too until the server restarts
+var LOCK_AFTER_FIRST = envBool("LOCK_AFTER_FIRST", false)
+var HANDSHAKE_TIMEOUT = envDuration("HANDSHAKE_TIMEOUT", 30*time.Second)
+
+// temporary ban after MAX_FAILURES failed handshakes or malformed frames within FAILURE_WINDOW.
+// connections without a remote host wait longer and longer instead
+var MAX_FAILURES = envInt("MAX_FAILURES", 5)
+var FAILURE_WINDOW = envDuration("FAILURE_WINDOW", time.Minute)
+var BAN_DURATION = envDuration("BAN_DURATION", 5*time.Minute)
+
+// proof of work puzzle before the handshake, difficulty in bits, 0 is off.
+// grows with the number of pending handshakes up to the max
+var POW_DIFFICULTY = envInt("POW_DIFFICULTY", 0)
+var POW_MAX_DIFFICULTY = envInt("POW_MAX_DIFFICULTY", 24)
+
+// tor, local, socks or unix. TOR=0 is the same as local
+var CONNECTOR = envString("CONNECTOR", "tor")
+
+// socket path for the unix connector
+var UNIX_SOCKET = envString("UNIX_SOCKET", "shaihulud.sock")
 var MSG_MAX_SIZE = 1024
-var CLIENT_MAX_RETRY = 5
+
+// reconnect on connection drop with exponential backoff
+var CLIENT_MAX_RETRY = envInt("CLIENT_MAX_RETRY", 5)
+var RECONNECT_DELAY = envDuration("RECONNECT_DELAY", time.Second)
+var RECONNECT_MAX_DELAY = envDuration("RECONNECT_MAX_DELAY", 30*time.Second)
+
+// full screen chat when stdout is a terminal, 0 is the line mode
+var TUI = envBool("TUI", true)
 
 const SESSION_DIR = "sessions"
+
+// server session name, keeps the onion address between restarts.
+// created on the first run
+var SESSION = envString("SESSION", "")
+
+// undelivered messages are kept encrypted on disk, per session
+var OUTBOX = envBool("OUTBOX", true)
+var OUTBOX_DIR = envString("OUTBOX_DIR", filepath.Join(SESSION_DIR, "outbox"))
+
+// received files, unfinished ones wait in the .partial dir inside
+var DOWNLOAD_DIR = envString("DOWNLOAD_DIR", "downloads")
+
+// offers over the size or with a denied extension are declined without asking.
+// FILE_ALLOW_EXT limits the extensions when set, FILE_MAX_SIZE 0 is unlimited
+var FILE_MAX_SIZE = envInt("FILE_MAX_SIZE", 1<<30)
+var FILE_ALLOW_EXT = envStrings("FILE_ALLOW_EXT", nil)
+var FILE_DENY_EXT = envStrings("FILE_DENY_EXT", []string{"exe", "msi", "bat", "cmd", "com", "scr", "ps1", "vbs", "jar", "lnk", "app", "apk", "dmg"})
+
+// accept offers without /accept, only from peers checked with /verify.
+// the key confirmation only proves the peer knows the password
+var FILE_AUTO_ACCEPT_VERIFIED = envBool("FILE_AUTO_ACCEPT_VERIFIED", false)
+
+// port forwarding, host:port patterns, * is any host or port. empty allows nothing.
+// FORWARD_ALLOW is what the peer -L can reach through us,
+// FORWARD_LISTEN is where the peer -R can listen on our side
+var FORWARD_ALLOW = envStrings("FORWARD_ALLOW", nil)
+var FORWARD_LISTEN = envStrings("FORWARD_LISTEN", nil)
+var FORWARD_DIAL_TIMEOUT = envDuration("FORWARD_DIAL_TIMEOUT", 10*time.Second)
+
+// TOR
+// persistent data dir keeps the cached consensus between runs, so tor starts faster
+var TOR_DATA_DIR = envString("TOR_DATA_DIR", "tor-data")
+
+// ephemeral mode uses a temp data dir that is removed on exit
+var TOR_EPHEMERAL = envBool("TOR_EPHEMERAL", false)
+
+var TOR_START_TIMEOUT = envDuration("TOR_START_TIMEOUT", 3*time.Minute)
+var TOR_DIAL_TIMEOUT = envDuration("TOR_DIAL_TIMEOUT", time.Minute)
+
+// bridges file has torrc bridge lines, one per line.
+// transports are plugin binaries: obfs4=/usr/bin/obfs4proxy,snowflake=/usr/bin/snowflake-client
+var TOR_BRIDGES_FILE = envString("TOR_BRIDGES_FILE", "")
+var TOR_TRANSPORTS = envString("TOR_TRANSPORTS", "")
+
+// SOCKS5 proxy for the socks connector, default is the system tor daemon
+var PROXY_ADDR = envString("PROXY_ADDR", "127.0.0.1:9050")
+var PROXY_USER = envString("PROXY_USER", "")
+var PROXY_PASSWORD = envString("PROXY_PASSWORD", "")
+var PROXY_DIAL_TIMEOUT = envDuration("PROXY_DIAL_TIMEOUT", time.Minute)
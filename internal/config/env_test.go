@@ -0,0 +1,28 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		duration time.Duration
+		interval time.Duration
+	}{
+		{"", time.Second, time.Second},
+		{"30s", 30 * time.Second, 30 * time.Second},
+		{"nope", time.Second, time.Second},
+		{"-5s", time.Second, time.Second},
+		{"0", time.Second, 0},
+		{"0s", time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_DURATION", tt.value)
+		assert.Equal(t, tt.duration, envDuration("TEST_DURATION", time.Second), "duration %q", tt.value)
+		assert.Equal(t, tt.interval, envInterval("TEST_DURATION", time.Second), "interval %q", tt.value)
+	}
+}
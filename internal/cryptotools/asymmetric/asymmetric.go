@@ -5,4 +5,5 @@ type Asymmetric interface {
 	Encrypt([]byte, []byte) ([]byte, error)
 	Decrypt([]byte) ([]byte, error)
 	PubKey() []byte
+	ValidateKey([]byte) error // check the peer public key before using it
 }
@@ -0,0 +1,118 @@
+// Rotating crypter for rekeying a live session.
+//
+// After Rotate the new keypair is used for our public key,
+// the previous one still decrypts messages the peer has sent
+// before it switched. The previous key is dropped and zeroed
+// as soon as the peer uses the new one.
+package rotating
+
+import (
+	"sync"
+
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+)
+
+// keys that can wipe their private part
+type zeroer interface {
+	Zero()
+}
+
+type Crypter struct {
+	mu       sync.RWMutex
+	keygen   func() (asymmetric.Asymmetric, error)
+	current  asymmetric.Asymmetric
+	previous asymmetric.Asymmetric
+	owned    bool // current key is ours to zero, the initial one is shared
+}
+
+func New(initial asymmetric.Asymmetric, keygen func() (asymmetric.Asymmetric, error)) *Crypter {
+	return &Crypter{keygen: keygen, current: initial}
+}
+
+func (c *Crypter) Encrypt(data, pubKey []byte) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current.Encrypt(data, pubKey)
+}
+
+// try the new key first, the peer may not have switched yet.
+// the keys are only zeroed under the write lock, so not while they decrypt
+func (c *Crypter) Decrypt(data []byte) ([]byte, error) {
+	c.mu.RLock()
+	plain, err := c.current.Decrypt(data)
+	prev := c.previous
+	if err != nil && prev != nil {
+		plain, err = prev.Decrypt(data)
+		c.mu.RUnlock()
+		return plain, err
+	}
+	c.mu.RUnlock()
+	if err == nil && prev != nil {
+		c.dropPrevious(prev)
+	}
+	return plain, err
+}
+
+// 0 if the keys don't tell
+func (c *Crypter) MaxSize() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, ok := c.current.(interface{ MaxSize() int }); ok {
+		return s.MaxSize()
+	}
+	return 0
+}
+
+func (c *Crypter) PubKey() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current.PubKey()
+}
+
+func (c *Crypter) ValidateKey(pubKey []byte) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current.ValidateKey(pubKey)
+}
+
+// new keypair, the previous one is kept until the peer switches
+func (c *Crypter) Rotate() error {
+	next, err := c.keygen()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.zero(c.previous)
+	if c.owned {
+		c.previous = c.current
+	} else {
+		// shared with other peers, just forget it
+		c.previous = nonZero{c.current}
+	}
+	c.current = next
+	c.owned = true
+	return nil
+}
+
+// peer uses the new key. a rotate since then has made another previous, it stays
+func (c *Crypter) dropPrevious(prev asymmetric.Asymmetric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.previous != prev {
+		return
+	}
+	c.zero(c.previous)
+	c.previous = nil
+}
+
+func (c *Crypter) zero(key asymmetric.Asymmetric) {
+	if z, ok := key.(zeroer); ok {
+		z.Zero()
+	}
+}
+
+// hides Zero of a shared key
+type nonZero struct {
+	asymmetric.Asymmetric
+}
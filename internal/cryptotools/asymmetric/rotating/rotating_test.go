@@ -0,0 +1,113 @@
+package rotating
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric"
+	myrsa "github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rsa"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func keygen() (asymmetric.Asymmetric, error) {
+	return myrsa.New()
+}
+
+func TestRotate(t *testing.T) {
+	shared, err := myrsa.New()
+	require.NoError(t, err)
+	c := New(shared, keygen)
+	oldKey := c.PubKey()
+	assert.Equal(t, shared.PubKey(), oldKey)
+
+	// peer has sent this before it got our new key
+	before, err := c.Encrypt([]byte("before"), oldKey)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Rotate())
+	newKey := c.PubKey()
+	assert.NotEqual(t, oldKey, newKey)
+
+	plain, err := c.Decrypt(before)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("before"), plain)
+
+	after, err := c.Encrypt([]byte("after"), newKey)
+	require.NoError(t, err)
+	plain, err = c.Decrypt(after)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("after"), plain)
+
+	// peer has switched, the old key is gone
+	_, err = c.Decrypt(before)
+	assert.Error(t, err)
+
+	// shared key is not zeroed, other peers still use it
+	plain, err = shared.Decrypt(before)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("before"), plain)
+}
+
+func TestRotateZeroesOwnKeys(t *testing.T) {
+	shared, err := myrsa.New()
+	require.NoError(t, err)
+	var generated []*myrsa.RsaCrypter
+	c := New(shared, func() (asymmetric.Asymmetric, error) {
+		k, err := myrsa.New()
+		generated = append(generated, k)
+		return k, err
+	})
+	require.NoError(t, c.Rotate())
+	first := c.PubKey()
+	msg, err := c.Encrypt([]byte("x"), first)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Rotate())
+	require.NoError(t, c.Rotate())
+	// the first generated key was previous and got zeroed on the next rotation
+	_, err = generated[0].Decrypt(msg)
+	assert.Error(t, err)
+}
+
+// frames for the old key are still decrypted while two rotations go by,
+// a key is never zeroed in the middle of a decrypt
+func TestRotateWhileDecrypting(t *testing.T) {
+	shared, err := myrsa.New()
+	require.NoError(t, err)
+	c := New(shared, keygen)
+	require.NoError(t, c.Rotate())
+	old := c.PubKey()
+	var frames [][]byte
+	for i := 0; i < 8; i++ {
+		frame, err := c.Encrypt([]byte(fmt.Sprint(i)), old)
+		require.NoError(t, err)
+		frames = append(frames, frame)
+	}
+
+	rotated := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, frame := range frames {
+		wg.Add(1)
+		go func(i int, frame []byte) {
+			defer wg.Done()
+			for {
+				// gone after the second rotation, but never wrong
+				if plain, err := c.Decrypt(frame); err == nil {
+					assert.Equal(t, fmt.Sprint(i), string(plain))
+				}
+				select {
+				case <-rotated:
+					return
+				default:
+				}
+			}
+		}(i, frame)
+	}
+	require.NoError(t, c.Rotate())
+	require.NoError(t, c.Rotate())
+	close(rotated)
+	wg.Wait()
+}
@@ -1,12 +1,24 @@
 package myrsa
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
 )
 
+const keySize = 2048
+
+// oaep with sha256 takes 2 hashes and 2 bytes of the key size.
+// peer keys are not shorter than ours, so it fits any of them
+const MaxPlaintext = keySize/8 - 2*sha256.Size - 2
+
+var ErrOwnKey = errors.New("peer has sent our own key")
+
 // MSG RSA encryption
 // implementation of interfaces.Asymmetric interface
 
@@ -16,7 +28,7 @@ type RsaCrypter struct {
 }
 
 func New() (*RsaCrypter, error) {
-	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privKey, err := rsa.GenerateKey(rand.Reader, keySize)
 	// log.Printf("rsa private key: %x\n", privateKey)
 	if err != nil {
 		return nil, err
@@ -50,7 +62,60 @@ func (r *RsaCrypter) Decrypt(data []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// largest message Encrypt takes
+func (r *RsaCrypter) MaxSize() int {
+	return MaxPlaintext
+}
+
 // get pub key as bytes to send over network
 func (r *RsaCrypter) PubKey() []byte {
 	return x509.MarshalPKCS1PublicKey(r.pubKey)
 }
+
+// peer key must be a PKCS1 RSA key not weaker than ours
+func (r *RsaCrypter) ValidateKey(pubKeyBytes []byte) error {
+	pubKey, err := x509.ParsePKCS1PublicKey(pubKeyBytes)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	if pubKey.N.BitLen() < keySize {
+		return fmt.Errorf("public key is too short: %d bits", pubKey.N.BitLen())
+	}
+	// reflected key, someone in the middle plays both sides
+	if bytes.Equal(pubKeyBytes, r.PubKey()) {
+		return ErrOwnKey
+	}
+	return nil
+}
+
+// wipe the private key, the crypter is useless after that.
+// crypto/rsa keeps its own copy for the fips code, it is not reachable from here
+func (r *RsaCrypter) Zero() {
+	k := r.privKey
+	wipe(k.D)
+	for _, p := range k.Primes {
+		wipe(p)
+	}
+	wipe(k.Precomputed.Dp)
+	wipe(k.Precomputed.Dq)
+	wipe(k.Precomputed.Qinv)
+	for _, v := range k.Precomputed.CRTValues {
+		wipe(v.Exp)
+		wipe(v.Coeff)
+		wipe(v.R)
+	}
+	k.Precomputed = rsa.PrecomputedValues{}
+}
+
+// SetInt64 only shortens the number, the old words stay in the backing array
+func wipe(n *big.Int) {
+	if n == nil {
+		return
+	}
+	words := n.Bits()
+	words = words[:cap(words)]
+	for i := range words {
+		words[i] = 0
+	}
+	n.SetInt64(0)
+}
@@ -1,6 +1,7 @@
 package myrsa
 
 import (
+	"math/big"
 	"testing"
 
 	msgcrypter "github.com/1F47E/go-shaihulud/internal/cryptotools/msgcrypter"
@@ -30,4 +31,45 @@ func TestRSACrypter(t *testing.T) {
 		require.Equal(t, message, plain, "Original and decoded message do not match")
 	})
 
+	t.Run("Test Validate Key", func(t *testing.T) {
+		peer, err := New()
+		require.NoError(t, err)
+		require.NoError(t, rsa.ValidateKey(peer.PubKey()))
+
+		require.ErrorIs(t, rsa.ValidateKey(rsa.PubKey()), ErrOwnKey)
+		require.Error(t, rsa.ValidateKey(nil))
+		require.Error(t, rsa.ValidateKey([]byte("not a key")))
+		require.Error(t, rsa.ValidateKey(peer.PubKey()[:100]), "truncated key")
+	})
+
+	t.Run("Test Max Size", func(t *testing.T) {
+		_, err := rsa.Encrypt(make([]byte, rsa.MaxSize()), rsa.PubKey())
+		require.NoError(t, err)
+		_, err = rsa.Encrypt(make([]byte, rsa.MaxSize()+1), rsa.PubKey())
+		require.Error(t, err)
+	})
+
+}
+
+func TestZero(t *testing.T) {
+	r, err := New()
+	require.NoError(t, err)
+	k := r.privKey
+	secrets := []*big.Int{k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv}
+	secrets = append(secrets, k.Primes...)
+	var words [][]big.Word
+	for _, n := range secrets {
+		require.NotNil(t, n)
+		w := n.Bits()
+		words = append(words, w[:cap(w)])
+	}
+
+	r.Zero()
+	for i, w := range words {
+		for _, v := range w {
+			require.Zero(t, v, "secret %d is not wiped", i)
+		}
+	}
+	_, err = r.Decrypt(make([]byte, keySize/8))
+	require.Error(t, err)
 }
@@ -21,6 +21,7 @@ package auth
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	mrand "math/rand"
 	"os"
@@ -34,6 +35,11 @@ import (
 
 var SESSION_DIR = config.SESSION_DIR
 
+var (
+	ErrWrongPassword = errors.New("wrong password")
+	ErrMalformedKey  = errors.New("malformed access key")
+)
+
 // NOTE:
 // for the access key we encode onion pub key (32 bytes) to hex format
 // for our session file we encode onion priv key without encryption
@@ -106,19 +112,23 @@ func NewFromKey(crypter symmetric.Symmetric, accessKey, password string) (*Auth,
 	// decode string key to bytes
 	keyBytesCipher, err := Decode(accessKey)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrMalformedKey, err)
 	}
 
-	// decrypt key bytes with password
+	// decrypt key bytes with password.
+	// a typo in the key fails the same way, it is authenticated with the password
 	keyBytes, err := crypter.Decrypt(keyBytesCipher, password)
 	if err != nil {
-		return nil, err
+		if strings.Contains(err.Error(), "authentication failed") {
+			return nil, ErrWrongPassword
+		}
+		return nil, fmt.Errorf("%w: %w", ErrMalformedKey, err)
 	}
 
 	// version of onion without priv key, only pub key to connect to
 	onion, err := onion.NewFromPubKey(keyBytes)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrMalformedKey, err)
 	}
 	a := Auth{
 		crypter:   crypter,
@@ -176,6 +186,11 @@ func (a *Auth) String() string {
 
 // save to a session file
 func (a *Auth) Save() error {
+	return a.SaveAs(a.accessKey)
+}
+
+// save to a session file with a given name
+func (a *Auth) SaveAs(name string) error {
 
 	data := a.onioner.PrivKey()
 	if len(data) == 0 {
@@ -187,8 +202,8 @@ func (a *Auth) Save() error {
 	if err != nil {
 		return err
 	}
-	path := filepath.Join(SESSION_DIR, a.accessKey)
-	f, err := os.Create(path)
+	path := filepath.Join(SESSION_DIR, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
@@ -200,6 +215,11 @@ func (a *Auth) Save() error {
 	return nil
 }
 
+func SessionExists(name string) bool {
+	_, err := os.Stat(filepath.Join(SESSION_DIR, name))
+	return err == nil
+}
+
 // ETC
 // len is 9 bytes
 // TODO: make a test
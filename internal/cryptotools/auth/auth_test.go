@@ -47,3 +47,14 @@ func TestOnionFromKey(t *testing.T) {
 	assert.NoError(t, err, "Error creating new Auth instance")
 	assert.Equal(t, auth.OnionAddress(), expected_onion)
 }
+
+func TestOnionFromKeyErrors(t *testing.T) {
+	key := "AF3EAFDE09FBA80741034641180F13E029B056BC5F7440598EAC2EBFFE894D6C51D5263782D957FC95A856E1469159BFC97228448D2BF5F2DC896CE25758EF742235A7CEA5032C3F0B0B8A78EB8B08BA7D036E436F563078E660ED46"
+	crypter := myaes.New()
+	_, err := NewFromKey(crypter, key, "0000-0000")
+	assert.ErrorIs(t, err, ErrWrongPassword)
+	_, err = NewFromKey(crypter, "not a key", "F2A6-D23A")
+	assert.ErrorIs(t, err, ErrMalformedKey)
+	_, err = NewFromKey(crypter, "AF3E", "F2A6-D23A")
+	assert.ErrorIs(t, err, ErrMalformedKey, "too short")
+}
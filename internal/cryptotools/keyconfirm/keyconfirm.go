@@ -0,0 +1,70 @@
+// Key confirmation after the public key exchange.
+//
+// Each side sends a random challenge encrypted with the peer public key.
+// The peer decrypts it and replies with HMAC(challenge | secret, transcript),
+// where the transcript is the hash of both public keys.
+// A valid proof means the peer holds the private key, got our key intact
+// and knows the session password.
+package keyconfirm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+const ChallengeSize = 32
+
+var ErrMismatch = errors.New("key confirmation failed: keys or password don't match")
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func Proof(challenge, secret, ourKey, peerKey []byte) []byte {
+	key := append(append([]byte(nil), challenge...), secret...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(transcript(ourKey, peerKey))
+	return mac.Sum(nil)
+}
+
+func Verify(proof, challenge, secret, ourKey, peerKey []byte) error {
+	if !hmac.Equal(proof, Proof(challenge, secret, ourKey, peerKey)) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// same on both sides, keys are sorted
+func transcript(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha256.New()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// proves the new key comes from the same peer and the session password.
+// oldKey is the sender key the receiver knows
+func RekeyMAC(secret, oldKey, newKey []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("rekey"))
+	mac.Write(oldKey)
+	mac.Write(newKey)
+	return mac.Sum(nil)
+}
+
+func VerifyRekey(sum, secret, oldKey, newKey []byte) error {
+	if !hmac.Equal(sum, RekeyMAC(secret, oldKey, newKey)) {
+		return ErrMismatch
+	}
+	return nil
+}
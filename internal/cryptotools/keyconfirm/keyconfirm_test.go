@@ -0,0 +1,38 @@
+package keyconfirm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyConfirm(t *testing.T) {
+	alice, bob := []byte("alice key"), []byte("bob key")
+	secret := []byte("ABCD-1234")
+
+	challenge, err := NewChallenge()
+	require.NoError(t, err)
+	require.Len(t, challenge, ChallengeSize)
+
+	// bob answers alice's challenge
+	proof := Proof(challenge, secret, bob, alice)
+	assert.NoError(t, Verify(proof, challenge, secret, alice, bob))
+
+	assert.ErrorIs(t, Verify(proof, challenge, []byte("wrong"), alice, bob), ErrMismatch, "password")
+	assert.ErrorIs(t, Verify(proof, challenge, secret, alice, []byte("mitm key")), ErrMismatch, "swapped key")
+	assert.ErrorIs(t, Verify(proof, challenge, secret, alice[:3], bob), ErrMismatch, "truncated key")
+	other, err := NewChallenge()
+	require.NoError(t, err)
+	assert.ErrorIs(t, Verify(proof, other, secret, alice, bob), ErrMismatch, "challenge")
+	assert.ErrorIs(t, Verify(nil, challenge, secret, alice, bob), ErrMismatch)
+}
+
+func TestRekeyMAC(t *testing.T) {
+	secret := []byte("ABCD-1234")
+	sum := RekeyMAC(secret, []byte("old"), []byte("new"))
+	assert.NoError(t, VerifyRekey(sum, secret, []byte("old"), []byte("new")))
+	assert.ErrorIs(t, VerifyRekey(sum, []byte("wrong"), []byte("old"), []byte("new")), ErrMismatch)
+	assert.ErrorIs(t, VerifyRekey(sum, secret, []byte("other"), []byte("new")), ErrMismatch)
+	assert.ErrorIs(t, VerifyRekey(sum, secret, []byte("old"), []byte("evil")), ErrMismatch)
+}
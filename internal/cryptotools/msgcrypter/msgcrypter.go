@@ -23,3 +23,7 @@ func (mc *MessageCrypter) Decrypt(ciphertext []byte) ([]byte, error) {
 func (mc *MessageCrypter) PubKey() []byte {
 	return mc.crypter.PubKey()
 }
+
+func (mc *MessageCrypter) ValidateKey(pubKey []byte) error {
+	return mc.crypter.ValidateKey(pubKey)
+}
@@ -26,6 +26,11 @@ func (m *mockAsymmetric) PubKey() []byte {
 	return args.Get(0).([]byte)
 }
 
+func (m *mockAsymmetric) ValidateKey(pubKey []byte) error {
+	args := m.Called(pubKey)
+	return args.Error(0)
+}
+
 func TestMessageCrypter(t *testing.T) {
 	m := new(mockAsymmetric)
 	mc := New(m)
@@ -0,0 +1,39 @@
+// Padding marks what is inside a chat frame, before the encryption.
+//
+// RSA-OAEP ciphertext is always the key size, so the frame size doesn't
+// tell the text length and the text goes as is. Dummy frames for the cover
+// traffic use the same format and are dropped by the receiver.
+// Format: 1 byte kind | text.
+package padding
+
+import "errors"
+
+// bytes taken from the text the crypter can carry
+const Overhead = 1
+
+type Kind byte
+
+const (
+	Data  Kind = iota // chat message
+	Dummy             // cover traffic, nobody reads it
+)
+
+var ErrMalformed = errors.New("malformed padding")
+
+func Pad(kind Kind, text []byte) []byte {
+	out := make([]byte, Overhead+len(text))
+	out[0] = byte(kind)
+	copy(out[Overhead:], text)
+	return out
+}
+
+func Unpad(data []byte) (Kind, []byte, error) {
+	if len(data) < Overhead {
+		return 0, nil, ErrMalformed
+	}
+	kind := Kind(data[0])
+	if kind != Data && kind != Dummy {
+		return 0, nil, ErrMalformed
+	}
+	return kind, data[Overhead:], nil
+}
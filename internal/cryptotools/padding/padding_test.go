@@ -0,0 +1,47 @@
+package padding
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		name string
+		text []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hi")},
+		{"long", bytes.Repeat([]byte("a"), 189)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			padded := Pad(Data, tt.text)
+			assert.Len(t, padded, Overhead+len(tt.text))
+			kind, text, err := Unpad(padded)
+			require.NoError(t, err)
+			assert.Equal(t, Data, kind)
+			assert.True(t, bytes.Equal(tt.text, text))
+		})
+	}
+
+	t.Run("dummy", func(t *testing.T) {
+		kind, text, err := Unpad(Pad(Dummy, nil))
+		require.NoError(t, err)
+		assert.Equal(t, Dummy, kind)
+		assert.Empty(t, text)
+	})
+}
+
+func TestUnpadMalformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":        {},
+		"unknown kind": {7, 'a'},
+	} {
+		_, _, err := Unpad(data)
+		assert.ErrorIs(t, err, ErrMalformed, name)
+	}
+}
@@ -0,0 +1,100 @@
+// Client puzzle to make connection floods expensive.
+//
+// Server sends a random challenge with a difficulty,
+// client has to find a nonce so that sha256(challenge || nonce)
+// starts with `difficulty` zero bits.
+// Solving takes ~2^difficulty hashes, checking takes one.
+package pow
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+const challengeSize = 16
+
+// don't let a malicious server make us spin forever
+const MaxDifficulty = 30
+
+var ErrInvalidSolution = errors.New("invalid puzzle solution")
+
+type Challenge struct {
+	Difficulty uint8
+	Data       [challengeSize]byte
+}
+
+func NewChallenge(difficulty int) (*Challenge, error) {
+	if difficulty < 0 || difficulty > MaxDifficulty {
+		return nil, fmt.Errorf("invalid difficulty: %d", difficulty)
+	}
+	c := &Challenge{Difficulty: uint8(difficulty)}
+	if _, err := rand.Read(c.Data[:]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// difficulty byte + challenge data
+func (c *Challenge) Marshal() []byte {
+	b := make([]byte, 1+challengeSize)
+	b[0] = c.Difficulty
+	copy(b[1:], c.Data[:])
+	return b
+}
+
+func Unmarshal(b []byte) (*Challenge, error) {
+	if len(b) != 1+challengeSize {
+		return nil, fmt.Errorf("invalid challenge len: %d", len(b))
+	}
+	if b[0] > MaxDifficulty {
+		return nil, fmt.Errorf("challenge difficulty is too high: %d", b[0])
+	}
+	c := &Challenge{Difficulty: b[0]}
+	copy(c.Data[:], b[1:])
+	return c, nil
+}
+
+// brute force the nonce, returns it as 8 bytes
+func (c *Challenge) Solve(ctx context.Context) ([]byte, error) {
+	nonce := make([]byte, 8)
+	for n := uint64(0); ; n++ {
+		// check for cancel once in a while
+		if n&0xFFF == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		binary.BigEndian.PutUint64(nonce, n)
+		if c.check(nonce) {
+			return nonce, nil
+		}
+	}
+}
+
+func (c *Challenge) Verify(nonce []byte) error {
+	if len(nonce) != 8 || !c.check(nonce) {
+		return ErrInvalidSolution
+	}
+	return nil
+}
+
+func (c *Challenge) check(nonce []byte) bool {
+	h := sha256.New()
+	h.Write(c.Data[:])
+	h.Write(nonce)
+	return leadingZeros(h.Sum(nil)) >= int(c.Difficulty)
+}
+
+func leadingZeros(b []byte) int {
+	n := 0
+	for _, v := range b {
+		if v != 0 {
+			return n + bits.LeadingZeros8(v)
+		}
+		n += 8
+	}
+	return n
+}
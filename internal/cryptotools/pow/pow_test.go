@@ -0,0 +1,63 @@
+package pow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPuzzle(t *testing.T) {
+	t.Run("Solve and Verify", func(t *testing.T) {
+		c, err := NewChallenge(12)
+		require.NoError(t, err)
+
+		nonce, err := c.Solve(context.Background())
+		require.NoError(t, err)
+		assert.NoError(t, c.Verify(nonce))
+
+		// solution is bound to the challenge
+		other, err := NewChallenge(12)
+		require.NoError(t, err)
+		if other.Verify(nonce) == nil {
+			// 1 in 4096 chance to pass by luck, check with a harder one
+			other.Difficulty = 24
+			assert.Error(t, other.Verify(nonce))
+		}
+		assert.Error(t, c.Verify([]byte("short")))
+	})
+
+	t.Run("Marshal and Unmarshal", func(t *testing.T) {
+		c, err := NewChallenge(20)
+		require.NoError(t, err)
+		c2, err := Unmarshal(c.Marshal())
+		require.NoError(t, err)
+		assert.Equal(t, c, c2)
+
+		_, err = Unmarshal([]byte{1, 2, 3})
+		assert.Error(t, err)
+
+		// too hard to solve
+		b := c.Marshal()
+		b[0] = MaxDifficulty + 1
+		_, err = Unmarshal(b)
+		assert.Error(t, err)
+	})
+
+	t.Run("Solve is cancelable", func(t *testing.T) {
+		c, err := NewChallenge(MaxDifficulty)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = c.Solve(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("leading zeros", func(t *testing.T) {
+		assert.Equal(t, 0, leadingZeros([]byte{0x80}))
+		assert.Equal(t, 7, leadingZeros([]byte{0x01}))
+		assert.Equal(t, 12, leadingZeros([]byte{0x00, 0x0F}))
+		assert.Equal(t, 16, leadingZeros([]byte{0x00, 0x00}))
+	})
+}
@@ -0,0 +1,209 @@
+// Streamcrypt seals a stream with its own AES-GCM key.
+//
+// The side that opens the stream makes a random key and sends it first,
+// encrypted with the peer public key, so only the peer can read it. Then
+// both ways go as sealed records, the nonce is the direction and the record
+// number, so a record can't be dropped, moved or replayed. An empty record
+// ends the direction, EOF without it is a cut stream.
+//
+// Key: 2 bytes len | encrypted key. Record: 4 bytes len | sealed data.
+package streamcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	keySize = 32
+	// max data in one record
+	recordSize = 16 << 10
+	maxKey     = 1024
+)
+
+var ErrMalformed = errors.New("malformed encrypted stream")
+
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// sealed conn, deadlines and addresses are the ones of the inner conn
+type Conn struct {
+	net.Conn
+	gcm cipher.AEAD
+
+	rmu    sync.Mutex
+	rbuf   []byte
+	rseq   uint64
+	rdir   byte
+	rended bool
+
+	wmu    sync.Mutex
+	wseq   uint64
+	wdir   byte
+	wended bool
+}
+
+// make the key and send it, encryptKey seals it for the peer
+func Client(conn net.Conn, encryptKey func([]byte) ([]byte, error)) (*Conn, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	sealed, err := encryptKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) > maxKey {
+		return nil, fmt.Errorf("%w: key of %d bytes", ErrMalformed, len(sealed))
+	}
+	msg := make([]byte, 2, 2+len(sealed))
+	binary.BigEndian.PutUint16(msg, uint16(len(sealed)))
+	if _, err := conn.Write(append(msg, sealed...)); err != nil {
+		return nil, err
+	}
+	return newConn(conn, key, 0)
+}
+
+// read the key the peer has sent
+func Server(conn net.Conn, decryptKey func([]byte) ([]byte, error)) (*Conn, error) {
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(size)
+	if n > maxKey {
+		return nil, fmt.Errorf("%w: key of %d bytes", ErrMalformed, n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(conn, sealed); err != nil {
+		return nil, err
+	}
+	key, err := decryptKey(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("%w: bad key", ErrMalformed)
+	}
+	return newConn(conn, key, 1)
+}
+
+func newConn(conn net.Conn, key []byte, dir byte) (*Conn, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, gcm: gcm, wdir: dir, rdir: 1 - dir}, nil
+}
+
+// direction | record number, the key is new for every stream
+func (c *Conn) nonce(dir byte, seq uint64) []byte {
+	n := make([]byte, c.gcm.NonceSize())
+	n[0] = dir
+	binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+	return n
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 {
+		if c.rended {
+			return 0, io.EOF
+		}
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *Conn) readRecord() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		if err == io.EOF {
+			// the peer didn't say it is done
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > recordSize+uint32(c.gcm.Overhead()) {
+		return fmt.Errorf("%w: record of %d bytes", ErrMalformed, size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	plain, err := c.gcm.Open(nil, c.nonce(c.rdir, c.rseq), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("%w: can't decrypt record %d", ErrMalformed, c.rseq)
+	}
+	c.rseq++
+	if len(plain) == 0 {
+		c.rended = true
+	}
+	c.rbuf = plain
+	return nil
+}
+
+// cut into records
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wended {
+		return 0, net.ErrClosed
+	}
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > recordSize {
+			n = recordSize
+		}
+		if err := c.writeRecord(p[written : written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c *Conn) writeRecord(data []byte) error {
+	sealed := c.gcm.Seal(nil, c.nonce(c.wdir, c.wseq), data, nil)
+	c.wseq++
+	record := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(record, uint32(len(sealed)))
+	_, err := c.Conn.Write(append(record, sealed...))
+	return err
+}
+
+// end record, then the half close of the inner conn if it has one
+func (c *Conn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wended {
+		return nil
+	}
+	c.wended = true
+	if err := c.writeRecord(nil); err != nil {
+		return err
+	}
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
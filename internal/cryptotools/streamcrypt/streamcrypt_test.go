@@ -0,0 +1,135 @@
+package streamcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the key wrap is rsa in the app, not needed here
+func plainKey(key []byte) ([]byte, error) {
+	return key, nil
+}
+
+// sealed pair over a pipe, wrap goes under the client
+func pair(t *testing.T, wrap func(net.Conn) net.Conn) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	server := make(chan *Conn, 1)
+	go func() {
+		conn, err := Server(b, plainKey)
+		assert.NoError(t, err)
+		server <- conn
+	}()
+	client, err := Client(wrap(a), plainKey)
+	require.NoError(t, err)
+	return client, <-server
+}
+
+func same(conn net.Conn) net.Conn {
+	return conn
+}
+
+func TestRoundTrip(t *testing.T) {
+	client, server := pair(t, same)
+	up := make([]byte, 3*recordSize+100)
+	rand.Read(up)
+
+	go func() {
+		client.Write(up)
+		client.CloseWrite()
+	}()
+	got, err := io.ReadAll(server)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(up, got))
+
+	// the other way has its own nonces
+	go func() {
+		server.Write([]byte("back"))
+		server.CloseWrite()
+	}()
+	got, err = io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "back", string(got))
+
+	_, err = client.Write([]byte("late"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestCutStream(t *testing.T) {
+	client, server := pair(t, same)
+	go func() {
+		client.Write([]byte("half"))
+		client.Conn.Close()
+	}()
+	_, err := io.ReadAll(server)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+// flips a bit of everything written after the key
+type tamper struct {
+	net.Conn
+	writes int
+}
+
+func (t *tamper) Write(p []byte) (int, error) {
+	t.writes++
+	if t.writes > 1 {
+		p = append([]byte(nil), p...)
+		p[len(p)-1] ^= 1
+	}
+	return t.Conn.Write(p)
+}
+
+func TestTampered(t *testing.T) {
+	client, server := pair(t, func(conn net.Conn) net.Conn {
+		return &tamper{Conn: conn}
+	})
+	go client.Write([]byte("pay 10"))
+	_, err := server.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestWrongKey(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		client, err := Client(a, plainKey)
+		if err == nil {
+			client.Write([]byte("secret"))
+		}
+	}()
+	wrongKey := func([]byte) ([]byte, error) { return make([]byte, keySize), nil }
+	server, err := Server(b, wrongKey)
+	require.NoError(t, err)
+	_, err = server.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+// record numbers start over on every stream, the key must not repeat.
+// a resumed file transfer is a new stream
+func TestKeyPerStream(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 2; i++ {
+		a, b := net.Pipe()
+		go io.Copy(io.Discard, b)
+		_, err := Client(a, func(key []byte) ([]byte, error) {
+			keys = append(keys, key)
+			return key, nil
+		})
+		require.NoError(t, err)
+		a.Close()
+		b.Close()
+	}
+	require.Len(t, keys, 2)
+	assert.NotEqual(t, keys[0], keys[1])
+}
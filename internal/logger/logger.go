@@ -2,7 +2,9 @@ package logger
 
 // import logrus
 import (
+	"io"
 	"os"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -11,6 +13,27 @@ type Logger struct {
 	*logrus.Logger
 }
 
+// shared by all loggers, so the ones made at init follow SetOutput too
+var output = &writer{w: os.Stdout}
+
+type writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// pipe mode keeps stdout for the data
+func SetOutput(w io.Writer) {
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	output.w = w
+}
+
 func New() *Logger {
 	log := initLogger()
 	return &Logger{log}
@@ -23,7 +46,7 @@ func initLogger() *logrus.Logger {
 	var format logrus.TextFormatter
 	format.ForceColors = true
 	format.DisableTimestamp = true
-	log.Out = os.Stdout
+	log.Out = output
 	log.SetFormatter(&format)
 
 	if os.Getenv("DEBUG") == "1" {
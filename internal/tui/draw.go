@@ -0,0 +1,199 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+const prompt = "> "
+
+var (
+	styleText    = tcell.StyleDefault
+	styleInfo    = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	styleStatus  = tcell.StyleDefault.Reverse(true)
+	styleSending = tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	styleOK      = tcell.StyleDefault.Foreground(tcell.ColorGreen)
+	styleFailed  = tcell.StyleDefault.Foreground(tcell.ColorRed)
+)
+
+// one screen row of the scrollback, marker is on the first row of our messages
+type row struct {
+	text   string
+	style  tcell.Style
+	marker string
+	mstyle tcell.Style
+}
+
+// scrollback, status bar and the input line from the bottom up
+func (u *UI) draw() {
+	u.screen.Clear()
+	w, h := u.screen.Size()
+	if w > 0 && h > 0 {
+		u.drawInput(w, h-1)
+	}
+	if h > 1 {
+		u.drawStatus(w, h-2)
+	}
+	if h > 2 {
+		u.drawLines(w, h-2)
+	}
+	u.screen.Show()
+}
+
+func (u *UI) drawLines(w, height int) {
+	// gutter for the delivery markers
+	rows := u.rows(w - 2)
+	if max := len(rows) - height; u.scroll > max {
+		u.scroll = max
+	}
+	if u.scroll < 0 {
+		u.scroll = 0
+	}
+	end := len(rows) - u.scroll
+	start := end - height
+	if start < 0 {
+		start = 0
+	}
+	// new lines come from the bottom
+	y := height - (end - start)
+	for _, r := range rows[start:end] {
+		if r.marker != "" {
+			drawText(u.screen, 0, y, 2, r.marker, r.mstyle)
+		}
+		drawText(u.screen, 2, y, w, r.text, r.style)
+		y++
+	}
+}
+
+func (u *UI) rows(width int) []row {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var rows []row
+	for _, l := range u.lines {
+		style := styleText
+		if l.kind == info {
+			style = styleInfo
+		}
+		for i, text := range wrap(l.text, width) {
+			r := row{text: text, style: style}
+			if i == 0 && l.kind == outgoing {
+				r.marker, r.mstyle = marker(l.state)
+			}
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+func marker(state delivery) (string, tcell.Style) {
+	switch state {
+	case delivered:
+		return "☑︎", styleOK
+	case failed:
+		return "✗", styleFailed
+	default:
+		return "⧗", styleSending
+	}
+}
+
+// peers on the left, the link on the right
+func (u *UI) drawStatus(w, y int) {
+	for x := 0; x < w; x++ {
+		u.screen.SetContent(x, y, ' ', nil, styleStatus)
+	}
+	left := " no authenticated peer"
+	if len(u.status) > 0 {
+		s := u.status[0]
+		trust := "not verified"
+		if s.Verified {
+			trust = "verified"
+		}
+		left = fmt.Sprintf(" <%s> %s · %s", s.Name, trust, s.Health)
+		if len(u.status) > 1 {
+			left += fmt.Sprintf(" +%d", len(u.status)-1)
+		}
+	}
+	if u.scroll > 0 {
+		left += fmt.Sprintf(" · ↑%d", u.scroll)
+	}
+	link := "waiting"
+	if len(u.status) > 0 {
+		link = "connected"
+	} else if u.reconnect != "" {
+		link = u.reconnect
+	}
+	connector := u.chat.Connector().String()
+	if u.link != "" {
+		connector += " " + u.link
+	}
+	right := fmt.Sprintf("%s · %s ", connector, link)
+	drawText(u.screen, 0, y, w, left, styleStatus)
+	if x := w - runewidth.StringWidth(right); x > runewidth.StringWidth(left) {
+		drawText(u.screen, x, y, w, right, styleStatus)
+	}
+}
+
+// long input scrolls sideways to keep the cursor on the screen
+func (u *UI) drawInput(w, y int) {
+	x := drawText(u.screen, 0, y, w, prompt, styleInfo)
+	text := u.input.text
+	space := w - x - 1
+	start := 0
+	for start < u.input.cursor && runewidth.StringWidth(string(text[start:u.input.cursor])) > space {
+		start++
+	}
+	cursor := x + runewidth.StringWidth(string(text[start:u.input.cursor]))
+	drawText(u.screen, x, y, w, string(text[start:]), styleText)
+	u.screen.ShowCursor(cursor, y)
+}
+
+// returns x after the text, cut at maxX
+func drawText(s tcell.Screen, x, y, maxX int, text string, style tcell.Style) int {
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		// variation selectors and such go with the rune before
+		var comb []rune
+		for i+1 < len(runes) && runewidth.RuneWidth(runes[i+1]) == 0 {
+			comb = append(comb, runes[i+1])
+			i++
+		}
+		width := runewidth.RuneWidth(r)
+		if width == 0 {
+			continue
+		}
+		if x+width > maxX {
+			break
+		}
+		s.SetContent(x, y, r, comb, style)
+		x += width
+	}
+	return x
+}
+
+// split to rows of the width, by the cells, not the bytes
+func wrap(text string, width int) []string {
+	if width < 1 {
+		width = 1
+	}
+	var rows []string
+	for _, part := range strings.Split(text, "\n") {
+		var b strings.Builder
+		used := 0
+		for _, r := range part {
+			rw := runewidth.RuneWidth(r)
+			if used+rw > width && used > 0 {
+				rows = append(rows, b.String())
+				b.Reset()
+				used = 0
+			}
+			b.WriteRune(r)
+			used += rw
+		}
+		rows = append(rows, b.String())
+	}
+	return rows
+}
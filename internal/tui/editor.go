@@ -0,0 +1,127 @@
+package tui
+
+import "unicode"
+
+const historySize = 100
+
+// input line with the cursor and the sent lines history
+type editor struct {
+	text    []rune
+	cursor  int
+	history []string
+	pos     int    // position in history, len(history) is the draft
+	draft   string // what was typed before going up the history
+}
+
+func (e *editor) String() string {
+	return string(e.text)
+}
+
+func (e *editor) insert(r rune) {
+	e.text = append(e.text, 0)
+	copy(e.text[e.cursor+1:], e.text[e.cursor:])
+	e.text[e.cursor] = r
+	e.cursor++
+}
+
+func (e *editor) backspace() {
+	if e.cursor == 0 {
+		return
+	}
+	e.text = append(e.text[:e.cursor-1], e.text[e.cursor:]...)
+	e.cursor--
+}
+
+func (e *editor) delete() {
+	if e.cursor == len(e.text) {
+		return
+	}
+	e.text = append(e.text[:e.cursor], e.text[e.cursor+1:]...)
+}
+
+func (e *editor) left() {
+	if e.cursor > 0 {
+		e.cursor--
+	}
+}
+
+func (e *editor) right() {
+	if e.cursor < len(e.text) {
+		e.cursor++
+	}
+}
+
+func (e *editor) home() {
+	e.cursor = 0
+}
+
+func (e *editor) end() {
+	e.cursor = len(e.text)
+}
+
+// ctrl+u
+func (e *editor) killBefore() {
+	e.text = append([]rune(nil), e.text[e.cursor:]...)
+	e.cursor = 0
+}
+
+// ctrl+k
+func (e *editor) killAfter() {
+	e.text = e.text[:e.cursor]
+}
+
+// ctrl+w, spaces and then the word before the cursor
+func (e *editor) killWord() {
+	start := e.cursor
+	for start > 0 && unicode.IsSpace(e.text[start-1]) {
+		start--
+	}
+	for start > 0 && !unicode.IsSpace(e.text[start-1]) {
+		start--
+	}
+	e.text = append(e.text[:start], e.text[e.cursor:]...)
+	e.cursor = start
+}
+
+func (e *editor) set(text string) {
+	e.text = []rune(text)
+	e.cursor = len(e.text)
+}
+
+// take the line and keep it in the history, empty lines are not kept
+func (e *editor) submit() string {
+	line := string(e.text)
+	if line != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+		e.history = append(e.history, line)
+		if len(e.history) > historySize {
+			e.history = e.history[1:]
+		}
+	}
+	e.pos = len(e.history)
+	e.draft = ""
+	e.set("")
+	return line
+}
+
+func (e *editor) up() {
+	if e.pos == 0 {
+		return
+	}
+	if e.pos == len(e.history) {
+		e.draft = string(e.text)
+	}
+	e.pos--
+	e.set(e.history[e.pos])
+}
+
+func (e *editor) down() {
+	if e.pos == len(e.history) {
+		return
+	}
+	e.pos++
+	if e.pos == len(e.history) {
+		e.set(e.draft)
+		return
+	}
+	e.set(e.history[e.pos])
+}
@@ -0,0 +1,83 @@
+package tui
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func typed(e *editor, s string) {
+	for _, r := range s {
+		e.insert(r)
+	}
+}
+
+func TestEditor(t *testing.T) {
+	e := &editor{}
+	typed(e, "spice flow")
+	e.left()
+	e.left()
+	e.left()
+	e.left()
+	typed(e, "must ")
+	assert.Equal(t, "spice must flow", e.String())
+
+	e.home()
+	e.delete()
+	typed(e, "S")
+	e.end()
+	e.backspace()
+	assert.Equal(t, "Spice must flo", e.String())
+
+	e.killWord()
+	assert.Equal(t, "Spice must ", e.String())
+	e.killWord()
+	assert.Equal(t, "Spice ", e.String())
+
+	e.left()
+	e.killAfter()
+	assert.Equal(t, "Spice", e.String())
+	e.left()
+	e.killBefore()
+	assert.Equal(t, "e", e.String())
+	assert.Equal(t, 0, e.cursor)
+
+	// nothing happens at the edges
+	e.left()
+	e.backspace()
+	e.end()
+	e.right()
+	e.delete()
+	assert.Equal(t, "e", e.String())
+}
+
+func TestEditorWide(t *testing.T) {
+	e := &editor{}
+	typed(e, "шай🐛")
+	e.backspace()
+	e.left()
+	typed(e, "-")
+	assert.Equal(t, "ша-й", e.String())
+}
+
+func TestHistory(t *testing.T) {
+	e := &editor{}
+	for _, line := range []string{"first", "second", "second", ""} {
+		typed(e, line)
+		assert.Equal(t, line, e.submit())
+	}
+	assert.Equal(t, []string{"first", "second"}, e.history, "no repeats and empty lines")
+
+	typed(e, "draft")
+	e.up()
+	assert.Equal(t, "second", e.String())
+	e.up()
+	e.up()
+	assert.Equal(t, "first", e.String())
+	e.down()
+	assert.Equal(t, "second", e.String())
+	e.down()
+	assert.Equal(t, "draft", e.String(), "back to what was typed")
+	e.down()
+	assert.Equal(t, "draft", e.String())
+}
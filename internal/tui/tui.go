@@ -0,0 +1,299 @@
+// TUI is the full screen chat: scrollback, status bar and the input line.
+//
+// It is one more subscriber of the client events, like the line CLI.
+// Logs go to the scrollback too, so nothing writes over the input.
+package tui
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client"
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// older lines are dropped
+const maxLines = 1000
+
+// what the ui needs from the chat
+type Chat interface {
+	Subscribe() (<-chan events.Event, func())
+	SendText(text string) (uint64, error)
+	Command(line string, out io.Writer) bool
+	Status() []client.PeerStatus
+	Connector() client.ConnectionType
+	ConnectorStatus() string
+}
+
+type kind int
+
+const (
+	info kind = iota // events, logs and command replies
+	incoming
+	outgoing
+)
+
+type delivery int
+
+const (
+	sending delivery = iota
+	delivered
+	failed
+)
+
+type line struct {
+	kind  kind
+	text  string
+	seq   uint64 // outgoing only
+	state delivery
+}
+
+type UI struct {
+	chat        Chat
+	events      <-chan events.Event
+	unsubscribe func()
+	screen      tcell.Screen
+	input       editor
+	scroll      int // rows up from the bottom
+	status      []client.PeerStatus
+	link        string     // connector state, asked on the ticker
+	reconnect   string     // last reconnect attempt, until the next handshake
+	mu          sync.Mutex // guards lines, logs come from everywhere
+	lines       []line
+	wake        chan struct{}
+}
+
+// subscribes right away, so the events before Run are kept
+func New(chat Chat) *UI {
+	ch, unsubscribe := chat.Subscribe()
+	return &UI{
+		chat:        chat,
+		events:      ch,
+		unsubscribe: unsubscribe,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// logrus colors
+var ansi = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// Write adds log lines and command replies to the scrollback
+func (u *UI) Write(p []byte) (int, error) {
+	text := ansi.ReplaceAllString(string(p), "")
+	for _, s := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		u.add(line{kind: info, text: strings.TrimRight(s, " ")})
+	}
+	return len(p), nil
+}
+
+func (u *UI) add(l line) {
+	u.mu.Lock()
+	u.lines = append(u.lines, l)
+	if len(u.lines) > maxLines {
+		u.lines = u.lines[len(u.lines)-maxLines:]
+	}
+	u.mu.Unlock()
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run takes the terminal until the context is done
+func (u *UI) Run(ctx context.Context) error {
+	defer u.unsubscribe()
+	if u.screen == nil {
+		screen, err := tcell.NewScreen()
+		if err != nil {
+			return fmt.Errorf("no terminal: %w", err)
+		}
+		u.screen = screen
+	}
+	if err := u.screen.Init(); err != nil {
+		return fmt.Errorf("no terminal: %w", err)
+	}
+	defer u.screen.Fini()
+
+	keys := make(chan tcell.Event)
+	quit := make(chan struct{})
+	defer close(quit)
+	go u.screen.ChannelEvents(keys, quit)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	u.refresh()
+	for {
+		u.draw()
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-keys:
+			u.handle(ev)
+		case e, ok := <-u.events:
+			if !ok {
+				return nil
+			}
+			u.event(e)
+		case <-u.wake:
+		case <-ticker.C:
+			u.refresh()
+		}
+	}
+}
+
+func (u *UI) handle(ev tcell.Event) {
+	switch ev := ev.(type) {
+	case *tcell.EventResize:
+		u.screen.Sync()
+	case *tcell.EventKey:
+		u.key(ev)
+	case *textEvent:
+		u.send(ev.text)
+	}
+}
+
+// input that is not a command after all, back from the command goroutine
+type textEvent struct {
+	tcell.EventTime
+	text string
+}
+
+func (u *UI) key(ev *tcell.EventKey) {
+	_, h := u.screen.Size()
+	page := h - 3
+	if page < 1 {
+		page = 1
+	}
+	switch ev.Key() {
+	case tcell.KeyEnter:
+		u.submit()
+	case tcell.KeyCtrlC:
+		go u.chat.Command("/quit", u)
+	case tcell.KeyCtrlD:
+		if len(u.input.text) == 0 {
+			go u.chat.Command("/quit", u)
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		u.input.backspace()
+	case tcell.KeyDelete:
+		u.input.delete()
+	case tcell.KeyLeft:
+		u.input.left()
+	case tcell.KeyRight:
+		u.input.right()
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		u.input.home()
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		u.input.end()
+	case tcell.KeyCtrlU:
+		u.input.killBefore()
+	case tcell.KeyCtrlK:
+		u.input.killAfter()
+	case tcell.KeyCtrlW:
+		u.input.killWord()
+	case tcell.KeyUp:
+		u.input.up()
+	case tcell.KeyDown:
+		u.input.down()
+	case tcell.KeyPgUp:
+		u.scroll += page
+	case tcell.KeyPgDn:
+		u.scroll -= page
+		if u.scroll < 0 {
+			u.scroll = 0
+		}
+	case tcell.KeyRune:
+		u.input.insert(ev.Rune())
+	}
+}
+
+func (u *UI) submit() {
+	text := u.input.submit()
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return
+	}
+	u.scroll = 0
+	if strings.HasPrefix(trimmed, "/") {
+		// off the ui loop, /send hashes the file and /quit waits for the acks.
+		// replies come through Write
+		go func() {
+			if u.chat.Command(trimmed, u) {
+				return
+			}
+			ev := &textEvent{text: text}
+			ev.SetEventNow()
+			if err := u.screen.PostEvent(ev); err != nil {
+				u.add(line{kind: info, text: "✗ " + err.Error()})
+			}
+		}()
+		return
+	}
+	u.send(text)
+}
+
+func (u *UI) send(text string) {
+	seq, err := u.chat.SendText(text)
+	if err != nil {
+		// back to the input to make it shorter
+		u.input.set(text)
+		u.add(line{kind: info, text: "✗ " + err.Error()})
+		return
+	}
+	u.add(line{
+		kind: outgoing,
+		text: fmt.Sprintf("%s <you> %s", time.Now().Format("15:04:05"), text),
+		seq:  seq,
+	})
+}
+
+// status bar, not on every draw, the tor state is a control port query
+func (u *UI) refresh() {
+	u.status = u.chat.Status()
+	u.link = u.chat.ConnectorStatus()
+}
+
+func (u *UI) event(e events.Event) {
+	switch e := e.(type) {
+	case events.Delivered:
+		u.mark(e.Seq, delivered)
+	case events.Undelivered:
+		u.mark(e.Seq, failed)
+	case events.MessageReceived:
+		u.add(line{kind: incoming, text: strings.TrimRight(e.String(), "\n")})
+	case events.Reconnecting:
+		u.reconnect = fmt.Sprintf("reconnecting %d/%d", e.Attempt, e.Max)
+		u.add(line{kind: info, text: e.String()})
+	case events.HandshakeComplete:
+		u.reconnect = ""
+		u.refresh()
+		u.add(line{kind: info, text: e.String()})
+	case events.PeerLeft:
+		u.refresh()
+		u.add(line{kind: info, text: e.String()})
+	default:
+		u.add(line{kind: info, text: e.String()})
+	}
+}
+
+// delivery marker of our message, delivered to anyone stays delivered
+func (u *UI) mark(seq uint64, state delivery) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := len(u.lines) - 1; i >= 0; i-- {
+		l := &u.lines[i]
+		if l.kind == outgoing && l.seq == seq {
+			if l.state != delivered {
+				l.state = state
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client"
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+	"github.com/1F47E/go-shaihulud/internal/client/listner"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chat without the network, the test publishes the events
+type fakeChat struct {
+	bus      *events.Bus
+	mu       sync.Mutex
+	sent     []string
+	commands []string
+	slow     chan struct{} // /slow waits for it
+	status   []client.PeerStatus
+	link     string
+}
+
+func (f *fakeChat) Subscribe() (<-chan events.Event, func()) {
+	return f.bus.Subscribe()
+}
+
+func (f *fakeChat) SendText(text string) (uint64, error) {
+	if len(text) > 20 {
+		return 0, client.ErrMessageTooLong
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, text)
+	return uint64(len(f.sent)), nil
+}
+
+func (f *fakeChat) Command(line string, out io.Writer) bool {
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "/me ") {
+		return false
+	}
+	if line == "/slow" {
+		<-f.slow
+	}
+	f.mu.Lock()
+	f.commands = append(f.commands, line)
+	f.mu.Unlock()
+	fmt.Fprintf(out, "did %s\n", line)
+	return true
+}
+
+func (f *fakeChat) Status() []client.PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]client.PeerStatus(nil), f.status...)
+}
+
+func (f *fakeChat) Connector() client.ConnectionType {
+	return client.Tor
+}
+
+func (f *fakeChat) ConnectorStatus() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.link
+}
+
+func (f *fakeChat) Sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent...)
+}
+
+type testUI struct {
+	*UI
+	chat   *fakeChat
+	screen tcell.SimulationScreen
+}
+
+func newTestUI(t *testing.T, w, h int) *testUI {
+	chat := &fakeChat{bus: events.NewBus(), slow: make(chan struct{})}
+	screen := tcell.NewSimulationScreen("UTF-8")
+	u := New(chat)
+	u.screen = screen
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		u.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	tu := &testUI{u, chat, screen}
+	// the init in Run sets its own size, the prompt is there after it
+	require.Eventually(t, func() bool {
+		_, _, sh := screen.GetContents()
+		return sh > 0 && strings.HasPrefix(tu.rows()[sh-1], ">")
+	}, time.Second, 10*time.Millisecond)
+	tu.resize(w, h)
+	return tu
+}
+
+func (u *testUI) resize(w, h int) {
+	u.screen.SetSize(w, h)
+	u.screen.PostEventWait(tcell.NewEventResize(w, h))
+}
+
+// the simulated queue is short, wait for the room
+func (u *testUI) key(k tcell.Key, r rune) {
+	u.screen.PostEventWait(tcell.NewEventKey(k, r, tcell.ModNone))
+}
+
+func (u *testUI) typeLine(text string) {
+	for _, r := range text {
+		u.key(tcell.KeyRune, r)
+	}
+	u.key(tcell.KeyEnter, 0)
+}
+
+// screen rows as text, wide runes take one place
+func (u *testUI) rows() []string {
+	cells, w, h := u.screen.GetContents()
+	// the cells are the live ones, the screen draws into them under its lock
+	lock := u.screen.(sync.Locker)
+	lock.Lock()
+	defer lock.Unlock()
+	rows := make([]string, h)
+	for y := 0; y < h; y++ {
+		var b strings.Builder
+		for x := 0; x < w; x++ {
+			b.WriteString(string(cells[y*w+x].Runes))
+		}
+		rows[y] = strings.TrimRight(b.String(), " ")
+	}
+	return rows
+}
+
+func (u *testUI) shows(t *testing.T, text string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		return strings.Contains(strings.Join(u.rows(), "\n"), text)
+	}, 2*time.Second, 10*time.Millisecond, "no %q on the screen", text)
+}
+
+func TestSendAndDeliver(t *testing.T) {
+	u := newTestUI(t, 60, 10)
+	u.typeLine("spice must flow")
+	assert.Eventually(t, func() bool {
+		return len(u.chat.Sent()) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "spice must flow", u.chat.Sent()[0])
+	u.shows(t, "⧗ ")
+	u.shows(t, "<you> spice must flow")
+
+	u.chat.bus.Publish(events.Delivered{Seq: 1, Peer: "A550", Text: "spice must flow"})
+	u.shows(t, "☑")
+	// a failure from another peer doesn't undo it
+	u.chat.bus.Publish(events.Undelivered{Seq: 1, Peer: "C2D9"})
+	u.chat.bus.Publish(events.MessageReceived{Peer: "A550", Text: "the sleeper must awaken\n", Time: time.Now()})
+	u.shows(t, "<A550> the sleeper must awaken")
+	assert.NotContains(t, strings.Join(u.rows(), "\n"), "✗")
+
+	// input line is empty again
+	rows := u.rows()
+	assert.Equal(t, ">", rows[len(rows)-1])
+}
+
+func TestTooLong(t *testing.T) {
+	u := newTestUI(t, 60, 10)
+	u.typeLine("the spice must flow, always")
+	u.shows(t, "message is too long")
+	assert.Empty(t, u.chat.Sent())
+	rows := u.rows()
+	assert.Equal(t, "> the spice must flow, always", rows[len(rows)-1], "kept for editing")
+}
+
+func TestCommands(t *testing.T) {
+	u := newTestUI(t, 60, 10)
+	u.typeLine("/status")
+	u.shows(t, "did /status")
+	assert.Empty(t, u.chat.Sent())
+
+	// not a command, goes as a message
+	u.typeLine("/me waves")
+	assert.Eventually(t, func() bool {
+		return len(u.chat.Sent()) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	u.shows(t, "<you> /me waves")
+
+	u.key(tcell.KeyCtrlC, 0)
+	assert.Eventually(t, func() bool {
+		u.chat.mu.Lock()
+		defer u.chat.mu.Unlock()
+		return len(u.chat.commands) == 2 && u.chat.commands[1] == "/quit"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestSlowCommand(t *testing.T) {
+	u := newTestUI(t, 60, 10)
+	u.typeLine("/slow")
+	// the ui is not blocked
+	u.typeLine("spice")
+	assert.Eventually(t, func() bool {
+		return len(u.chat.Sent()) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	u.shows(t, "<you> spice")
+
+	close(u.chat.slow)
+	u.shows(t, "did /slow")
+}
+
+func TestStatusBar(t *testing.T) {
+	u := newTestUI(t, 60, 10)
+	u.shows(t, "no authenticated peer")
+	u.shows(t, "tor · waiting")
+
+	// tor state comes with the ticker
+	u.chat.mu.Lock()
+	u.chat.link = "bootstrap 45%"
+	u.chat.mu.Unlock()
+	u.shows(t, "tor bootstrap 45% · waiting")
+
+	u.chat.bus.Publish(events.Reconnecting{Attempt: 2, Max: 5, Delay: time.Second})
+	u.shows(t, "tor bootstrap 45% · reconnecting 2/5")
+
+	u.chat.mu.Lock()
+	u.chat.status = []client.PeerStatus{{Name: "A550", Health: listner.Health{Latency: 42 * time.Millisecond}}}
+	u.chat.link = "circuit up"
+	u.chat.mu.Unlock()
+	u.chat.bus.Publish(events.HandshakeComplete{Peer: "A550"})
+	u.shows(t, "<A550> not verified · ok 42ms")
+	u.shows(t, "tor circuit up · connected")
+	rows := u.rows()
+	assert.Contains(t, rows[len(rows)-2], "not verified", "status is above the input")
+
+	u.chat.mu.Lock()
+	u.chat.status[0].Verified = true
+	u.chat.mu.Unlock()
+	u.shows(t, "<A550> verified · ok 42ms")
+}
+
+func TestLogsAndResize(t *testing.T) {
+	u := newTestUI(t, 60, 10)
+	fmt.Fprintf(u, "\x1b[36mINFO\x1b[0m %s   \n", strings.Repeat("long ", 20))
+	u.shows(t, "INFO long long")
+	assert.NotContains(t, strings.Join(u.rows(), ""), "\x1b")
+
+	u.resize(20, 8)
+	assert.Eventually(t, func() bool {
+		rows := u.rows()
+		// wrapped to the new width, the last log row is right above the status
+		return len(rows) == 8 && rows[5] == "  long long long"
+	}, 2*time.Second, 10*time.Millisecond, "%q", u.rows())
+}
+
+func TestScroll(t *testing.T) {
+	u := newTestUI(t, 30, 6)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(u, "line %d\n", i)
+	}
+	u.shows(t, "line 19")
+	u.key(tcell.KeyPgUp, 0)
+	u.shows(t, "↑3")
+	assert.Eventually(t, func() bool {
+		return !strings.Contains(strings.Join(u.rows(), "\n"), "line 19")
+	}, 2*time.Second, 10*time.Millisecond)
+	// sending goes back to the bottom
+	u.typeLine("hi")
+	u.shows(t, "<you> hi")
+}
+
+func TestWrap(t *testing.T) {
+	assert.Equal(t, []string{"abc", "de"}, wrap("abcde", 3))
+	assert.Equal(t, []string{"шай", "хул", "уд"}, wrap("шайхулуд", 3))
+	assert.Equal(t, []string{"🐛", "🐛"}, wrap("🐛🐛", 3), "wide runes take two cells")
+	assert.Equal(t, []string{"a", "", "b"}, wrap("a\n\nb", 10))
+	assert.Equal(t, []string{""}, wrap("", 10))
+}
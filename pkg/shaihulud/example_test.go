@@ -0,0 +1,51 @@
+package shaihulud_test
+
+import (
+	"fmt"
+
+	"github.com/1F47E/go-shaihulud/pkg/shaihulud"
+)
+
+func Example() {
+	host, err := shaihulud.New(shaihulud.WithConnector(shaihulud.Memory)).Host()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer host.Close()
+
+	// the key and password go to the other side
+	guest, err := shaihulud.New(shaihulud.WithConnector(shaihulud.Memory)).Join(host.Key(), host.Password())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer guest.Close()
+
+	guest.Send("hello")
+	msg := <-host.Messages()
+	fmt.Println(msg.Text)
+	// Output: hello
+}
+
+// the local connector is tcp on localhost:3000, for two programs on one machine.
+// it is not run by go test, the fixed port can be taken, TestHostJoinLocal runs it when it is free
+func Example_local() {
+	host, err := shaihulud.New(shaihulud.WithConnector(shaihulud.Local)).Host()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer host.Close()
+
+	guest, err := shaihulud.New(shaihulud.WithConnector(shaihulud.Local)).Join(host.Key(), host.Password())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer guest.Close()
+
+	guest.Send("hello over tcp")
+	msg := <-host.Messages()
+	fmt.Println(msg.Text)
+}
@@ -0,0 +1,167 @@
+package shaihulud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client"
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+	"github.com/1F47E/go-shaihulud/internal/client/message"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+)
+
+var (
+	ErrClosed          = errors.New("session is closed")
+	ErrWrongPassword   = client.ErrWrongPassword
+	ErrMalformedKey    = client.ErrMalformedKey
+	ErrPeerUnreachable = client.ErrPeerUnreachable
+	ErrHandshakeFailed = client.ErrHandshakeFailed
+	ErrProtocol        = client.ErrProtocol
+	ErrMessageTooLong  = client.ErrMessageTooLong
+	ErrDropped         = errors.New("messages were read too slowly, some are lost")
+)
+
+type Message struct {
+	From string // peer name, short hash of its key
+	Text string
+	Time time.Time
+}
+
+// Session is one hosted or joined chat
+type Session struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	client   *client.Client
+	messages chan Message
+	key      string
+	password string
+	once     sync.Once
+
+	mu      sync.Mutex
+	dropped int // events the bus dropped while Messages was not read
+}
+
+func newSession(ctx context.Context, cancel context.CancelFunc, c *client.Client) *Session {
+	s := &Session{
+		ctx:      ctx,
+		cancel:   cancel,
+		client:   c,
+		messages: make(chan Message),
+	}
+	ch, _ := c.Subscribe()
+	go s.receive(ch)
+	return s
+}
+
+// messages from the peers until the session ends
+func (s *Session) receive(ch <-chan events.Event) {
+	defer close(s.messages)
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if o, ok := e.(events.Overflow); ok {
+				s.mu.Lock()
+				s.dropped += o.Dropped
+				s.mu.Unlock()
+				continue
+			}
+			msg, ok := e.(events.MessageReceived)
+			if !ok {
+				continue
+			}
+			select {
+			case s.messages <- Message{From: msg.Peer, Text: msg.Text, Time: msg.Time}:
+			case <-s.ctx.Done():
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Session) handshake(ch <-chan events.Event) error {
+	timer := time.NewTimer(cfg.HANDSHAKE_TIMEOUT)
+	defer timer.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				// unsubscribed or the bus is closed, nothing more comes
+				if err := s.client.Err(); err != nil {
+					return err
+				}
+				return ErrClosed
+			}
+			switch e := e.(type) {
+			case events.HandshakeComplete:
+				return nil
+			case events.Error:
+				return e.Err
+			}
+		case <-timer.C:
+			return fmt.Errorf("%w: timeout", ErrHandshakeFailed)
+		case <-s.ctx.Done():
+			if err := s.client.Err(); err != nil {
+				return err
+			}
+			return ErrClosed
+		}
+	}
+}
+
+// access key for the peers
+func (s *Session) Key() string {
+	return s.key
+}
+
+func (s *Session) Password() string {
+	return s.password
+}
+
+// Send queues the text for every peer, it goes out after the handshake
+// if nobody is connected yet. ErrMessageTooLong if it doesn't fit one frame
+func (s *Session) Send(text string) error {
+	if s.ctx.Err() != nil {
+		return ErrClosed
+	}
+	_, err := s.client.SendText(text)
+	return err
+}
+
+// closed when the session ends
+func (s *Session) Messages() <-chan Message {
+	return s.messages
+}
+
+// why the session has ended, nil if it was closed or is still going.
+// ErrDropped if Messages was read too slowly and some messages are lost
+func (s *Session) Err() error {
+	if err := s.client.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped > 0 {
+		return fmt.Errorf("%w: %d events", ErrDropped, s.dropped)
+	}
+	return nil
+}
+
+// Close says goodbye to the peers and stops the session
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		if s.ctx.Err() == nil {
+			s.client.Disconnect(message.DiscQuit, "")
+		}
+		s.cancel()
+		s.client.Close()
+	})
+	return nil
+}
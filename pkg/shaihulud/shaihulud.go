@@ -0,0 +1,156 @@
+// Package shaihulud embeds the encrypted chat into other programs.
+//
+// One side hosts a session and gives the access key and password to the
+// other side, which joins with them. Both get a Session to send and receive
+// messages. The defaults are the same as in the app: tor connector, rsa keys
+// and the settings from the ENVS.
+//
+//	host, err := shaihulud.New().Host()
+//	key, password := host.Key(), host.Password()
+//	...
+//	guest, err := shaihulud.New().Join(key, password)
+//	guest.Send("hello")
+package shaihulud
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/1F47E/go-shaihulud/internal/client"
+	myrsa "github.com/1F47E/go-shaihulud/internal/cryptotools/asymmetric/rsa"
+	"github.com/1F47E/go-shaihulud/internal/logger"
+)
+
+// how the peers reach each other
+type Connector int
+
+const (
+	Tor    Connector = iota // onion service, the default
+	Local                   // tcp on localhost:3000, for development
+	Socks                   // tor through the socks proxy from PROXY_ADDR
+	Unix                    // unix socket from UNIX_SOCKET, same machine only
+	Memory                  // in-process, both sides in one program
+)
+
+var connectors = map[Connector]client.ConnectionType{
+	Tor:    client.Tor,
+	Local:  client.Local,
+	Socks:  client.Socks,
+	Unix:   client.Unix,
+	Memory: client.Memory,
+}
+
+// message crypter, rsa by default
+type Crypter interface {
+	Encrypt(msg, pubKey []byte) ([]byte, error)
+	Decrypt(msg []byte) ([]byte, error)
+	PubKey() []byte
+	ValidateKey(pubKey []byte) error // check the peer public key before using it
+}
+
+type Option func(*Client)
+
+func WithConnector(c Connector) Option {
+	return func(cl *Client) { cl.connector = c }
+}
+
+func WithCrypter(c Crypter) Option {
+	return func(cl *Client) { cl.crypter = c }
+}
+
+// named host session, created on the first Host and loaded after,
+// so the onion address stays the same between runs. The password is new
+// on every Host and the access key with it, give both to the peers again
+func WithSession(name string) Option {
+	return func(cl *Client) { cl.session = name }
+}
+
+// the session ends when the context is done
+func WithContext(ctx context.Context) Option {
+	return func(cl *Client) { cl.ctx = ctx }
+}
+
+// redirects the chat logs, they go to stdout by default.
+// the log is process wide, it is shared with the host program and
+// all clients in it, the last one wins. Without the option it is left alone
+func WithLog(w io.Writer) Option {
+	return func(cl *Client) { cl.log = w }
+}
+
+// Client holds the options, every Host or Join starts a new session with them
+type Client struct {
+	ctx       context.Context
+	connector Connector
+	crypter   Crypter
+	session   string
+	log       io.Writer
+}
+
+func New(opts ...Option) *Client {
+	c := &Client{
+		ctx:       context.Background(),
+		connector: Tor,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Host starts the server, peers join with the session Key and Password.
+// Returns when it is listening
+func (c *Client) Host() (*Session, error) {
+	s, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.client.RunServer(c.session); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.key, s.password = s.client.Credentials()
+	return s, nil
+}
+
+// Join connects to the host, returns after the handshake
+func (c *Client) Join(key, password string) (*Session, error) {
+	s, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	// before the connection, so the handshake is not missed
+	ch, unsubscribe := s.client.Subscribe()
+	defer unsubscribe()
+	if err := s.client.RunClient(key, password); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.handshake(ch); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.key, s.password = key, password
+	return s, nil
+}
+
+func (c *Client) start() (*Session, error) {
+	conn, ok := connectors[c.connector]
+	if !ok {
+		return nil, fmt.Errorf("unknown connector: %d", c.connector)
+	}
+	crypter := c.crypter
+	if crypter == nil {
+		rsa, err := myrsa.New()
+		if err != nil {
+			return nil, fmt.Errorf("can't create keys: %w", err)
+		}
+		crypter = rsa
+	}
+	if c.log != nil {
+		logger.SetOutput(c.log)
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	return newSession(ctx, cancel, client.NewClient(ctx, cancel, conn, crypter)), nil
+}
@@ -0,0 +1,139 @@
+package shaihulud
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1F47E/go-shaihulud/internal/client/events"
+	cfg "github.com/1F47E/go-shaihulud/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// keep the outbox files away from the repo
+	dir, err := os.MkdirTemp("", "sdk")
+	if err != nil {
+		panic(err)
+	}
+	cfg.OUTBOX_DIR = dir
+	cfg.DOWNLOAD_DIR = filepath.Join(dir, "downloads")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func receive(t *testing.T, s *Session) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-s.Messages():
+		require.True(t, ok, "session is over")
+		return msg
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message")
+		return Message{}
+	}
+}
+
+func TestHostJoin(t *testing.T) {
+	host, err := New(WithConnector(Memory)).Host()
+	require.NoError(t, err)
+	defer host.Close()
+	require.NotEmpty(t, host.Key())
+	require.NotEmpty(t, host.Password())
+
+	guest, err := New(WithConnector(Memory)).Join(host.Key(), host.Password())
+	require.NoError(t, err)
+	defer guest.Close()
+
+	require.NoError(t, guest.Send("spice must flow"))
+	got := receive(t, host)
+	assert.Equal(t, "spice must flow", got.Text)
+	assert.NotEmpty(t, got.From)
+
+	require.NoError(t, host.Send("the sleeper must awaken"))
+	assert.Equal(t, "the sleeper must awaken", receive(t, guest).Text)
+	assert.ErrorIs(t, guest.Send(strings.Repeat("spice ", 100)), ErrMessageTooLong)
+
+	require.NoError(t, guest.Close())
+	require.NoError(t, guest.Close())
+	assert.ErrorIs(t, guest.Send("too late"), ErrClosed)
+	for range guest.Messages() {
+	}
+}
+
+// the local connector listens on the fixed localhost:3000, like the app
+func TestHostJoinLocal(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:3000")
+	if err != nil {
+		t.Skipf("localhost:3000 is busy: %v", err)
+	}
+	ln.Close()
+
+	host, err := New(WithConnector(Local)).Host()
+	require.NoError(t, err)
+	defer host.Close()
+	guest, err := New(WithConnector(Local)).Join(host.Key(), host.Password())
+	require.NoError(t, err)
+	defer guest.Close()
+
+	require.NoError(t, guest.Send("over tcp"))
+	assert.Equal(t, "over tcp", receive(t, host).Text)
+}
+
+// closed events channel ends the wait, not the timeout
+func TestHandshakeClosed(t *testing.T) {
+	s, err := New(WithConnector(Memory)).start()
+	require.NoError(t, err)
+	defer s.Close()
+	ch := make(chan events.Event)
+	close(ch)
+	assert.ErrorIs(t, s.handshake(ch), ErrClosed)
+}
+
+// events dropped by the bus show up in Err, not as a silent gap
+func TestOverflow(t *testing.T) {
+	base, err := New(WithConnector(Memory)).start()
+	require.NoError(t, err)
+	defer base.Close()
+	s := &Session{ctx: base.ctx, client: base.client, messages: make(chan Message)}
+	assert.NoError(t, s.Err())
+
+	ch := make(chan events.Event, 1)
+	ch <- events.Overflow{Dropped: 3}
+	close(ch)
+	s.receive(ch)
+	assert.ErrorIs(t, s.Err(), ErrDropped)
+}
+
+func TestJoinBadCredentials(t *testing.T) {
+	host, err := New(WithConnector(Memory)).Host()
+	require.NoError(t, err)
+	defer host.Close()
+
+	_, err = New(WithConnector(Memory)).Join(host.Key(), "0000-0000")
+	assert.ErrorIs(t, err, ErrWrongPassword)
+	_, err = New(WithConnector(Memory)).Join("not a key", host.Password())
+	assert.ErrorIs(t, err, ErrMalformedKey)
+}
+
+func TestJoinNobody(t *testing.T) {
+	// a valid key for nobody
+	host, err := New(WithConnector(Memory)).Host()
+	require.NoError(t, err)
+	key, password := host.Key(), host.Password()
+	host.Close()
+
+	_, err = New(WithConnector(Memory)).Join(key, password)
+	assert.ErrorIs(t, err, ErrPeerUnreachable)
+}
+
+func TestUnknownConnector(t *testing.T) {
+	_, err := New(WithConnector(Connector(42))).Host()
+	assert.Error(t, err)
+}